@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// isGzip reports whether the archive name asks for gzip compression.
+func isGzip(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+func cmdBackup(ctx *cli.Context) error {
+	out := ctx.Args().Get(0)
+	if out == "" {
+		return usagef("no archive given")
+	}
+	err := checkRemotePaths(ctx.String("path"))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	root := ctx.String("path")
+	if !path.IsAbs(root) {
+		cwd, err := r.Cwd()
+		if err != nil {
+			return err
+		}
+		root = path.Join(cwd, root)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if isGzip(out) {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	now := time.Now()
+	var total repl.TransferStats
+	err = r.Walk(root, func(p string, isDir bool, size int64) error {
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(p, "/"),
+			Mode:    0644,
+			Size:    size,
+			ModTime: now,
+		}
+		if isDir {
+			hdr.Name += "/"
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+			return tw.WriteHeader(hdr)
+		}
+		hdr.Typeflag = tar.TypeReg
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		info.Println("Backing up", p, "...")
+		stats, err := r.Get(tw, p)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		total = total.Add(stats)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	info.Println("Backed up", total)
+	return nil
+}
+
+func cmdRestore(ctx *cli.Context) error {
+	in := ctx.Args().Get(0)
+	if in == "" {
+		return usagef("no archive given")
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if isGzip(in) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	tr := tar.NewReader(rd)
+	dryRun := ctx.Bool("dry-run")
+	p := &plan{}
+	var r *repl.Repl
+	if !dryRun {
+		r, err = connect(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.EnterRawMode()
+		if err != nil {
+			return err
+		}
+		defer r.ExitRawMode()
+	}
+	var total repl.TransferStats
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dst := path.Clean("/" + hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if dryRun {
+				p.mkdir(dst)
+				continue
+			}
+			err = r.MkdirAll(dst)
+		case tar.TypeReg:
+			if dryRun {
+				p.put(hdr.Name, dst)
+				continue
+			}
+			info.Println("Restoring", dst, "...")
+			var stats repl.TransferStats
+			stats, err = r.PutWithOptions(dst, tr, repl.PutOptions{MakeDirs: true})
+			total = total.Add(stats)
+		default:
+			fmt.Fprintln(os.Stderr, "skipping", hdr.Name, "(not a file or directory)")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", dst, err)
+		}
+	}
+	if dryRun {
+		return p.done()
+	}
+	info.Println("Restored", total)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// benchFile is the remote file bench writes and removes afterwards.
+const benchFile = "_zap_bench.tmp"
+
+// benchPings is how many round trips bench averages the latency over.
+const benchPings = 10
+
+// benchResult is the output of bench, also printed as JSON.
+type benchResult struct {
+	Bytes        int64   `json:"bytes"`
+	RoundTripMs  float64 `json:"round_trip_ms"`
+	WriteKBps    float64 `json:"write_kbps"`
+	ReadKBps     float64 `json:"read_kbps"`
+	FlashKBps    float64 `json:"flash_write_kbps"`
+	FlashWriteMs float64 `json:"flash_write_ms"`
+}
+
+func cmdBench(ctx *cli.Context) error {
+	size := ctx.Int64("size")
+	if size <= 0 {
+		return usagef("--size must be positive, got %d", size)
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	res := benchResult{Bytes: size}
+	var total time.Duration
+	for i := 0; i < benchPings; i++ {
+		d, err := r.Ping()
+		if err != nil {
+			return err
+		}
+		total += d
+	}
+	res.RoundTripMs = ms(total / benchPings)
+	// random data so compression doesn't flatter the link
+	data := make([]byte, size)
+	rand.Read(data)
+	defer r.Rm(benchFile)
+	put, err := r.Put(benchFile, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.WriteKBps = put.KBps()
+	get, err := r.Get(ioutil.Discard, benchFile)
+	if err != nil {
+		return err
+	}
+	res.ReadKBps = get.KBps()
+	flash, err := r.FlashWrite(benchFile, size)
+	if err != nil {
+		return err
+	}
+	res.FlashWriteMs = ms(flash)
+	res.FlashKBps = repl.TransferStats{Bytes: size, Elapsed: flash}.KBps()
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	fmt.Printf("Round trip:   %.1f ms\n", res.RoundTripMs)
+	fmt.Printf("Write:        %.2f KB/s (%d bytes)\n", res.WriteKBps, size)
+	fmt.Printf("Read:         %.2f KB/s\n", res.ReadKBps)
+	fmt.Printf("Flash write:  %.2f KB/s on the device\n", res.FlashKBps)
+	return nil
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// completionScripts hook zap into each shell. They pass the words typed so
+// far to zap __complete and offer what it prints, one candidate per line.
+var completionScripts = map[string]string{
+	"bash": `_zap() {
+	local IFS=$'\n'
+	COMPREPLY=($(zap __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -F _zap zap
+`,
+	"zsh": `#compdef zap
+_zap() {
+	local -a dirs files
+	local c
+	for c in "${(@f)$(zap __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		[[ -z $c ]] && continue
+		if [[ $c == */ ]]; then dirs+=("$c"); else files+=("$c"); fi
+	done
+	(( $#dirs )) && compadd -S '' -- "${dirs[@]}"
+	(( $#files )) && compadd -- "${files[@]}"
+}
+compdef _zap zap
+`,
+	"fish": `function __zap_complete
+	set -l tokens (commandline -opc) (commandline -ct)
+	zap __complete $tokens[2..-1] 2>/dev/null
+end
+complete -c zap -f -a '(__zap_complete)'
+`,
+}
+
+// remoteCompletion lists the commands whose arguments are remote paths.
+var remoteCompletion = map[string]bool{
+	"cat": true,
+	"cd":  true,
+	"get": true,
+	"rm":  true,
+}
+
+// completeTimeout bounds the whole device exchange of a completion so a
+// missing or busy board never hangs the shell.
+const completeTimeout = time.Second * 2
+
+func cmdCompletion(ctx *cli.Context) error {
+	shell := ctx.Args().First()
+	script, ok := completionScripts[shell]
+	if !ok {
+		return usagef("unknown shell %q, want bash, zsh or fish", shell)
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// cmdComplete prints the completions of the last of the words typed after
+// zap. Errors are swallowed since the shell has no use for them.
+func cmdComplete(ctx *cli.Context) error {
+	words := ctx.Args().Slice()
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+	var command, device string
+	for i := 0; i < len(words)-1; i++ {
+		w := words[i]
+		if !strings.HasPrefix(w, "-") {
+			command = w
+			break
+		}
+		name := strings.TrimLeft(w, "-")
+		value := ""
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if flagTakesValue(ctx.App.Flags, name) && i+1 < len(words)-1 {
+			i++
+			value = words[i]
+		}
+		if name == "d" || name == "device" {
+			device = value
+		}
+	}
+	var candidates []string
+	switch {
+	case command == "":
+		for _, c := range ctx.App.Commands {
+			if !c.Hidden {
+				candidates = append(candidates, c.Name)
+			}
+		}
+	case strings.HasPrefix(cur, "-"):
+		if c := ctx.App.Command(command); c != nil {
+			for _, f := range c.Flags {
+				candidates = append(candidates, "--"+f.Names()[0])
+			}
+		}
+	case remoteCompletion[command]:
+		candidates = completeRemote(ctx, device, cur)
+	}
+	sort.Strings(candidates)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, cur) {
+			fmt.Println(c)
+		}
+	}
+	return nil
+}
+
+// flagTakesValue reports whether the flag called name is followed by a value.
+func flagTakesValue(flags []cli.Flag, name string) bool {
+	for _, f := range flags {
+		for _, n := range f.Names() {
+			if n == name {
+				_, isBool := f.(*cli.BoolFlag)
+				return !isBool
+			}
+		}
+	}
+	return false
+}
+
+// completeRemote returns the entries of the remote directory cur is in, as
+// paths starting like cur. Directories get a trailing slash. It returns
+// nothing when the device can't be reached within completeTimeout.
+func completeRemote(ctx *cli.Context, device, cur string) []string {
+	opts, err := connectOptions(ctx)
+	if err != nil {
+		return nil
+	}
+	if device != "" {
+		opts.Device = device
+	}
+	if opts.Device == "" {
+		return nil
+	}
+	opts.ReadTimeout = time.Millisecond * 100
+	opts.MaxIdleReads = 10
+	opts.AutoReconnect = false
+	done := make(chan []string, 1)
+	go func() {
+		r, err := repl.ConnectWithOptions(opts)
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer r.Close()
+		err = r.EnterRawMode()
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer r.ExitRawMode()
+		names, err := remoteNames(r, cur)
+		if err != nil {
+			done <- nil
+			return
+		}
+		done <- names
+	}()
+	select {
+	case names := <-done:
+		return names
+	case <-time.After(completeTimeout):
+		return nil
+	}
+}
+
+// remoteNames lists the remote directory cur is in, returning each entry as
+// a path starting like cur. Directories get a trailing slash. The Repl must
+// be in raw mode.
+func remoteNames(r *repl.Repl, cur string) ([]string, error) {
+	dir := ""
+	if i := strings.LastIndex(cur, "/"); i >= 0 {
+		dir = cur[:i+1]
+	}
+	d := dir
+	if d == "" {
+		d = "."
+	}
+	names, err := r.ListDir(d)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range names {
+		names[i] = dir + n
+	}
+	return names, nil
+}
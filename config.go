@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// configFile is read from the current directory, taking precedence over the
+// one in the user's config directory. Flags and environment variables take
+// precedence over both.
+const configFile = "zap.toml"
+
+// configKeys are the keys a config file may set. The global ones map to the
+// flag they fill in.
+var configKeys = map[string]string{
+	"device":     "device",
+	"baudrate":   "baudrate",
+	"chunk_size": "chunk-size",
+	"exclude":    "",
+	"upload_dir": "",
+}
+
+// configValue is a value of a config file along with where it was set.
+type configValue struct {
+	values []string
+	source string
+}
+
+// config holds the values read from the config files by key.
+var config = map[string]configValue{}
+
+// configApplied records the flags applyConfig filled in.
+var configApplied = map[string]bool{}
+
+// configPaths returns the config files in order of precedence.
+func configPaths() []string {
+	paths := []string{configFile}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "zap", "config"))
+	}
+	return paths
+}
+
+// loadConfig reads the config files into config. Missing files are skipped.
+func loadConfig() error {
+	for _, p := range configPaths() {
+		values, err := readConfig(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			if _, ok := config[k]; !ok {
+				config[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+// readConfig parses the config file at p. It understands the flat subset of
+// TOML zap needs: key = value lines where a value is a quoted string, a
+// number, a bool or an array of strings.
+func readConfig(p string) (map[string]configValue, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]configValue{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", p, n)
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: expected key = value", source)
+		}
+		key := strings.TrimSpace(line[:i])
+		if _, ok := configKeys[key]; !ok {
+			return nil, fmt.Errorf("%s: unknown key %q", source, key)
+		}
+		v, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		values[key] = configValue{v, source}
+	}
+	return values, s.Err()
+}
+
+// stripComment removes a # comment that isn't inside quotes from line.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue parses a value of a config file. An array gives one value
+// per element.
+func parseConfigValue(s string) ([]string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array %s", s)
+		}
+		var values []string
+		for _, e := range strings.Split(s[1:len(s)-1], ",") {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue
+			}
+			v, err := parseConfigScalar(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	v, err := parseConfigScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+// parseConfigScalar parses a quoted string, number or bool.
+func parseConfigScalar(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", s)
+		}
+		return v, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil || s == "true" || s == "false" {
+		return s, nil
+	}
+	return "", fmt.Errorf("bad value %s, strings need quotes", s)
+}
+
+// applyConfig fills in the global flags that weren't given on the command
+// line or in the environment from the config files.
+func applyConfig(ctx *cli.Context) error {
+	for key, flag := range configKeys {
+		v, ok := config[key]
+		if !ok || flag == "" || ctx.IsSet(flag) {
+			continue
+		}
+		for _, s := range v.values {
+			err := ctx.Set(flag, s)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", v.source, key, err)
+			}
+		}
+		configApplied[flag] = true
+	}
+	return nil
+}
+
+// configStrings returns the values of key from the config files.
+func configStrings(key string) []string {
+	return config[key].values
+}
+
+// configString returns the value of key from the config files or def.
+func configString(key, def string) string {
+	v := config[key].values
+	if len(v) == 0 {
+		return def
+	}
+	return v[len(v)-1]
+}
+
+// globalFlagEnv is the environment variable of each global flag a config
+// file can set, if it has one.
+var globalFlagEnv = map[string]string{
+	"device":   "PYBOARD_DEVICE",
+	"baudrate": "PYBOARD_BAUDRATE",
+}
+
+func cmdConfig(ctx *cli.Context) error {
+	keys := make([]string, 0, len(configKeys))
+	for k := range configKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, source := effectiveConfig(ctx, key)
+		fmt.Printf("%-10s  %-20s  (%s)\n", key, value, source)
+	}
+	return nil
+}
+
+// effectiveConfig returns the value in effect for key and where it came
+// from: a flag, an environment variable, a config file or the default.
+func effectiveConfig(ctx *cli.Context, key string) (string, string) {
+	flag := configKeys[key]
+	v, inFile := config[key]
+	if flag != "" {
+		value := ctx.String(flag)
+		if flag == "device" {
+			value = strings.Join(ctx.StringSlice(flag), ",")
+		}
+		switch {
+		case configApplied[flag]:
+			return value, v.source
+		case !ctx.IsSet(flag):
+			return value, "default"
+		case globalFlagEnv[flag] != "" && os.Getenv(globalFlagEnv[flag]) == value:
+			return value, "env " + globalFlagEnv[flag]
+		}
+		return value, "flag --" + flag
+	}
+	switch key {
+	case "exclude":
+		if inFile {
+			return strings.Join(v.values, ","), v.source
+		}
+		return "", "default"
+	case "upload_dir":
+		if inFile {
+			return configString(key, "."), v.source
+		}
+		return ".", "default"
+	}
+	return "", "default"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// plan prints the operations a command run with --dry-run would perform
+// instead of performing them.
+type plan struct {
+	actions int
+}
+
+// put plans writing the local file src to the remote path dst.
+func (p *plan) put(src, dst string) {
+	fmt.Printf("PUT %s -> %s\n", src, dst)
+	p.actions++
+}
+
+// mkdir plans creating the remote directory dir.
+func (p *plan) mkdir(dir string) {
+	fmt.Println("MKDIR", dir)
+	p.actions++
+}
+
+// del plans removing the remote path name.
+func (p *plan) del(name string) {
+	fmt.Println("DEL", name)
+	p.actions++
+}
+
+// format plans formatting the device's filesystem as fs.
+func (p *plan) format(fs string) {
+	if fs == "" {
+		fs = "default"
+	}
+	fmt.Println("FORMAT", fs)
+	p.actions++
+}
+
+// done returns a plannedError when anything was planned so the exit code tells
+// scripts whether a real run would change the device.
+func (p *plan) done() error {
+	if p.actions > 0 {
+		return &plannedError{p.actions}
+	}
+	return nil
+}
+
+// plannedError reports that a dry run found work to do.
+type plannedError struct {
+	n int
+}
+
+func (e *plannedError) Error() string {
+	return fmt.Sprintf("dry run planned %d operations", e.n)
+}
+
+// remotePath returns name made absolute against the remote directory cwd.
+func remotePath(cwd, name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(cwd, name)
+}
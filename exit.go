@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// Exit codes that let scripts tell failures apart, e.g. to retry when the
+// device couldn't be opened but not when a file is missing on it.
+const (
+	exitError          = 1
+	exitUsage          = 2
+	exitConnection     = 3
+	exitRemoteOSError  = 4
+	exitTimeout        = 5
+	exitPortBusy       = 6
+	exitPortPermission = 7
+	exitPlanned        = 8
+	exitRemoteError    = 9
+)
+
+// usageError is a mistake in the command line arguments.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// usagef returns a usageError with a formatted message.
+func usagef(format string, a ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, a...)}
+}
+
+// connectError is a failure to open or reach the device.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the process exit code for err.
+func exitCode(err error) int {
+	var ue *usageError
+	var ce *connectError
+	var pe *repl.MicroPythonError
+	var ne *repl.NotMicroPythonError
+	switch {
+	case errors.As(err, &ue):
+		return exitUsage
+	case errors.Is(err, repl.ErrPortBusy):
+		return exitPortBusy
+	case errors.Is(err, repl.ErrPortPermission):
+		return exitPortPermission
+	case errors.Is(err, repl.ErrTimeout), errors.Is(err, repl.ErrBusy):
+		return exitTimeout
+	case errors.As(err, &ce), errors.As(err, &ne), errors.Is(err, repl.ErrInterrupt), repl.IsPortError(err):
+		return exitConnection
+	case errors.As(err, &pe) && pe.Type == "OSError":
+		return exitRemoteOSError
+	case errors.As(err, &pe):
+		return exitRemoteError
+	}
+	return exitError
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("something"), exitError},
+		{usagef("bad"), exitUsage},
+		{&connectError{errors.New("no such port")}, exitConnection},
+		{fmt.Errorf("%w: stuck in paste mode", repl.ErrInterrupt), exitConnection},
+		// unplugged in the middle of a command
+		{fmt.Errorf("reading: %w", io.EOF), exitConnection},
+		{syscall.EIO, exitConnection},
+		{fmt.Errorf("%w: %v", repl.ErrDeviceReset, syscall.EIO), exitConnection},
+		// a local file isn't the device
+		{&os.PathError{Op: "open", Path: "main.py", Err: syscall.ENOENT}, exitError},
+		{fmt.Errorf("%w: no prompt", repl.ErrTimeout), exitTimeout},
+		{&repl.MicroPythonError{Type: "OSError", Errno: 2}, exitRemoteOSError},
+		{&repl.MicroPythonError{Type: "ValueError"}, exitRemoteError},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// info prints status messages like transfer progress. They go to stderr
+// along with errors, so stdout only carries the data a command was asked for
+// and can be piped. --quiet discards them.
+var info = log.New(os.Stderr, "", 0)
+
+// setQuiet discards status messages when quiet is set.
+func setQuiet(quiet bool) {
+	if quiet {
+		info.SetOutput(ioutil.Discard)
+	}
+}
+
+// debugLog receives the dump of the traffic with the device when --debug or
+// --debug-file is given, nil otherwise.
+var debugLog io.Writer
+
+// setDebug sends the dump of the traffic with the device to stderr when
+// debug is set or to the end of file when it's not empty.
+func setDebug(debug bool, file string) error {
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		debugLog = f
+		return nil
+	}
+	if debug {
+		debugLog = os.Stderr
+	}
+	return nil
+}
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containerd/console"
 	"github.com/urfave/cli"
@@ -19,17 +35,87 @@ func main() {
 	// setup CLI app
 	c := cli.NewApp()
 	c.CommandNotFound = func(ctx *cli.Context, command string) {
-		fmt.Printf("Command not found: %v\n", command)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Command not found: %v\n", command)
+		os.Exit(exitError)
 	}
 	c.Version = version
 	c.Usage = "MicroPython CLI tool"
 	c.Commands = []*cli.Command{
+		&cli.Command{
+			Name:            "__complete",
+			Hidden:          true,
+			Action:          cmdComplete,
+			SkipFlagParsing: true,
+		},
+		&cli.Command{
+			Name:      "backup",
+			Usage:     "Save the device filesystem to a tar archive",
+			Action:    cmdBackup,
+			ArgsUsage: "archive",
+			Description: "Writes every file under --path to archive, gzipped when the\n" +
+				"   name ends in .tar.gz or .tgz.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "path",
+					Value: "/",
+					Usage: "Remote directory to back up",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "bench",
+			Usage:  "Measure the speed of the link and the device flash",
+			Action: cmdBench,
+			Flags: []cli.Flag{
+				&cli.Int64Flag{
+					Name:  "size",
+					Value: 16 * 1024,
+					Usage: "Bytes to transfer",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the results as JSON",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "board-info",
+			Usage:  "Show chip, frequency and memory of the board",
+			Action: cmdBoardInfo,
+		},
 		&cli.Command{
 			Name:      "cat",
 			Usage:     "Read file",
 			Action:    cmdCat,
-			ArgsUsage: "file",
+			ArgsUsage: "file...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "verbose",
+					Aliases: []string{"v"},
+					Usage:   "Print the absolute path before the contents",
+				},
+				&cli.BoolFlag{
+					Name:  "strict",
+					Usage: "Stop at the first file that can't be read",
+				},
+				&cli.BoolFlag{
+					Name:  "text",
+					Usage: "Let the device print the file as text instead of sending it encoded",
+				},
+				&cli.StringFlag{
+					Name:  "encoding",
+					Usage: "Decode the file as utf-8, latin-1 or ascii instead of printing the bytes unchanged",
+				},
+				&cli.StringFlag{
+					Name:  "errors",
+					Usage: "What to do with bytes that don't decode with --encoding: replace, ignore or strict",
+					Value: repl.DecodeReplace,
+				},
+				&cli.BoolFlag{
+					Name:  "no-pager",
+					Usage: "Don't page large files through $PAGER on a terminal",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "cd",
@@ -37,16 +123,119 @@ func main() {
 			Action:    cmdCd,
 			ArgsUsage: "path",
 		},
+		&cli.Command{
+			Name:      "completion",
+			Usage:     "Print a shell completion script",
+			Action:    cmdCompletion,
+			ArgsUsage: "bash|zsh|fish",
+			Description: "Completes commands, flags and, for cat, cd, get and rm,\n" +
+				"   the files on the device. Completing those connects to the\n" +
+				"   device, which interrupts code running on it.",
+		},
+		&cli.Command{
+			Name:   "config",
+			Usage:  "Show the settings in effect and where they come from",
+			Action: cmdConfig,
+			Description: "Settings are read from zap.toml in the current directory,\n" +
+				"   then ~/.config/zap/config. Flags and environment variables\n" +
+				"   override both.",
+		},
+		&cli.Command{
+			Name:   "df",
+			Usage:  "Show free space on the device",
+			Action: cmdDf,
+		},
 		&cli.Command{
 			Name:   "download",
 			Usage:  "Copy all files from device to local directory",
 			Action: cmdDownload,
 		},
+		&cli.Command{
+			Name:      "edit",
+			Usage:     "Edit a file on the device with $EDITOR",
+			Action:    cmdEdit,
+			ArgsUsage: "file",
+		},
+		&cli.Command{
+			Name:      "eval",
+			Usage:     "Run Python code and print the value of the last expression",
+			Action:    cmdEval,
+			ArgsUsage: "code",
+			Description: "Runs code on the device and prints the repr of its final\n" +
+				"   statement when that is an expression. Exits with a non-zero\n" +
+				"   status if it raises.",
+		},
+		&cli.Command{
+			Name:   "format",
+			Usage:  "Erase the device filesystem",
+			Action: cmdFormat,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "fs",
+					Usage: "Filesystem type (fat, lfs1, lfs2), defaults to the usual one for the board",
+				},
+				&cli.BoolFlag{
+					Name:  "confirm",
+					Usage: "Required to format, then type yes when asked",
+				},
+				&cli.BoolFlag{
+					Name:  "yes",
+					Usage: "Don't ask to type yes, --confirm is still needed",
+				},
+			},
+		},
 		&cli.Command{
 			Name:      "get",
 			Usage:     "Copy a file from the device",
 			Action:    cmdGet,
 			ArgsUsage: "dst src",
+			Description: "Copies the remote file src to the local file dst.\n" +
+				"   With a single argument the remote path is kept and the file is\n" +
+				"   written to the current directory, so `zap get /lib/foo.py`\n" +
+				"   creates ./foo.py. With --stdout the single remote path is\n" +
+				"   written to stdout instead. When dst is a directory, or ends\n" +
+				"   with / to have it created, the file is copied into it. With\n" +
+				"   --recursive src is a directory copied into dst.",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"r"},
+					Usage:   "Copy a directory and everything in it",
+				},
+				&cli.BoolFlag{
+					Name:  "archive",
+					Usage: "With --recursive, send the whole directory in one exchange",
+				},
+				&cli.BoolFlag{
+					Name:    "preserve-times",
+					Aliases: []string{"p"},
+					Value:   true,
+					Usage:   "Copy the modification time along with the file, --preserve-times=false to skip it",
+				},
+				&cli.BoolFlag{
+					Name:  "stdout",
+					Usage: "Write the file to stdout instead of a local file",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "head",
+			Usage:     "Print the start of a file",
+			Action:    cmdHead,
+			ArgsUsage: "file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "lines",
+					Aliases: []string{"n"},
+					Value:   10,
+					Usage:   "Number of lines to print",
+				},
+				&cli.Int64Flag{
+					Name:    "bytes",
+					Aliases: []string{"c"},
+					Usage:   "Number of bytes to print instead of lines",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "help",
@@ -54,10 +243,70 @@ func main() {
 			ArgsUsage: "[command]",
 			Action:    cmdHelp,
 		},
+		&cli.Command{
+			Name:      "hexdump",
+			Usage:     "Show a file as hex",
+			Action:    cmdHexdump,
+			ArgsUsage: "file",
+			Flags: []cli.Flag{
+				&cli.Int64Flag{
+					Name:    "length",
+					Aliases: []string{"n"},
+					Value:   -1,
+					Usage:   "Number of bytes to show, all by default",
+				},
+				&cli.Int64Flag{
+					Name:    "seek",
+					Aliases: []string{"s"},
+					Usage:   "Offset to start at",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "interrupt",
+			Usage:  "Stop the running program and leave the device at the prompt",
+			Action: cmdInterrupt,
+			Description: "Breaks into the running program with ctrl-C instead of\n" +
+				"   rebooting, so its variables are still there for eval.",
+		},
 		&cli.Command{
 			Name:   "ls",
 			Usage:  "List files",
 			Action: cmdLs,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "absolute",
+					Usage: "Print absolute paths",
+				},
+				&cli.BoolFlag{
+					Name:    "long",
+					Aliases: []string{"l"},
+					Usage:   "Print the size of each file, one entry per line (slower)",
+				},
+				&cli.BoolFlag{
+					Name:    "all",
+					Aliases: []string{"a"},
+					Usage:   "Include names starting with a dot",
+				},
+				&cli.StringFlag{
+					Name:  "sort",
+					Value: "name",
+					Usage: "Sort by name, size (largest first), time (newest first) or none",
+				},
+				&cli.BoolFlag{
+					Name:  "S",
+					Usage: "Sort by size, same as --sort size",
+				},
+				&cli.BoolFlag{
+					Name:  "t",
+					Usage: "Sort by modification time where the device keeps it, same as --sort time",
+				},
+				&cli.BoolFlag{
+					Name:    "reverse",
+					Aliases: []string{"r"},
+					Usage:   "Reverse the sort order",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "mkdir",
@@ -65,11 +314,70 @@ func main() {
 			Action:    cmdMkdir,
 			ArgsUsage: "dir",
 		},
+		&cli.Command{
+			Name:      "mount",
+			Usage:     "Serve a local directory to the device and open the REPL",
+			Action:    cmdMount,
+			ArgsUsage: "[dir]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "name",
+					Value: "/remote",
+					Usage: "Mount point on the device",
+				},
+				&cli.StringFlag{
+					Name:  "menu-key",
+					Value: "ctrl-t",
+					Usage: "Key that opens the local command menu",
+				},
+			},
+		},
 		&cli.Command{
 			Name:      "put",
 			Usage:     "Copy a file to the device",
 			Action:    cmdPut,
 			ArgsUsage: "dst src",
+			Description: "Copies the local file src to the remote file dst.\n" +
+				"   With a single argument the remote path is kept and the file of\n" +
+				"   that name in the current directory is copied, so\n" +
+				"   `zap put /lib/foo.py` copies ./foo.py.\n" +
+				"   When dst is a directory, or ends with / to have it created,\n" +
+				"   the file is copied into it. A src of - copies stdin.",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "preserve-times",
+					Aliases: []string{"p"},
+					Value:   true,
+					Usage:   "Copy the modification time along with the file, --preserve-times=false to skip it",
+				},
+				&cli.StringFlag{
+					Name:  "mode",
+					Value: "w",
+					Usage: "w to replace, a to append or wx to fail if dst exists",
+				},
+				&cli.BoolFlag{
+					Name:  "make-dirs",
+					Usage: "Create missing parent directories of dst",
+				},
+				&cli.BoolFlag{
+					Name:    "text",
+					Aliases: []string{"normalize-eol"},
+					Usage:   "Convert CRLF line endings to LF in text files",
+				},
+				&cli.BoolFlag{
+					Name:  "atomic",
+					Usage: "Write to dst.tmp and rename it over dst once complete, the default for boot.py and main.py",
+				},
+				&cli.BoolFlag{
+					Name:  "verify",
+					Usage: "With --atomic, check the SHA-256 of the copy before renaming it",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "ports",
+			Usage:  "List available serial ports",
+			Action: cmdPorts,
 		},
 		&cli.Command{
 			Name:   "pwd",
@@ -80,11 +388,38 @@ func main() {
 			Name:   "reboot",
 			Usage:  "Perform a soft reboot",
 			Action: cmdReboot,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "follow",
+					Usage: "Show what boot.py and main.py print after the reboot until ctrl-C",
+				},
+			},
 		},
 		&cli.Command{
 			Name:   "repl",
 			Usage:  "Open the MicroPython REPL",
 			Action: cmdRepl,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "menu-key",
+					Value: "ctrl-t",
+					Usage: "Key that opens the local command menu",
+				},
+				&cli.StringFlag{
+					Name:  "init",
+					Usage: "Local Python file to run before the prompt appears",
+				},
+				&cli.BoolFlag{
+					Name:  "fail-on-init-error",
+					Usage: "Exit instead of starting the REPL when --init raises",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "restore",
+			Usage:     "Copy the files in a tar archive to the device",
+			Action:    cmdRestore,
+			ArgsUsage: "archive",
 		},
 		&cli.Command{
 			Name:      "rm",
@@ -98,10 +433,115 @@ func main() {
 			Action:    cmdRmdir,
 			ArgsUsage: "dir",
 		},
+		&cli.Command{
+			Name:      "run",
+			Usage:     "Execute a local Python file without copying it",
+			Action:    cmdRun,
+			ArgsUsage: "file [-- args...]",
+			Description: "Runs file on the device. Any further arguments are\n" +
+				"   passed to the script in sys.argv. With --until the script is\n" +
+				"   interrupted once it prints a line containing the text, and\n" +
+				"   zap fails if it ends without printing it.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "until",
+					Usage: "Stop the script when it prints a line containing this text",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "serve",
+			Usage:  "Share the device with other machines over TCP",
+			Action: cmdServe,
+			Description: "Bridges the serial device to one TCP client at a time. Other\n" +
+				"   machines use it with --device tcp://host:port.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "listen",
+					Value: ":2217",
+					Usage: "Address to listen on",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "shell",
+			Usage:  "Run commands at a prompt over a single connection",
+			Action: cmdShell,
+			Description: "Keeps the device connected between commands, so cd sticks\n" +
+				"   and nothing waits for the port to open again. Type help at\n" +
+				"   the prompt for the commands.",
+		},
+		&cli.Command{
+			Name:      "tail",
+			Usage:     "Print the end of a file",
+			Action:    cmdTail,
+			ArgsUsage: "file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "lines",
+					Aliases: []string{"n"},
+					Value:   10,
+					Usage:   "Number of lines to print",
+				},
+				&cli.Int64Flag{
+					Name:    "bytes",
+					Aliases: []string{"c"},
+					Usage:   "Number of bytes to print instead of lines",
+				},
+				&cli.BoolFlag{
+					Name:    "follow",
+					Aliases: []string{"f"},
+					Usage:   "Keep printing data as the file grows",
+				},
+			},
+		},
 		&cli.Command{
 			Name:   "upload",
 			Usage:  "Copy all files from local directory to device",
 			Action: cmdUpload,
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Skip files matching the pattern, along with .zapignore",
+				},
+				&cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "Stop at the first file that fails",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Upload even if the files don't seem to fit in the free space",
+				},
+				&cli.BoolFlag{
+					Name:  "skip-existing",
+					Usage: "Leave files that are already on the device alone",
+				},
+				&cli.BoolFlag{
+					Name:  "atomic",
+					Usage: "Write each file to a temporary name and rename it once complete, always done for boot.py and main.py",
+				},
+				&cli.BoolFlag{
+					Name:  "no-manifest",
+					Usage: "Hash every file on the device to find unchanged ones instead of trusting " + repl.ManifestFile,
+				},
+				&cli.BoolFlag{
+					Name:    "text",
+					Aliases: []string{"normalize-eol"},
+					Usage:   "Convert CRLF line endings to LF in text files",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "watch",
+			Usage:     "Upload changed files, reboot and show the output",
+			Action:    cmdWatch,
+			ArgsUsage: "[dir]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "delete",
+					Usage: "Delete files from the device when they're removed locally",
+				},
+			},
 		},
 		&cli.Command{
 			Name:  "version",
@@ -111,14 +551,39 @@ func main() {
 				return nil
 			},
 		},
+		&cli.Command{
+			Name:   "wipe",
+			Usage:  "Delete every file and directory on the device",
+			Action: cmdWipe,
+			Description: "Leaves the filesystem empty, like a fresh flash, without\n" +
+				"   reformatting it. Read-only and virtual mounts are left alone.\n" +
+				"   Asks for confirmation unless --yes is given.",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "yes",
+					Usage: "Don't ask for confirmation",
+				},
+			},
+		},
 	}
 	c.Flags = []cli.Flag{
-		&cli.StringFlag{
-			Name:     "device",
-			Aliases:  []string{"d"},
-			Usage:    "Serial device name of MicroPython board",
-			Required: true,
-			EnvVars:  []string{"PYBOARD_DEVICE"},
+		&cli.StringSliceFlag{
+			Name:    "device",
+			Aliases: []string{"d"},
+			Usage:   "Serial device name of MicroPython board, or usb:VID:PID or serial:NUMBER, repeat it or give a comma list or glob for several",
+			EnvVars: []string{"PYBOARD_DEVICE"},
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print what upload, rm, restore, format and wipe would change without changing it",
+		},
+		&cli.BoolFlag{
+			Name:  "reset-before",
+			Usage: "Soft reboot the device before running the command",
+		},
+		&cli.BoolFlag{
+			Name:  "parallel",
+			Usage: "Run the command on all devices at once instead of one after another",
 		},
 		&cli.IntFlag{
 			Name:    "baudrate",
@@ -127,42 +592,276 @@ func main() {
 			Usage:   "Baudrate of serial device",
 			EnvVars: []string{"PYBOARD_BAUDRATE"},
 		},
+		&cli.StringFlag{
+			Name:  "baud-list",
+			Usage: "Comma separated baudrates to try in order instead of --baudrate",
+		},
+		&cli.StringFlag{
+			Name:  "parity",
+			Value: "none",
+			Usage: "Parity of serial device (none, odd, even, mark, space)",
+		},
+		&cli.StringFlag{
+			Name:  "stopbits",
+			Value: "1",
+			Usage: "Stop bits of serial device (1, 1.5, 2)",
+		},
+		&cli.BoolFlag{
+			Name:  "rtscts",
+			Usage: "Enable RTS/CTS hardware flow control",
+		},
+		&cli.BoolFlag{
+			Name:  "interrupt",
+			Usage: "Interrupt running code and wait for the prompt before the command",
+		},
+		&cli.BoolFlag{
+			Name:  "no-interrupt",
+			Usage: "Don't stop code running on the device, wait for it to finish instead",
+		},
+		&cli.IntFlag{
+			Name:  "max-idle-reads",
+			Value: repl.DefaultMaxIdleReads,
+			Usage: "Fail after this many read timeouts in a row without data, -1 waits forever",
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "Only print errors and the data asked for",
+		},
+		&cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Log the bytes sent to and read from the device to stderr",
+		},
+		&cli.StringFlag{
+			Name:  "debug-file",
+			Usage: "Append the --debug log to this file instead of stderr",
+		},
+		&cli.BoolFlag{
+			Name:  "no-compress",
+			Usage: "Don't compress transfers even if the device supports it",
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "Bytes per transfer chunk, 0 picks a default",
+		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Value: 3,
+			Usage: "Times to resend a corrupted transfer chunk",
+		},
+		&cli.BoolFlag{
+			Name:  "no-helper",
+			Usage: "Send the full code of every operation instead of loading a helper into RAM",
+		},
+		&cli.StringFlag{
+			Name:    "raw-banner",
+			EnvVars: []string{"ZAP_RAW_BANNER"},
+			Usage:   "Raw REPL banner of non-standard firmware, with Go escapes like \\r\\n",
+		},
+		&cli.StringFlag{
+			Name:    "soft-reboot-marker",
+			EnvVars: []string{"ZAP_SOFT_REBOOT_MARKER"},
+			Usage:   "Soft reboot message of non-standard firmware",
+		},
+		&cli.StringFlag{
+			Name:    "prompt",
+			EnvVars: []string{"ZAP_PROMPT"},
+			Usage:   "Raw REPL prompt of non-standard firmware",
+		},
+		&cli.BoolFlag{
+			Name:  "no-reconnect",
+			Usage: "Fail instead of reopening the device when it disconnects, e.g. after a reset",
+		},
+		&cli.BoolFlag{
+			// reconnecting is the default now, kept so old scripts work
+			Name:   "reconnect",
+			Hidden: true,
+		},
+		&cli.DurationFlag{
+			Name:    "read-timeout",
+			Aliases: []string{"port-timeout"},
+			Value:   repl.DefaultReadTimeout,
+			Usage:   "Read timeout of serial device, e.g. 2s on slow USB hubs",
+		},
+		&cli.DurationFlag{
+			Name:  "response-timeout",
+			Usage: "Fail when the device doesn't answer within this long, 0 waits forever",
+		},
+		&cli.DurationFlag{
+			Name:  "raw-timeout",
+			Value: repl.InterruptTimeout,
+			Usage: "How long to wait for the device to enter the raw REPL",
+		},
+	}
+	// reject bad serial settings before any command runs
+	c.Before = func(ctx *cli.Context) error {
+		setQuiet(ctx.Bool("quiet"))
+		err := setDebug(ctx.Bool("debug"), ctx.String("debug-file"))
+		if err != nil {
+			return err
+		}
+		err = loadConfig()
+		if err == nil {
+			err = applyConfig(ctx)
+		}
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		if len(ctx.StringSlice("device")) == 0 {
+			return nil
+		}
+		_, err = connectOptions(ctx)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		return nil
+	}
+	for _, cmd := range c.Commands {
+		cmd.Action = eachDevice(cmd.Name, resetBefore(cmd.Name, cmd.Action))
+		cmd.OnUsageError = onUsageError
 	}
+	c.OnUsageError = onUsageError
 	// run CLI app
 	err := c.Run(os.Args)
+	var planned *plannedError
+	if errors.As(err, &planned) {
+		os.Exit(exitPlanned)
+	}
 	if err != nil {
-		fmt.Println("\nERROR:", err)
+		fmt.Fprintln(os.Stderr, "\nERROR:", err)
+		if errors.Is(err, repl.ErrNoSpace) {
+			fmt.Fprintln(os.Stderr, "Device storage full, run 'zap df' to check usage")
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
-func cmdCat(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+// onUsageError marks errors parsing the flags as usage errors.
+func onUsageError(ctx *cli.Context, err error, isSubcommand bool) error {
+	return &usageError{err.Error()}
+}
+
+// connectOptions builds the serial port options from the global flags.
+func connectOptions(ctx *cli.Context) (repl.ConnectOptions, error) {
+	devices, err := deviceNames(ctx)
 	if err != nil {
-		return err
+		return repl.ConnectOptions{}, err
 	}
-	err = r.EnterRawMode()
+	opts := repl.ConnectOptions{
+		Baud:            ctx.Int("baudrate"),
+		RTSCTS:          ctx.Bool("rtscts"),
+		ReadTimeout:     ctx.Duration("read-timeout"),
+		MaxIdleReads:    ctx.Int("max-idle-reads"),
+		ResponseTimeout: ctx.Duration("response-timeout"),
+		RawModeTimeout:  ctx.Duration("raw-timeout"),
+		NoCompress:      ctx.Bool("no-compress"),
+		Retries:         ctx.Int("retries"),
+		NoHelper:        ctx.Bool("no-helper"),
+		ChunkSize:       ctx.Int("chunk-size"),
+		Debug:           debugLog,
+	}
+	if len(devices) > 0 {
+		opts.Device = devices[0]
+	}
+	for _, f := range []struct {
+		name string
+		dst  *[]byte
+	}{
+		{"raw-banner", &opts.RawBanner},
+		{"soft-reboot-marker", &opts.SoftRebootMarker},
+		{"prompt", &opts.Prompt},
+	} {
+		if ctx.String(f.name) == "" {
+			continue
+		}
+		b, err := unescape(ctx.String(f.name))
+		if err != nil {
+			return opts, fmt.Errorf("--%s: %v", f.name, err)
+		}
+		*f.dst = b
+	}
+	if ctx.Bool("interrupt") && ctx.Bool("no-interrupt") {
+		return opts, fmt.Errorf("--interrupt and --no-interrupt can't be used together")
+	}
+	opts.NoInterrupt = ctx.Bool("no-interrupt")
+	if !ctx.Bool("no-reconnect") {
+		opts.AutoReconnect = true
+		opts.OnReconnect = func(attempt int, err error) {
+			fmt.Fprintf(os.Stderr, "Reconnecting to %s (attempt %d): %v\n", opts.Device, attempt, err)
+		}
+	}
+	opts.Parity, err = repl.ParseParity(ctx.String("parity"))
 	if err != nil {
-		return err
+		return opts, err
 	}
-	defer r.ExitRawMode()
-	return r.Cat(os.Stdout, ctx.Args().Get(0))
+	opts.StopBits, err = repl.ParseStopBits(ctx.String("stopbits"))
+	if err != nil {
+		return opts, err
+	}
+	if opts.ReadTimeout <= 0 {
+		return opts, fmt.Errorf("--read-timeout must be positive, got %v", opts.ReadTimeout)
+	}
+	return opts, opts.Validate()
 }
 
-func cmdCd(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+// unescape interprets Go escape sequences like \r\n in a sentinel flag.
+func unescape(s string) ([]byte, error) {
+	u, err := strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
 	if err != nil {
-		return err
+		return nil, errors.New("invalid escape sequence")
 	}
-	err = r.EnterRawMode()
+	return []byte(u), nil
+}
+
+// parseBaudList parses a comma separated list of baudrates.
+func parseBaudList(s string) ([]int, error) {
+	var bauds []int
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid baudrate %q in --baud-list", f)
+		}
+		bauds = append(bauds, b)
+	}
+	return bauds, nil
+}
+
+// connect opens the serial device described by the global flags.
+func connect(ctx *cli.Context) (*repl.Repl, error) {
+	opts, err := connectOptions(ctx)
 	if err != nil {
-		return err
+		return nil, &usageError{err.Error()}
 	}
-	defer r.ExitRawMode()
-	return r.Cd(ctx.Args().Get(0))
+	if opts.Device == "" {
+		return nil, usagef("no device given, use --device or set PYBOARD_DEVICE")
+	}
+	if ctx.String("baud-list") != "" {
+		bauds, err := parseBaudList(ctx.String("baud-list"))
+		if err != nil {
+			return nil, &usageError{err.Error()}
+		}
+		opts.Baud, err = repl.DetectBaudWithOptions(opts, bauds)
+		if err != nil {
+			return nil, &connectError{err}
+		}
+		info.Println("Using baudrate", opts.Baud)
+	}
+	r, err := repl.ConnectWithOptions(opts)
+	if err != nil {
+		return nil, &connectError{err}
+	}
+	if ctx.Bool("interrupt") {
+		err = r.Interrupt()
+		if err != nil {
+			r.Close()
+			return nil, &connectError{err}
+		}
+	}
+	return r, nil
 }
 
-func cmdDownload(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdBoardInfo(ctx *cli.Context) error {
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -171,11 +870,54 @@ func cmdDownload(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.Download()
+	info, err := r.BoardInfo()
+	if err != nil {
+		return err
+	}
+	row := func(k, v string) {
+		if v != "" && v != "0" {
+			fmt.Printf("%-16s%s\n", k+":", v)
+		}
+	}
+	row("Platform", info.Platform)
+	row("Implementation", info.Implementation)
+	row("Machine", info.Machine)
+	row("Chip", info.ChipName)
+	if info.FreqHz > 0 {
+		row("Frequency", fmt.Sprintf("%d MHz", info.FreqHz/1000000))
+	}
+	if info.FlashBytes > 0 {
+		row("Flash", fmt.Sprintf("%d KB", info.FlashBytes/1024))
+	}
+	if n, err := strconv.ParseInt(info.RAMBytes, 10, 64); err == nil {
+		row("RAM", fmt.Sprintf("%d KB", n/1024))
+	} else {
+		row("RAM", info.RAMBytes)
+	}
+	return nil
 }
 
-func cmdGet(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdCat(ctx *cli.Context) error {
+	files := ctx.Args().Slice()
+	if len(files) == 0 {
+		return usagef("no file given")
+	}
+	err := checkRemotePaths(files...)
+	if err != nil {
+		return err
+	}
+	opts := repl.CatOptions{
+		Encoding: ctx.String("encoding"),
+		Errors:   ctx.String("errors"),
+	}
+	if opts.Encoding != "" && ctx.Bool("text") {
+		return usagef("--encoding can't be used with --text")
+	}
+	err = opts.Validate()
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -184,48 +926,114 @@ func cmdGet(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	args := ctx.Args()
-	dst := args.Get(0)
-	src := dst
-	if args.Len() > 1 {
-		src = args.Get(1)
+	var w io.Writer = os.Stdout
+	if !ctx.Bool("no-pager") && isTerminal(os.Stdout) {
+		if p := pageLarge(r, files); p != nil {
+			defer p.Close()
+			w = p
+		}
+	}
+	if !ctx.Bool("verbose") && !ctx.Bool("strict") && !ctx.Bool("text") && opts.Encoding == "" {
+		return catAll(r, w, files)
+	}
+	failed := 0
+	for _, fn := range files {
+		err = catFile(r, w, fn, ctx.Bool("verbose"), ctx.Bool("text"), opts)
+		if errors.Is(err, syscall.EPIPE) {
+			// the pager was quit
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Bool("strict") {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		fmt.Fprintf(os.Stderr, "cat: %s: %s\n", fn, errorLine(err))
+		failed++
 	}
-	return r.Get(dst, src)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be read", failed, len(files))
+	}
+	return nil
 }
 
-func cmdHelp(ctx *cli.Context) error {
-	args := ctx.Args()
-	if args.Present() {
-		cli.ShowCommandHelp(ctx, args.First())
+// catAll writes files to w in a single exchange, printing those that can't
+// be read instead of stopping at them.
+func catAll(r *repl.Repl, w io.Writer, files []string) error {
+	err := r.CatMultiple(w, files...)
+	if errors.Is(err, syscall.EPIPE) {
+		// the pager was quit
 		return nil
 	}
-	cli.ShowAppHelp(ctx)
-	return nil
+	var e *repl.CatError
+	if !errors.As(err, &e) {
+		return err
+	}
+	for _, err := range e.Errors {
+		fmt.Fprintln(os.Stderr, "cat:", err)
+	}
+	return fmt.Errorf("%d of %d files could not be read", len(e.Errors), len(files))
 }
 
-func cmdLs(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+// pageLarge starts a pager when files add up to more than pagerThreshold
+// bytes. It returns nil when they don't, or can't be sized, or no pager can
+// be run.
+func pageLarge(r *repl.Repl, files []string) *pager {
+	sizes, err := r.Sizes(files)
 	if err != nil {
-		return err
+		return nil
 	}
-	err = r.EnterRawMode()
-	if err != nil {
-		return err
+	var total int64
+	for _, n := range sizes {
+		total += n
 	}
-	defer r.ExitRawMode()
-	fs, err := r.Ls()
+	if total <= pagerThreshold {
+		return nil
+	}
+	p, err := startPager()
 	if err != nil {
-		return err
+		return nil
+	}
+	return p
+}
+
+// catFile writes a remote file to w, preceded by its absolute path when
+// verbose is set. With text set the device prints it instead of sending it
+// encoded, otherwise it's decoded as opts say.
+func catFile(r *repl.Repl, w io.Writer, fn string, verbose, text bool, opts repl.CatOptions) error {
+	if verbose {
+		abs := fn
+		if !path.IsAbs(fn) {
+			cwd, err := r.Cwd()
+			if err != nil {
+				return err
+			}
+			abs = path.Join(cwd, fn)
+		}
+		fmt.Fprintf(w, "==> %s <==\n", abs)
 	}
-	for _, f := range fs {
-		fmt.Print(f + "  ")
+	if text {
+		return r.CatText(w, fn)
 	}
-	fmt.Print("\n")
-	return nil
+	return r.CatWithOptions(w, fn, opts)
 }
 
-func cmdMkdir(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+// errorLine shortens a device traceback to its final line.
+func errorLine(err error) string {
+	var e *repl.MicroPythonError
+	if errors.As(err, &e) && e.Message != "" {
+		return e.Type + ": " + e.Message
+	}
+	return err.Error()
+}
+
+func cmdCd(ctx *cli.Context) error {
+	err := checkRemotePaths(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -234,11 +1042,11 @@ func cmdMkdir(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.Mkdir(ctx.Args().Get(0))
+	return r.Cd(ctx.Args().Get(0))
 }
 
-func cmdPut(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdDf(ctx *cli.Context) error {
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -247,17 +1055,19 @@ func cmdPut(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	args := ctx.Args()
-	dst := args.Get(0)
-	src := dst
-	if args.Len() > 1 {
-		src = args.Get(1)
+	free, err := r.DiskFree()
+	if err == repl.ErrUnsupported {
+		return errors.New("the device can't report free space, its uos has no statvfs")
+	}
+	if err != nil {
+		return err
 	}
-	return r.Put(dst, src)
+	fmt.Printf("%d bytes free\n", free)
+	return nil
 }
 
-func cmdPwd(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdDownload(ctx *cli.Context) error {
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -266,16 +1076,24 @@ func cmdPwd(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	cwd, err := r.Cwd()
+	total, err := r.Download(".", printTransfer("Downloading"))
 	if err != nil {
 		return err
 	}
-	fmt.Println(cwd)
+	info.Println("Downloaded", total)
 	return nil
 }
 
-func cmdReboot(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdEdit(ctx *cli.Context) error {
+	remote := ctx.Args().Get(0)
+	if remote == "" {
+		return usagef("no file given")
+	}
+	err := checkRemotePaths(remote)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -284,27 +1102,67 @@ func cmdReboot(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.SoftReboot()
-}
-
-func cmdRepl(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+	f, err := ioutil.TempFile("", "zap-*"+path.Ext(remote))
 	if err != nil {
 		return err
 	}
-	current := console.Current()
-	defer current.Reset()
-	err = current.SetRaw()
+	defer os.Remove(f.Name())
+	_, err = r.Get(f, remote)
+	f.Close()
 	if err != nil {
 		return err
 	}
-	go io.Copy(os.Stdout, r.Port)
-	io.Copy(r.Port, os.Stdin)
-	return nil
+	before, err := hashFile(f.Name())
+	if err != nil {
+		return err
+	}
+	err = runEditor(f.Name())
+	if err != nil {
+		return fmt.Errorf("editor failed, %s not uploaded: %v", remote, err)
+	}
+	after, err := hashFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if before == after {
+		info.Println("No changes")
+		return nil
+	}
+	return putFile(r, remote, f.Name(), transferOpts{})
 }
 
-func cmdRm(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+// runEditor opens fn in $EDITOR and waits for it to exit.
+func runEditor(fn string) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+		if runtime.GOOS == "windows" {
+			editor = []string{"notepad"}
+		}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], fn)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// hashFile returns the SHA-256 of the contents of a local file.
+func hashFile(fn string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return sum, err
+	}
+	return sha256.Sum256(b), nil
+}
+
+func cmdEval(ctx *cli.Context) error {
+	code := strings.Join(ctx.Args().Slice(), " ")
+	if strings.TrimSpace(code) == "" {
+		return usagef("no code given")
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -313,11 +1171,36 @@ func cmdRm(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.Rm(ctx.Args().Get(0))
+	c, cancel := interruptContext()
+	defer cancel()
+	err = r.EvalCode(c, code, os.Stdout)
+	exitOnSystemExit(r, err)
+	var e *repl.MicroPythonError
+	if errors.As(err, &e) {
+		fmt.Fprint(os.Stderr, e.Traceback)
+		return cli.Exit("", exitCode(e))
+	}
+	return err
 }
 
-func cmdRmdir(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdFormat(ctx *cli.Context) error {
+	if !ctx.Bool("confirm") && !ctx.Bool("dry-run") {
+		return usagef("format erases every file on the device, pass --confirm to go ahead")
+	}
+	if !ctx.Bool("yes") && !ctx.Bool("dry-run") && !isTerminal(os.Stdin) {
+		// a stray line of piped input shouldn't be able to confirm this
+		return usagef("format needs --yes when stdin isn't a terminal")
+	}
+	if !ctx.Bool("yes") && !ctx.Bool("dry-run") {
+		ok, err := confirm("This will erase every file on the device.")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("format cancelled")
+		}
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -326,11 +1209,31 @@ func cmdRmdir(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.Rmdir(ctx.Args().Get(0))
+	if ctx.Bool("dry-run") {
+		p := &plan{}
+		err = r.Walk("/", func(name string, isDir bool, size int64) error {
+			p.del(name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		p.format(ctx.String("fs"))
+		return p.done()
+	}
+	return r.FormatFS(ctx.String("fs"))
 }
 
-func cmdUpload(ctx *cli.Context) error {
-	r, err := repl.Connect(ctx.String("device"), ctx.Int("baudrate"))
+func cmdGet(ctx *cli.Context) error {
+	if ctx.Bool("stdout") && ctx.NArg() != 1 {
+		return usagef("get --stdout takes exactly one remote path")
+	}
+	_, src := getArgs(ctx.Args().Slice())
+	err := checkRemotePaths(src)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
 	if err != nil {
 		return err
 	}
@@ -339,5 +1242,1126 @@ func cmdUpload(ctx *cli.Context) error {
 		return err
 	}
 	defer r.ExitRawMode()
-	return r.Upload()
+	if ctx.Bool("stdout") {
+		_, err = r.Get(os.Stdout, ctx.Args().First())
+		return err
+	}
+	dst, src := getArgs(ctx.Args().Slice())
+	if ctx.Bool("recursive") {
+		return getDir(r, dst, src, ctx.Bool("archive"))
+	}
+	dst, err = localTarget(dst, path.Base(src))
+	if err != nil {
+		return err
+	}
+	return getFile(r, dst, src, transferOptions(ctx))
+}
+
+// localTarget is repl.Repl.TargetPath for a local dst.
+func localTarget(dst, name string) (string, error) {
+	if strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, string(filepath.Separator)) {
+		err := os.MkdirAll(dst, 0755)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dst, name), nil
+	}
+	fi, err := os.Stat(dst)
+	if err == nil && fi.IsDir() {
+		return filepath.Join(dst, name), nil
+	}
+	return dst, nil
+}
+
+// getDir copies the remote directory src into the local directory dst.
+func getDir(r *repl.Repl, dst, src string, archive bool) error {
+	if src == "" {
+		return usagef("no directory given")
+	}
+	info.Println("Downloading", src, "...")
+	get := r.GetDir
+	if archive {
+		get = r.GetArchive
+	}
+	stats, err := get(dst, src)
+	if err != nil {
+		return err
+	}
+	info.Println(stats)
+	return nil
+}
+
+// checkRemotePaths returns a usage error for the first of paths that
+// repl.ValidateRemotePath rejects.
+func checkRemotePaths(paths ...string) error {
+	for _, p := range paths {
+		err := repl.ValidateRemotePath(p)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	return nil
+}
+
+// getArgs returns the local dst and remote src of a get command. When only the
+// remote path is given the file is written to the current directory.
+func getArgs(args []string) (string, string) {
+	if len(args) == 0 {
+		return "", ""
+	}
+	if len(args) == 1 {
+		return filepath.Base(args[0]), args[0]
+	}
+	return args[0], args[1]
+}
+
+// putArgs returns the remote dst and local src of a put command. When only the
+// remote path is given the file of that name in the current directory is
+// copied, the reverse of getArgs.
+func putArgs(args []string) (string, string) {
+	if len(args) == 1 {
+		src, dst := getArgs(args)
+		return dst, src
+	}
+	return getArgs(args)
+}
+
+// transferOpts are the command flags shared by get and put.
+type transferOpts struct {
+	preserveTimes bool
+	// preserveTimesSet is set when --preserve-times was given rather than
+	// on by default
+	preserveTimesSet bool
+	// mode is the put mode, see repl.PutMode
+	mode string
+	// makeDirs creates missing remote parent directories on put
+	makeDirs bool
+	// text converts CRLF to LF in text files on put
+	text bool
+	// atomic and verify set repl.PutOptions.Atomic and Verify on put
+	atomic bool
+	verify bool
+}
+
+// transferOptions reads the transferOpts from the command flags.
+func transferOptions(ctx *cli.Context) transferOpts {
+	return transferOpts{
+		preserveTimes:    ctx.Bool("preserve-times"),
+		preserveTimesSet: ctx.IsSet("preserve-times"),
+		mode:             ctx.String("mode"),
+		makeDirs:         ctx.Bool("make-dirs"),
+		text:             ctx.Bool("text"),
+		atomic:           ctx.Bool("atomic"),
+		verify:           ctx.Bool("verify"),
+	}
+}
+
+// getFile copies the remote file src to the local file dst, making its
+// local parent directories as needed.
+func getFile(r *repl.Repl, dst, src string, opts transferOpts) error {
+	stats, err := r.GetFile(dst, src)
+	if err != nil {
+		return err
+	}
+	info.Println(stats)
+	if opts.preserveTimes {
+		t, err := r.Mtime(src)
+		if err != nil {
+			return err
+		}
+		if t.IsZero() {
+			if opts.preserveTimesSet {
+				fmt.Fprintln(os.Stderr, "warning: device has no file times, mtime not preserved")
+			}
+			return nil
+		}
+		return os.Chtimes(dst, t, t)
+	}
+	return nil
+}
+
+func cmdHead(ctx *cli.Context) error {
+	fn := ctx.Args().Get(0)
+	if fn == "" {
+		return usagef("no file given")
+	}
+	err := checkRemotePaths(fn)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	if ctx.IsSet("bytes") {
+		return r.HeadBytes(os.Stdout, fn, ctx.Int64("bytes"))
+	}
+	return r.Head(os.Stdout, fn, ctx.Int("lines"))
+}
+
+func cmdHelp(ctx *cli.Context) error {
+	args := ctx.Args()
+	if args.Present() {
+		cli.ShowCommandHelp(ctx, args.First())
+		return nil
+	}
+	cli.ShowAppHelp(ctx)
+	return nil
+}
+
+func cmdHexdump(ctx *cli.Context) error {
+	fn := ctx.Args().Get(0)
+	if fn == "" {
+		return usagef("no file given")
+	}
+	err := checkRemotePaths(fn)
+	if err != nil {
+		return err
+	}
+	off := ctx.Int64("seek")
+	if off < 0 {
+		return usagef("--seek can't be negative, got %d", off)
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	data, err := r.ReadRange(fn, off, ctx.Int64("length"))
+	if err != nil {
+		return err
+	}
+	hexdump(os.Stdout, data, off)
+	return nil
+}
+
+// hexdump writes data in xxd format with offsets counted from off.
+func hexdump(w io.Writer, data []byte, off int64) {
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		fmt.Fprintf(w, "%08x: ", off+int64(i))
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				fmt.Fprintf(w, "%02x", line[j])
+			} else {
+				fmt.Fprint(w, "  ")
+			}
+			if j%2 == 1 {
+				fmt.Fprint(w, " ")
+			}
+		}
+		fmt.Fprint(w, " ")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			fmt.Fprintf(w, "%c", c)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func cmdInterrupt(ctx *cli.Context) error {
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	return r.Interrupt()
+}
+
+func cmdLs(ctx *cli.Context) error {
+	by := ctx.String("sort")
+	if ctx.Bool("S") {
+		by = "size"
+	}
+	if ctx.Bool("t") {
+		by = "time"
+	}
+	if by != "name" && by != "size" && by != "time" && by != "none" {
+		return usagef("invalid --sort %q, want name, size, time or none", by)
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	opts := repl.ListOptions{
+		Absolute: ctx.Bool("absolute"),
+		Unsorted: by == "none",
+		Mtime:    by == "time",
+	}
+	if !opts.Absolute {
+		cwd, err := r.Cwd()
+		if err != nil {
+			return err
+		}
+		fmt.Println(cwd + ":")
+	}
+	var entries []repl.FileEntry
+	if ctx.Bool("long") || by == "size" || by == "time" {
+		entries, err = r.ListLong(opts)
+	} else {
+		var fs []string
+		fs, err = r.List(opts)
+		for _, f := range fs {
+			entries = append(entries, repl.FileEntry{
+				Name:  strings.TrimSuffix(f, "/"),
+				IsDir: strings.HasSuffix(f, "/"),
+			})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !ctx.Bool("all") {
+		entries = withoutHidden(entries)
+	}
+	sortEntries(entries, by)
+	if ctx.Bool("reverse") {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	if ctx.Bool("long") {
+		printLong(entries)
+		return nil
+	}
+	for _, e := range entries {
+		if e.IsDir {
+			e.Name += "/"
+		}
+		fmt.Print(e.Name + "  ")
+	}
+	fmt.Print("\n")
+	return nil
+}
+
+// withoutHidden leaves out entries whose names start with a dot, like the
+// upload manifest.
+func withoutHidden(entries []repl.FileEntry) []repl.FileEntry {
+	var shown []repl.FileEntry
+	for _, e := range entries {
+		if !strings.HasPrefix(path.Base(e.Name), ".") {
+			shown = append(shown, e)
+		}
+	}
+	return shown
+}
+
+// sortEntries sorts entries for ls --sort by, largest or newest first for
+// size and time with ties in name order. Entries are already sorted by name
+// or in filesystem order otherwise.
+func sortEntries(entries []repl.FileEntry, by string) {
+	switch by {
+	case "size":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Size > entries[j].Size
+		})
+	case "time":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Mtime.After(entries[j].Mtime)
+		})
+	}
+}
+
+// printLong prints entries for ls --long as one "size name" line per entry,
+// with DIR in place of the size of directories.
+func printLong(entries []repl.FileEntry) {
+	sizes := make([]string, len(entries))
+	width := len("DIR")
+	for i, e := range entries {
+		sizes[i] = "DIR"
+		if !e.IsDir {
+			sizes[i] = strconv.FormatInt(e.Size, 10)
+		}
+		if len(sizes[i]) > width {
+			width = len(sizes[i])
+		}
+	}
+	for i, e := range entries {
+		fmt.Printf("%*s %s\n", width, sizes[i], e.Name)
+	}
+}
+
+func cmdMkdir(ctx *cli.Context) error {
+	err := checkRemotePaths(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	return r.Mkdir(ctx.Args().Get(0))
+}
+
+func cmdMount(ctx *cli.Context) error {
+	dir := ctx.Args().Get(0)
+	if dir == "" {
+		dir = "."
+	}
+	key, err := parseCtrlKey(ctx.String("menu-key"))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	m, err := r.Mount(dir, ctx.String("name"))
+	if err != nil {
+		r.ExitRawMode()
+		return err
+	}
+	err = r.ExitRawMode()
+	if err != nil {
+		return err
+	}
+	info.Printf("Mounted %s at %s\n", dir, ctx.String("name"))
+	// ExitRawMode consumed the prompt, ask for a fresh one
+	_, err = r.Write([]byte("\r"))
+	if err != nil {
+		return err
+	}
+	current := console.Current()
+	defer current.Reset()
+	err = current.SetRaw()
+	if err != nil {
+		return err
+	}
+	s := &replSession{
+		r:       r,
+		console: current,
+		menuKey: key,
+		mount:   m,
+	}
+	err = s.run()
+	// keep the passthrough paused while unmounting
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current.Reset()
+	// ctrl-C: raw mode can only be entered from an idle prompt
+	_, uerr := r.Write([]byte("\x03"))
+	if uerr == nil {
+		uerr = r.EnterRawMode()
+	}
+	if uerr == nil {
+		uerr = m.Unmount()
+		r.ExitRawMode()
+	}
+	if err == nil {
+		err = uerr
+	}
+	return err
+}
+
+func cmdPut(ctx *cli.Context) error {
+	err := checkRemotePaths(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	args := ctx.Args()
+	dst, src := putArgs(args.Slice())
+	if args.Len() > 1 && src == "-" {
+		if strings.HasSuffix(dst, "/") {
+			return usagef("put from stdin needs a file name, not a directory")
+		}
+	} else if args.Len() > 1 {
+		dst, err = r.TargetPath(dst, filepath.Base(src))
+		if err != nil {
+			return err
+		}
+	}
+	opts := transferOptions(ctx)
+	if !ctx.IsSet("atomic") && opts.mode == "w" && repl.CriticalFile(dst) {
+		opts.atomic = true
+	}
+	return putFile(r, dst, src, opts)
+}
+
+// putFile copies the local file src to the remote file dst. A src of -
+// copies stdin, which has no modification time to preserve.
+func putFile(r *repl.Repl, dst, src string, opts transferOpts) error {
+	f := os.Stdin
+	if src == "-" {
+		opts.preserveTimes = false
+	} else {
+		var err error
+		f, err = os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	stats, err := r.PutWithOptions(dst, f, repl.PutOptions{
+		Mode:         opts.mode,
+		MakeDirs:     opts.makeDirs,
+		NormalizeEOL: opts.text,
+		Atomic:       opts.atomic,
+		Verify:       opts.verify,
+	})
+	if err != nil {
+		return err
+	}
+	info.Println(stats)
+	if opts.preserveTimes {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		err = r.SetMtime(dst, fi.ModTime())
+		if errors.Is(err, repl.ErrUnsupported) {
+			// only worth a warning when it was asked for, most ports
+			// can't do it
+			if opts.preserveTimesSet {
+				fmt.Fprintln(os.Stderr, "warning: device can't set file times, mtime not preserved")
+			}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func cmdPorts(ctx *cli.Context) error {
+	ports, err := repl.ListPortDetails()
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if p.VID == "" {
+			fmt.Println(p.Name)
+			continue
+		}
+		id := "usb:" + p.VID + ":" + p.PID
+		if p.SerialNumber != "" {
+			id += "  serial:" + p.SerialNumber
+		}
+		fmt.Printf("%s  %s\n", p.Name, id)
+	}
+	return nil
+}
+
+func cmdPwd(ctx *cli.Context) error {
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	cwd, err := r.Cwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(cwd)
+	return nil
+}
+
+func cmdReboot(ctx *cli.Context) error {
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("follow") {
+		c, cancel := interruptContext()
+		defer cancel()
+		return r.RebootAndStream(c, os.Stdout)
+	}
+	return softReboot(r)
+}
+
+// softReboot reboots the device from the raw REPL, leaving it at the normal
+// REPL with a fresh interpreter.
+func softReboot(r *repl.Repl) error {
+	err := r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	return r.SoftReboot()
+}
+
+// resetBefore wraps the action of the command name so that with
+// --reset-before the device is soft rebooted before the command runs.
+func resetBefore(name string, action cli.ActionFunc) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if !ctx.Bool("reset-before") || noDevice[name] {
+			return action(ctx)
+		}
+		r, err := connect(ctx)
+		if err != nil {
+			return err
+		}
+		info.Println("Rebooting device ...")
+		err = softReboot(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		return action(ctx)
+	}
+}
+
+func cmdRepl(ctx *cli.Context) error {
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := parseCtrlKey(ctx.String("menu-key"))
+	if err != nil {
+		return err
+	}
+	if ctx.String("init") != "" {
+		err = runInit(r, ctx.String("init"), ctx.Bool("fail-on-init-error"))
+		if err != nil {
+			return err
+		}
+		// leaving raw mode consumed the prompt, ask for a fresh one
+		_, err = r.Write([]byte("\r"))
+		if err != nil {
+			return err
+		}
+	}
+	if !isTerminal(os.Stdin) {
+		// not a terminal, e.g. zap repl < commands.txt
+		s := &replSession{r: r}
+		return s.runPiped()
+	}
+	// --interrupt already waited for the prompt
+	if ctx.String("init") == "" && !ctx.Bool("no-interrupt") && !ctx.Bool("interrupt") {
+		err = greet(r)
+		if err != nil {
+			return err
+		}
+	}
+	current := console.Current()
+	defer current.Reset()
+	err = current.SetRaw()
+	if err != nil {
+		return err
+	}
+	defer resetOnSignal(r, current)()
+	s := &replSession{
+		r:       r,
+		console: current,
+		menuKey: key,
+	}
+	return s.run()
+}
+
+// greetTimeout is how long the repl command waits for the prompt after the
+// ctrl-C sent on connect.
+const greetTimeout = time.Second * 2
+
+// greet waits for the prompt after the ctrl-C sent on connect, so a blocking
+// program doesn't leave the terminal silent. It shows what the interrupted
+// program printed and says how to start it again. With no prompt it explains
+// why that may be and offers to send ctrl-B, which leaves a raw REPL left
+// behind by a zap that crashed.
+func greet(r *repl.Repl) error {
+	data, err := r.AwaitPrompt(greetTimeout)
+	if errors.Is(err, repl.ErrTimeout) {
+		fmt.Fprintln(os.Stderr, "No >>> prompt from the device. It may still be in raw mode after a zap that crashed, or be wedged.")
+		var ok bool
+		ok, err = confirm("Send ctrl-B to leave raw mode?")
+		if err != nil || !ok {
+			return err
+		}
+		_, err = r.Write([]byte{0x02})
+		if err != nil {
+			return err
+		}
+		data, err = r.AwaitPrompt(greetTimeout)
+		if errors.Is(err, repl.ErrTimeout) {
+			fmt.Fprintln(os.Stderr, "Still no prompt, try resetting the board.")
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("KeyboardInterrupt")) {
+		out := bytes.TrimSuffix(data, []byte(">>> "))
+		os.Stdout.Write(bytes.TrimLeft(out, "\r\n"))
+		info.Println("(program interrupted, ctrl-D to restart it)")
+	}
+	// the prompt was consumed, ask for a fresh one
+	_, err = r.Write([]byte("\r"))
+	return err
+}
+
+// resetOnSignal restores the terminal and exits when zap is interrupted,
+// killed or hung up while the REPL has it in raw mode, since deferred calls
+// don't run then. After a hangup the device is also sent ctrl-B so it's left
+// at the normal prompt. It doesn't wait for the REPL goroutines, which may be
+// blocked reading. The returned function stops the handler.
+func resetOnSignal(r *repl.Repl, current console.Console) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				r.Port.Write([]byte{0x02})
+			}
+			current.Reset()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// runInit runs the local file fn in raw mode before the interactive REPL
+// starts, so what it defines is there at the prompt. Its errors are only
+// printed unless failOnError is set.
+func runInit(r *repl.Repl, fn string, failOnError bool) error {
+	err := r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	c, cancel := interruptContext()
+	defer cancel()
+	err = r.ExecFile(c, fn, os.Stdout)
+	var e *repl.MicroPythonError
+	if errors.As(err, &e) && !failOnError {
+		fmt.Fprint(os.Stderr, e.Traceback)
+		return nil
+	}
+	return err
+}
+
+func cmdRm(ctx *cli.Context) error {
+	err := checkRemotePaths(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	if ctx.Bool("dry-run") {
+		cwd, err := r.Cwd()
+		if err != nil {
+			return err
+		}
+		p := &plan{}
+		p.del(remotePath(cwd, ctx.Args().Get(0)))
+		return p.done()
+	}
+	return r.Rm(ctx.Args().Get(0))
+}
+
+func cmdRmdir(ctx *cli.Context) error {
+	err := checkRemotePaths(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	return r.Rmdir(ctx.Args().Get(0))
+}
+
+func cmdRun(ctx *cli.Context) error {
+	args := ctx.Args().Slice()
+	if len(args) == 0 {
+		return usagef("no file given")
+	}
+	if ctx.IsSet("until") && len(args) > 1 {
+		return usagef("run --until takes a single file without arguments")
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	if !ctx.IsSet("max-idle-reads") {
+		// a program may be quiet for as long as it likes
+		r.MaxIdleReads = 0
+	}
+	c, cancel := interruptContext()
+	defer cancel()
+	if ctx.IsSet("until") {
+		return runUntil(c, r, args[0], ctx.String("until"))
+	}
+	if len(args) == 1 {
+		err = r.ExecFile(c, args[0], os.Stdout)
+	} else {
+		argv := args[1:]
+		if argv[0] == "--" {
+			argv = argv[1:]
+		}
+		err = r.RunFileArgs(c, args[0], argv, os.Stdout)
+	}
+	exitOnSystemExit(r, err)
+	return err
+}
+
+// runUntil runs the local file fn, streaming its output, and interrupts it
+// once it prints a line containing marker. Cancelling ctx interrupts it too.
+func runUntil(ctx context.Context, r *repl.Repl, fn, marker string) error {
+	code, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// ctrl-C: interrupt running code
+			r.Port.Write([]byte("\x03"))
+		case <-done:
+		}
+	}()
+	found := false
+	err = r.Stream(code, os.Stdout, func(line []byte) bool {
+		found = bytes.Contains(line, []byte(marker))
+		return found
+	})
+	exitOnSystemExit(r, err)
+	if err != nil || found {
+		return err
+	}
+	return fmt.Errorf("%s ended without printing %q", fn, marker)
+}
+
+// exitOnSystemExit exits with the status the code on the device passed to
+// sys.exit, if it called it, so zap can be chained with && and ||.
+func exitOnSystemExit(r *repl.Repl, err error) {
+	var e *repl.ExitCodeError
+	if !errors.As(err, &e) {
+		return
+	}
+	// the exit happens before deferred calls run
+	r.ExitRawMode()
+	os.Exit(e.Code)
+}
+
+func cmdTail(ctx *cli.Context) error {
+	fn := ctx.Args().Get(0)
+	if fn == "" {
+		return usagef("no file given")
+	}
+	err := checkRemotePaths(fn)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	if ctx.IsSet("bytes") {
+		err = r.TailBytes(os.Stdout, fn, ctx.Int64("bytes"))
+	} else {
+		err = r.Tail(os.Stdout, fn, ctx.Int("lines"))
+	}
+	if err != nil || !ctx.Bool("follow") {
+		return err
+	}
+	return followFile(r, fn)
+}
+
+// tailInterval is how often tail -f polls the file for growth.
+const tailInterval = time.Second
+
+// followFile prints data appended to the remote file fn until interrupted.
+func followFile(r *repl.Repl, fn string) error {
+	c, cancel := interruptContext()
+	defer cancel()
+	offset, err := r.Size(fn)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-c.Done():
+			return nil
+		case <-time.After(tailInterval):
+		}
+		size, err := r.Size(fn)
+		if err != nil {
+			return err
+		}
+		if size < offset {
+			// truncated, start over
+			offset = 0
+		}
+		if size > offset {
+			err = r.CatRange(os.Stdout, fn, offset, size-offset)
+			if err != nil {
+				return err
+			}
+			offset = size
+		}
+	}
+}
+
+func cmdWipe(ctx *cli.Context) error {
+	if !ctx.Bool("yes") && !ctx.Bool("dry-run") && !isTerminal(os.Stdin) {
+		// a stray line of piped input shouldn't be able to confirm this
+		return usagef("wipe needs --yes when stdin isn't a terminal")
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	skip := func(name string) {
+		info.Println("Skipping", name, "(read-only or virtual mount)")
+	}
+	if ctx.Bool("dry-run") {
+		p := &plan{}
+		_, err = r.WipeWithOptions(repl.WipeOptions{
+			DryRun:   true,
+			OnRemove: func(name string, isDir bool) { p.del(name) },
+			OnSkip:   skip,
+		})
+		if err != nil {
+			return err
+		}
+		return p.done()
+	}
+	if !ctx.Bool("yes") {
+		// count first so the prompt says what's at stake
+		n, err := r.WipeWithOptions(repl.WipeOptions{DryRun: true})
+		if err != nil {
+			return err
+		}
+		opts, err := connectOptions(ctx)
+		if err != nil {
+			return err
+		}
+		ok, err := confirm(fmt.Sprintf("This will delete all %d files on %s.", n, opts.Device))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("wipe cancelled")
+		}
+	}
+	n, err := r.WipeWithOptions(repl.WipeOptions{OnSkip: skip})
+	info.Printf("Removed %d files\n", n)
+	return err
+}
+
+func cmdUpload(ctx *cli.Context) error {
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	dir := configString("upload_dir", ".")
+	exclude, err := readIgnoreFile(dir)
+	if err != nil {
+		return err
+	}
+	exclude = append(exclude, ignoreFile)
+	if ctx.IsSet("exclude") {
+		exclude = append(exclude, ctx.StringSlice("exclude")...)
+	} else {
+		exclude = append(exclude, configStrings("exclude")...)
+	}
+	if ctx.Bool("dry-run") {
+		// the plan is still worth seeing, the shortfall goes with it
+		need, free, err := r.UploadSpace(dir, exclude)
+		if err == nil && free < need {
+			err = lowSpace(true)(need, free)
+		}
+		if err != nil && err != repl.ErrUnsupported {
+			fmt.Fprintln(os.Stderr, "warning:", err)
+		}
+		return planUpload(r, dir, exclude, ctx.Bool("skip-existing"), repl.UnchangedOptions{
+			NoManifest:   ctx.Bool("no-manifest"),
+			NormalizeEOL: ctx.Bool("text"),
+		})
+	}
+	sum, err := r.UploadWithOptions(dir, repl.UploadOptions{
+		Exclude:       exclude,
+		NormalizeEOL:  ctx.Bool("text"),
+		FailFast:      ctx.Bool("fail-fast"),
+		SkipExisting:  ctx.Bool("skip-existing"),
+		Atomic:        ctx.Bool("atomic"),
+		SkipUnchanged: true,
+		NoManifest:    ctx.Bool("no-manifest"),
+		OnSkipExisting: func(name string) {
+			info.Printf("Skipping %s (already exists)\n", name)
+		},
+		OnLowSpace: lowSpace(ctx.Bool("force")),
+	}, printTransfer("Uploading"))
+	if err != nil {
+		return err
+	}
+	for _, err := range sum.Errors {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+	}
+	info.Println(sum)
+	if len(sum.Errors) > 0 {
+		return fmt.Errorf("%d files could not be uploaded", len(sum.Errors))
+	}
+	return nil
+}
+
+// planUpload prints the files upload would copy from dir, leaving out the
+// ones already on the device unchanged. With skipExisting the ones on the
+// device at all are left out.
+func planUpload(r *repl.Repl, dir string, exclude []string, skipExisting bool, unchanged repl.UnchangedOptions) error {
+	cwd, err := r.Cwd()
+	if err != nil {
+		return err
+	}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, fi := range fs {
+		if !fi.IsDir() && fi.Name() != repl.ManifestFile && !repl.MatchesIgnore(exclude, fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+	same, err := r.Unchanged(dir, names, unchanged)
+	if err != nil {
+		return err
+	}
+	p := &plan{}
+	for _, name := range names {
+		if same[name] {
+			continue
+		}
+		if skipExisting {
+			_, err := r.Stat(name)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, repl.ErrNotExist) {
+				return err
+			}
+		}
+		p.put(filepath.Join(dir, name), remotePath(cwd, name))
+	}
+	return p.done()
+}
+
+// lowSpace returns the OnLowSpace of upload, which stops it unless force is
+// set and then only warns.
+func lowSpace(force bool) func(need, free int64) error {
+	return func(need, free int64) error {
+		msg := fmt.Sprintf("uploading needs %d more bytes but only %d bytes are free on the device", need, free)
+		if force {
+			fmt.Fprintln(os.Stderr, "warning:", msg)
+			return nil
+		}
+		return errors.New(msg + ", use --force to upload anyway")
+	}
+}
+
+// printTransfer returns a repl.TransferFunc that prints the progress of
+// Upload/Download.
+func printTransfer(verb string) repl.TransferFunc {
+	return func(name string, stats *repl.TransferStats) {
+		if stats == nil {
+			info.Println(verb, name, "...")
+			return
+		}
+		info.Println(" ", stats)
+	}
+}
+
+// interruptContext returns a context that's cancelled when the process
+// receives an interrupt signal.
+func interruptContext() (context.Context, context.CancelFunc) {
+	c, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-c.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return c, cancel
+}
+
+// confirm asks the user to type yes before a destructive operation.
+func confirm(msg string) (bool, error) {
+	fmt.Print(msg + " Type 'yes' to continue: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.TrimSpace(line) == "yes", nil
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+func TestGetArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		dst, src string
+	}{
+		{nil, "", ""},
+		{[]string{"main.py"}, "main.py", "main.py"},
+		{[]string{"/lib/foo.py"}, "foo.py", "/lib/foo.py"},
+		{[]string{"/remote/dir/file.py"}, "file.py", "/remote/dir/file.py"},
+		{[]string{"lib/foo.py"}, "foo.py", "lib/foo.py"},
+		{[]string{"out.py", "/lib/foo.py"}, "out.py", "/lib/foo.py"},
+		{[]string{"local/dir/", "/lib/foo.py"}, "local/dir/", "/lib/foo.py"},
+	}
+	for _, tt := range tests {
+		dst, src := getArgs(tt.args)
+		if dst != tt.dst || src != tt.src {
+			t.Errorf("getArgs(%q) = %q, %q, want %q, %q", tt.args, dst, src, tt.dst, tt.src)
+		}
+	}
+}
+
+func TestPutArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		dst, src string
+	}{
+		{nil, "", ""},
+		{[]string{"main.py"}, "main.py", "main.py"},
+		{[]string{"/lib/foo.py"}, "/lib/foo.py", "foo.py"},
+		{[]string{"/lib/", "lib/foo.py"}, "/lib/", "lib/foo.py"},
+		{[]string{"main.py", "-"}, "main.py", "-"},
+	}
+	for _, tt := range tests {
+		dst, src := putArgs(tt.args)
+		if dst != tt.dst || src != tt.src {
+			t.Errorf("putArgs(%q) = %q, %q, want %q, %q", tt.args, dst, src, tt.dst, tt.src)
+		}
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "main.py")
+	err = ioutil.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+	tests := []struct {
+		dst, want string
+	}{
+		// a file is overwritten
+		{file, file},
+		// a directory gets the file inside
+		{dir, filepath.Join(dir, "foo.py")},
+		{dir + sep, filepath.Join(dir, "foo.py")},
+		// a missing path is the new name, unless it ends with a separator
+		{filepath.Join(dir, "new.py"), filepath.Join(dir, "new.py")},
+		{filepath.Join(dir, "new") + sep, filepath.Join(dir, "new", "foo.py")},
+	}
+	for _, tt := range tests {
+		got, err := localTarget(tt.dst, "foo.py")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.dst, err)
+		}
+		if got != tt.want {
+			t.Errorf("localTarget(%q) = %q, want %q", tt.dst, got, tt.want)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dir, "new"))
+	if err != nil || !fi.IsDir() {
+		t.Errorf("new directory wasn't made: %v", err)
+	}
+}
+
+// fakeDevice plays a MicroPython device holding one file in its raw REPL.
+// It answers the code of Get with the file and runs everything else
+// without output. A ctrl-D with no code soft reboots it.
+type fakeDevice struct {
+	file []byte
+	code []byte
+	// paste is how much of the raw-paste request was received
+	paste int
+}
+
+const fakeBanner = "raw REPL; CTRL-B to exit\r\n>"
+
+// input feeds b to the device and returns what it prints in reply.
+func (d *fakeDevice) input(b []byte) []byte {
+	var out bytes.Buffer
+	for _, c := range b {
+		switch {
+		case d.paste == 1 && c == 'A':
+			d.paste = 2
+		case d.paste == 2 && c == 0x01:
+			// raw-paste mode isn't supported
+			d.paste = 0
+			out.WriteString("R\x00")
+		case c == 0x05:
+			d.paste = 1
+		case c == 0x01:
+			d.code = nil
+			out.WriteString(fakeBanner)
+		case c == 0x02:
+			out.WriteString("\r\nMicroPython\r\n>>> ")
+		case c == 0x03:
+			d.code = nil
+		case c == 0x04 && len(d.code) == 0:
+			out.WriteString("OK\r\nMPY: soft reboot\r\n" + fakeBanner)
+		case c == 0x04:
+			out.WriteString("OK")
+			if bytes.Contains(d.code, []byte("g(o,")) {
+				fmt.Fprintf(&out, "%d %d r%s\r\n", len(d.file), crc32.ChecksumIEEE(d.file), base64.StdEncoding.EncodeToString(d.file))
+			}
+			out.WriteString("\x04\x04>")
+			d.code = nil
+		default:
+			d.paste = 0
+			d.code = append(d.code, c)
+		}
+	}
+	return out.Bytes()
+}
+
+// devicePort is a repl.Port connected to a fakeDevice.
+type devicePort struct {
+	dev fakeDevice
+	out bytes.Buffer
+}
+
+// Read returns nothing without an error when there's no output, like a
+// serial port whose read timed out.
+func (p *devicePort) Read(b []byte) (int, error) {
+	if p.out.Len() == 0 {
+		return 0, nil
+	}
+	return p.out.Read(b)
+}
+
+func (p *devicePort) Write(b []byte) (int, error) {
+	p.out.Write(p.dev.input(b))
+	return len(b), nil
+}
+
+func (p *devicePort) Close() error                         { return nil }
+func (p *devicePort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *devicePort) SetDTR(dtr bool) error                { return nil }
+func (p *devicePort) SetRTS(rts bool) error                { return nil }
+func (p *devicePort) Break(d time.Duration) error          { return nil }
+
+// serveDevice serves a fakeDevice over TCP like zap serve and returns its
+// tcp:// address.
+func serveDevice(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				d := &fakeDevice{}
+				b := make([]byte, 256)
+				for {
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					conn.Write(d.input(b[:n]))
+				}
+			}()
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestGetToCurrentDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	p := &devicePort{dev: fakeDevice{file: []byte("print('hi')\n")}}
+	r := &repl.Repl{Port: p, NoCompress: true, NoHelper: true}
+	dst, src := getArgs([]string{"/remote/dir/file.py"})
+	dst, err = localTarget(dst, path.Base(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = getFile(r, dst, src, transferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.py"))
+	if err != nil || string(b) != "print('hi')\n" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "remote")); err == nil {
+		t.Fatal("made the remote directories locally")
+	}
+}
+
+func TestStatusOnStderr(t *testing.T) {
+	// status messages like "Rebooting device ..." from --reset-before must
+	// not end up in the output of the command, e.g. zap get --stdout
+	if info.Writer() != os.Stderr {
+		t.Fatal("status messages don't go to stderr")
+	}
+	set := flag.NewFlagSet("zap", flag.ContinueOnError)
+	set.Var(cli.NewStringSlice(serveDevice(t)), "device", "")
+	set.Int("baudrate", 115200, "")
+	set.Duration("read-timeout", time.Millisecond*100, "")
+	set.Bool("no-reconnect", true, "")
+	set.Bool("reset-before", true, "")
+	ctx := cli.NewContext(cli.NewApp(), set, nil)
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = wr
+	ran := false
+	err = resetBefore("eval", func(ctx *cli.Context) error {
+		ran = true
+		return nil
+	})(ctx)
+	os.Stdout = stdout
+	wr.Close()
+	out, _ := ioutil.ReadAll(rd)
+	if err != nil || !ran {
+		t.Fatalf("command ran: %v, %v", ran, err)
+	}
+	if len(out) > 0 {
+		t.Fatalf("wrote %q to stdout", out)
+	}
+}
+
+// commandContext returns a context to call a command action with directly,
+// with args, which may set flags, and flags defaulting to the given values.
+func commandContext(args []string, flags map[string]string) *cli.Context {
+	set := flag.NewFlagSet("zap", flag.ContinueOnError)
+	for name, v := range flags {
+		set.String(name, v, "")
+	}
+	set.Parse(args)
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestArgumentsCheckedFirst(t *testing.T) {
+	// bad arguments are a usage error before any device is opened
+	tests := []struct {
+		name   string
+		action cli.ActionFunc
+		args   []string
+		flags  map[string]string
+		want   string
+	}{
+		{"cd", cmdCd, []string{"../x"}, nil, "contains .."},
+		{"backup", cmdBackup, []string{"out.tar"}, map[string]string{"path": ".."}, "contains .."},
+		{"run", cmdRun, nil, nil, "no file given"},
+		{"run --until", cmdRun, []string{"--until=done", "a.py", "x"}, map[string]string{"until": ""}, "--until"},
+	}
+	for _, tt := range tests {
+		err := tt.action(commandContext(tt.args, tt.flags))
+		if code := exitCode(err); code != exitUsage || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: exit code %d (%v), want %d (%s)", tt.name, code, err, exitUsage, tt.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+const menuHelp = `Local commands:
+   get [local] remote  Copy a file from the device
+   ls                  List files
+   put remote [local]  Copy a file to the device
+   reboot              Perform a soft reboot
+   exit                Leave the REPL`
+
+// replSession passes the terminal through to the friendly REPL and pauses to
+// run local commands over the same connection when the menu key is pressed.
+type replSession struct {
+	r       *repl.Repl
+	console console.Console
+	menuKey byte
+	// exitKey leaves the passthrough straight away when it's not zero
+	exitKey byte
+	// mount answers filesystem requests from the device when set
+	mount *repl.Mount
+	// mu is held while the passthrough is paused
+	mu sync.Mutex
+	// tail is the end of the output so far and lastOutput when it came,
+	// both guarded by mu
+	tail       []byte
+	lastOutput time.Time
+	// stopped ends pipeOutput, guarded by mu
+	stopped bool
+}
+
+// pipeSettle is how long the device has to be quiet at its prompt before
+// runPiped takes the input as done.
+const pipeSettle = time.Millisecond * 300
+
+// pipeTimeout is how long runPiped waits for the device to settle once stdin
+// ended, unless --response-timeout says otherwise.
+const pipeTimeout = time.Second * 30
+
+// replPrompt is printed by the friendly REPL when it's ready for a line.
+var replPrompt = []byte(">>> ")
+
+// run copies stdin to the device until stdin is closed, the exit key is
+// pressed or the user exits from the menu.
+func (s *replSession) run() error {
+	go s.pipeOutput()
+	defer s.stop()
+	in := bufio.NewReader(os.Stdin)
+	b := make([]byte, 1024)
+	for {
+		n, err := in.Read(b)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := b[:n]
+		if s.exitKey != 0 {
+			if i := bytes.IndexByte(data, s.exitKey); i >= 0 {
+				_, err = s.write(data[:i])
+				return err
+			}
+		}
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, s.menuKey)
+			if i < 0 {
+				_, err = s.write(data)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			_, err = s.write(data[:i])
+			if err != nil {
+				return err
+			}
+			quit, err := s.menu(in)
+			if err != nil || quit {
+				return err
+			}
+			data = data[i+1:]
+		}
+	}
+}
+
+// runPiped sends stdin to the device when it isn't a terminal, with each
+// line ended by a carriage return as if typed. Once stdin ends and the device
+// is quiet at its prompt it sends ctrl-B and returns. A device that doesn't
+// get there within pipeTimeout fails with repl.ErrTimeout.
+func (s *replSession) runPiped() error {
+	go s.pipeOutput()
+	b := make([]byte, 1024)
+	var sent time.Time
+	for {
+		n, err := os.Stdin.Read(b)
+		if n > 0 {
+			sent = time.Now()
+			_, werr := s.write(bytes.Replace(b[:n], []byte("\n"), []byte("\r"), -1))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	timeout := pipeTimeout
+	if s.r.ResponseTimeout > 0 {
+		timeout = s.r.ResponseTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for !sent.IsZero() && !s.settled(sent) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: device didn't return to its prompt within %v of the end of input", repl.ErrTimeout, timeout)
+		}
+		time.Sleep(pipeSettle / 4)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.r.Write([]byte{0x02})
+	return err
+}
+
+// settled reports whether the device has answered input sent at sent,
+// shown its prompt and printed nothing since for pipeSettle.
+func (s *replSession) settled(sent time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastOutput.After(sent) && bytes.HasSuffix(s.tail, replPrompt) &&
+		time.Since(s.lastOutput) >= pipeSettle
+}
+
+// stop ends pipeOutput. Once it returns nothing else reads from the device
+// on behalf of the session.
+func (s *replSession) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+}
+
+// pipeOutput copies device output to stdout while the passthrough isn't
+// paused, until the session is stopped.
+func (s *replSession) pipeOutput() {
+	b := make([]byte, 1024)
+	for {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		n, err := s.r.ReadOutput(b)
+		if n > 0 {
+			s.tail = append(s.tail, b[:n]...)
+			if len(s.tail) > len(replPrompt) {
+				s.tail = s.tail[len(s.tail)-len(replPrompt):]
+			}
+			s.lastOutput = time.Now()
+			if s.mount != nil {
+				err = s.mount.Filter(b[:n], os.Stdout)
+			} else {
+				_, err = os.Stdout.Write(b[:n])
+			}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write sends keyboard input to the device.
+func (s *replSession) write(p []byte) (int, error) {
+	if s.mount != nil {
+		return s.mount.Write(p)
+	}
+	return s.r.Write(p)
+}
+
+// menu prompts for a single local command and runs it. It reports whether the
+// user asked to leave the REPL.
+func (s *replSession) menu(in *bufio.Reader) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.console.Reset()
+	if err != nil {
+		return false, err
+	}
+	defer s.console.SetRaw()
+	fmt.Print("\r\nzap> ")
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return false, s.resume()
+	}
+	switch args[0] {
+	case "exit", "quit":
+		return true, nil
+	case "get", "ls", "put", "reboot":
+		err = s.exec(args)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+		}
+		return false, nil
+	}
+	fmt.Println(menuHelp)
+	return false, s.resume()
+}
+
+// resume asks the friendly REPL for a fresh prompt.
+func (s *replSession) resume() error {
+	_, err := s.r.Write([]byte("\r"))
+	return err
+}
+
+// exec runs a local command in raw mode and returns to the friendly REPL.
+func (s *replSession) exec(args []string) error {
+	if (args[0] == "get" || args[0] == "put") && len(args) < 2 {
+		return fmt.Errorf("%s needs a file name", args[0])
+	}
+	// ctrl-C: raw mode can only be entered from an idle prompt
+	_, err := s.r.Write([]byte("\x03"))
+	if err != nil {
+		return err
+	}
+	err = s.r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	// ExitRawMode consumes the prompt, so ask for another one after it
+	defer s.resume()
+	defer s.r.ExitRawMode()
+	switch args[0] {
+	case "get":
+		local, remote := getArgs(args[1:])
+		return getFile(s.r, local, remote, transferOpts{})
+	case "ls":
+		fs, err := s.r.Ls()
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.Join(fs, "  "))
+	case "put":
+		remote, local := putArgs(args[1:])
+		return putFile(s.r, remote, local, transferOpts{})
+	case "reboot":
+		return s.r.SoftReboot()
+	}
+	return nil
+}
+
+// parseCtrlKey parses a key name like "ctrl-t" or "^T" into its control
+// character.
+func parseCtrlKey(s string) (byte, error) {
+	k := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(k, "ctrl-"):
+		k = k[5:]
+	case strings.HasPrefix(k, "^"):
+		k = k[1:]
+	default:
+		return 0, fmt.Errorf("invalid key %q, expected something like ctrl-t", s)
+	}
+	if len(k) != 1 || k[0] < 'a' || k[0] > 'z' {
+		return 0, fmt.Errorf("invalid key %q, expected something like ctrl-t", s)
+	}
+	return k[0] & 0x1f, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+)
+
+// singleDevice lists the interactive commands that can't run on several
+// devices at once.
+var singleDevice = map[string]bool{
+	"edit":  true,
+	"mount": true,
+	"repl":  true,
+	"serve": true,
+}
+
+// noDevice lists the commands that don't talk to a device.
+var noDevice = map[string]bool{
+	"__complete": true,
+	"completion": true,
+	"config":     true,
+	"help":       true,
+	"ports":      true,
+	"version":    true,
+}
+
+// deviceNames returns the devices given with --device. The flag may repeat
+// and each value may be a comma separated list or a glob like /dev/ttyUSB*.
+func deviceNames(ctx *cli.Context) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, v := range ctx.StringSlice("device") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			matches := []string{name}
+			if !isTCPDevice(name) && strings.ContainsAny(name, "*?[") {
+				var err error
+				matches, err = filepath.Glob(name)
+				if err != nil {
+					return nil, fmt.Errorf("bad device pattern %s: %v", name, err)
+				}
+				if len(matches) == 0 {
+					return nil, usagef("no device matches %s", name)
+				}
+				sort.Strings(matches)
+			}
+			for _, m := range matches {
+				if !seen[m] {
+					seen[m] = true
+					names = append(names, m)
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// isTCPDevice reports whether name is a tcp:// address rather than a port.
+func isTCPDevice(name string) bool {
+	return strings.HasPrefix(name, "tcp://")
+}
+
+// eachDevice wraps the action of the command name so that with several
+// devices it runs once per device and reports which ones failed.
+func eachDevice(name string, action cli.ActionFunc) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if noDevice[name] {
+			return action(ctx)
+		}
+		devices, err := deviceNames(ctx)
+		if err != nil {
+			return err
+		}
+		if len(devices) <= 1 {
+			return action(ctx)
+		}
+		if singleDevice[name] {
+			return usagef("%s can't be used with more than one device", name)
+		}
+		var stdin []byte
+		if name == "put" && ctx.Args().Get(1) == "-" {
+			// every device gets the same copy of stdin
+			stdin, err = ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+		}
+		return runOnDevices(devices, name, ctx.Bool("parallel"), stdin)
+	}
+}
+
+// runOnDevices runs zap again for each device with the same arguments,
+// prefixing every line of output with the device name. The devices are done
+// one after another unless parallel is set. Each one reads stdin from its
+// own reader over stdin when that's not nil.
+func runOnDevices(devices []string, command string, parallel bool, stdin []byte) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := withoutDeviceFlags(os.Args[1:], command)
+	errs := make([]error, len(devices))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		run := func(i int, device string) {
+			defer wg.Done()
+			prefix := device + ": "
+			stdout := &prefixWriter{w: os.Stdout, mu: &mu, prefix: prefix}
+			stderr := &prefixWriter{w: os.Stderr, mu: &mu, prefix: prefix}
+			cmd := exec.Command(self, append([]string{"--device", device}, args...)...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			if stdin != nil {
+				cmd.Stdin = bytes.NewReader(stdin)
+			}
+			errs[i] = cmd.Run()
+			stdout.Flush()
+			stderr.Flush()
+		}
+		wg.Add(1)
+		if parallel {
+			go run(i, device)
+		} else {
+			run(i, device)
+		}
+	}
+	wg.Wait()
+	failed, planned := 0, 0
+	info.Println()
+	for i, device := range devices {
+		var ee *exec.ExitError
+		if errors.As(errs[i], &ee) && ee.ExitCode() == exitPlanned {
+			planned++
+			info.Printf("%s: changes planned\n", device)
+			continue
+		}
+		if errs[i] != nil {
+			failed++
+			info.Printf("%s: FAILED (%v)\n", device, errs[i])
+		} else {
+			info.Printf("%s: ok\n", device)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s failed on %d of %d devices", command, failed, len(devices))
+	}
+	if planned > 0 {
+		return &plannedError{planned}
+	}
+	return nil
+}
+
+// withoutDeviceFlags removes the --device flags given before command from
+// args so a single device can be passed instead.
+func withoutDeviceFlags(args []string, command string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == command {
+			return append(out, args[i:]...)
+		}
+		switch {
+		case a == "-d" || a == "--device" || a == "-device":
+			i++
+		case strings.HasPrefix(a, "-d=") || strings.HasPrefix(a, "--device=") || strings.HasPrefix(a, "-device="):
+		default:
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// prefixWriter writes each complete line to w preceded by prefix. Lines are
+// written while holding mu so the output of several devices doesn't mix
+// within a line.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes what's left of an unterminated last line.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, "%s%s\n", p.prefix, line)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/console"
+)
+
+// pagerThreshold is the size from which cat output is paged.
+const pagerThreshold = 16 * 1024
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	_, err := console.ConsoleFromFile(f)
+	return err == nil
+}
+
+// pager pipes what's written to it through a pager program.
+type pager struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// startPager starts $PAGER, or less when it isn't set, writing to stdout.
+func startPager() (*pager, error) {
+	name := os.Getenv("PAGER")
+	if name == "" {
+		name = "less"
+	}
+	args := strings.Fields(name)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &pager{in, cmd}, nil
+}
+
+// Close ends the input of the pager and waits for the user to quit it.
+func (p *pager) Close() error {
+	p.WriteCloser.Close()
+	return p.cmd.Wait()
+}
@@ -0,0 +1,240 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveBufSize is the size of the read buffer GetArchive allocates on the
+// device. It's a multiple of 3 so each base64 line decodes on its own.
+const archiveBufSize = 3072
+
+// archiveCode streams the tree under root as base64 lines. Each entry is a
+// header packed as >BHI (1 for a directory or 0 for a file, the length of
+// the path and the size of the file) followed by the path relative to root
+// and, for a file, its contents and a trailer packed as >BI: 1 and the CRC-32
+// of the contents, or 0 and 0 on ports without crc32. The device lacks
+// tarfile, hence the custom format.
+const archiveCode = osImport + `import ustruct, ubinascii
+from ubinascii import b2a_base64
+_b = bytearray(%d)
+_crc = getattr(ubinascii, 'crc32', None)
+def _arc(d, p):
+	for e in uos.ilistdir(d):
+		f = (d if d.endswith('/') else d + '/') + e[0]
+		n = (p + e[0]).encode()
+		if e[1] & 0x4000:
+			print(str(b2a_base64(ustruct.pack('>BHI', 1, len(n), 0) + n), 'ascii'), end='')
+			_arc(f, p + e[0] + '/')
+			continue
+		s = uos.stat(f)[6]
+		print(str(b2a_base64(ustruct.pack('>BHI', 0, len(n), s) + n), 'ascii'), end='')
+		h = open(f, 'rb')
+		m = memoryview(_b)
+		c = 0
+		while s > 0:
+			k = h.readinto(m[:min(s, len(_b))])
+			if not k:
+				raise OSError(5)
+			if _crc:
+				c = _crc(m[:k], c)
+			print(str(b2a_base64(m[:k]), 'ascii'), end='')
+			s -= k
+		h.close()
+		print(str(b2a_base64(ustruct.pack('>BI', 1 if _crc else 0, c & 0xffffffff)), 'ascii'), end='')
+_arc(%s, '')
+del _arc, _b, _crc
+`
+
+// GetArchive copies the directory remoteDir from the device into localDir
+// in a single exchange instead of one per file, which is much faster for
+// many small files. Each file is checked against the CRC-32 the device sends
+// along, where it has crc32, and one that arrived corrupted is copied again
+// with GetFile. When the device can't allocate the buffer it needs the files
+// are copied one at a time with GetDir instead.
+func (r *Repl) GetArchive(localDir, remoteDir string) (TransferStats, error) {
+	start := time.Now()
+	pr, pw := io.Pipe()
+	type result struct {
+		n       int64
+		corrupt []string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, corrupt, err := unpackArchive(r.local(), pr, localDir)
+		// keep reading so the exchange with the device completes
+		io.Copy(ioutil.Discard, pr)
+		done <- result{n, corrupt, err}
+	}()
+	code := fmt.Sprintf(archiveCode, archiveBufSize, pyString(remoteDir))
+	_, err := r.Exec([]byte(code), &base64LineWriter{w: pw})
+	pw.Close()
+	res := <-done
+	var e *MicroPythonError
+	if errors.As(err, &e) && e.Type == "MemoryError" {
+		return r.GetDir(localDir, remoteDir)
+	}
+	if err != nil {
+		return TransferStats{}, err
+	}
+	if res.err != nil {
+		return TransferStats{}, res.err
+	}
+	stats := TransferStats{Bytes: res.n}
+	for _, name := range res.corrupt {
+		dst, err := archivePath(localDir, name)
+		if err != nil {
+			return stats, err
+		}
+		s, err := r.GetFile(dst, path.Join(remoteDir, name))
+		stats = stats.Add(s)
+		if err != nil {
+			return stats, err
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
+
+// GetDir copies the directory remoteDir from the device into localDir one
+// file at a time.
+func (r *Repl) GetDir(localDir, remoteDir string) (TransferStats, error) {
+	var total TransferStats
+	root := strings.TrimSuffix(remoteDir, "/") + "/"
+	err := r.local().MkdirAll(localDir)
+	if err != nil {
+		return total, err
+	}
+	err = r.Walk(remoteDir, func(p string, isDir bool, size int64) error {
+		dst, err := archivePath(localDir, strings.TrimPrefix(p, root))
+		if err != nil {
+			return err
+		}
+		if isDir {
+			return r.local().MkdirAll(dst)
+		}
+		stats, err := r.GetFile(dst, p)
+		total = total.Add(stats)
+		return err
+	})
+	return total, err
+}
+
+// unpackArchive writes the entries read from the stream of archiveCode into
+// dir on fs and returns the number of file bytes written and the names of the files
+// whose CRC-32 didn't match.
+func unpackArchive(fs LocalFS, rd io.Reader, dir string) (int64, []string, error) {
+	var total int64
+	var corrupt []string
+	err := fs.MkdirAll(dir)
+	if err != nil {
+		return total, nil, err
+	}
+	for {
+		var hdr struct {
+			Kind    uint8
+			NameLen uint16
+			Size    uint32
+		}
+		err := binary.Read(rd, binary.BigEndian, &hdr)
+		if err == io.EOF {
+			return total, corrupt, nil
+		}
+		if err != nil {
+			return total, corrupt, err
+		}
+		name := make([]byte, hdr.NameLen)
+		_, err = io.ReadFull(rd, name)
+		if err != nil {
+			return total, corrupt, err
+		}
+		dst, err := archivePath(dir, string(name))
+		if err != nil {
+			return total, corrupt, err
+		}
+		if hdr.Kind == 1 {
+			err = fs.MkdirAll(dst)
+			if err != nil {
+				return total, corrupt, err
+			}
+			continue
+		}
+		f, err := fs.Create(dst)
+		if err != nil {
+			return total, corrupt, err
+		}
+		h := crc32.NewIEEE()
+		n, err := io.CopyN(io.MultiWriter(f, h), rd, int64(hdr.Size))
+		total += n
+		cerr := f.Close()
+		if err != nil {
+			return total, corrupt, err
+		}
+		if cerr != nil {
+			return total, corrupt, cerr
+		}
+		var trailer struct {
+			HasCRC uint8
+			CRC    uint32
+		}
+		err = binary.Read(rd, binary.BigEndian, &trailer)
+		if err != nil {
+			return total, corrupt, err
+		}
+		if trailer.HasCRC == 1 && trailer.CRC != h.Sum32() {
+			corrupt = append(corrupt, string(name))
+		}
+	}
+}
+
+// archivePath returns the local path of the entry name under dir. Cleaning
+// the name as a rooted path keeps it from reaching outside of dir.
+func archivePath(dir, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", fmt.Errorf("bad archive entry %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean[1:])), nil
+}
+
+// base64LineWriter decodes each complete line of base64 written to it and
+// passes the bytes on to w.
+type base64LineWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (b *base64LineWriter) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	for {
+		i := bytes.IndexByte(b.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimSpace(b.buf[:i])
+		b.buf = b.buf[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		d := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(d, line)
+		if err != nil {
+			return 0, fmt.Errorf("corrupted archive data: %v", err)
+		}
+		_, err = b.w.Write(d[:n])
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// archiveEntry appends a file entry of the stream of archiveCode to b, with
+// crc as its CRC-32 when hasCRC is set.
+func archiveEntry(b *bytes.Buffer, name, data string, hasCRC uint8, crc uint32) {
+	binary.Write(b, binary.BigEndian, struct {
+		Kind    uint8
+		NameLen uint16
+		Size    uint32
+	}{0, uint16(len(name)), uint32(len(data))})
+	b.WriteString(name + data)
+	binary.Write(b, binary.BigEndian, struct {
+		HasCRC uint8
+		CRC    uint32
+	}{hasCRC, crc})
+}
+
+func TestUnpackArchiveCRC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var b bytes.Buffer
+	archiveEntry(&b, "good.py", "print(1)\n", 1, crc32.ChecksumIEEE([]byte("print(1)\n")))
+	archiveEntry(&b, "bad.py", "print(2)\n", 1, crc32.ChecksumIEEE([]byte("print(3)\n")))
+	archiveEntry(&b, "nocrc.py", "print(4)\n", 0, 0)
+	archiveEntry(&b, "empty.py", "", 1, 0)
+	n, corrupt, err := unpackArchive(OSFS{}, &b, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 27 {
+		t.Errorf("wrote %d bytes, want 27", n)
+	}
+	if !reflect.DeepEqual(corrupt, []string{"bad.py"}) {
+		t.Errorf("corrupt %q, want bad.py", corrupt)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "nocrc.py"))
+	if err != nil || string(got) != "print(4)\n" {
+		t.Errorf("nocrc.py: %q, %v", got, err)
+	}
+}
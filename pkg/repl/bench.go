@@ -0,0 +1,47 @@
+package repl
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ping times a round trip through the raw REPL running code that does
+// nothing.
+func (r *Repl) Ping() (time.Duration, error) {
+	start := time.Now()
+	_, err := r.Exec([]byte("pass"), nil)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// flashWriteCode writes n bytes to the file p in 512 byte blocks and prints
+// how long that took on the device in milliseconds.
+const flashWriteCode = `import utime
+b = bytes(512)
+t = utime.ticks_ms()
+with open(p, 'wb') as f:
+	while n > 0:
+		f.write(b[:min(n, 512)])
+		n -= 512
+print(utime.ticks_diff(utime.ticks_ms(), t), end='')
+del b
+`
+
+// FlashWrite writes n bytes to the remote file path with code running on the
+// device and returns how long the device took, leaving out the serial link.
+func (r *Repl) FlashWrite(path string, n int64) (time.Duration, error) {
+	code := "p = " + pyString(path) + "\nn = " + strconv.FormatInt(n, 10) + "\n" + flashWriteCode
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
+	if err != nil {
+		return 0, err
+	}
+	ms, err := strconv.ParseInt(b.String(), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,87 @@
+package repl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// boardInfoCode prints one "key value" line per attribute the port exposes.
+const boardInfoCode = `import sys, gc
+try:
+	import machine
+except ImportError:
+	machine = None
+i = sys.implementation
+print('platform', sys.platform)
+print('implementation', i.name, '.'.join(str(x) for x in i.version[:3]))
+if hasattr(i, '_machine'):
+	print('machine', i._machine)
+if machine and hasattr(machine, 'freq'):
+	f = machine.freq()
+	print('freq', f[0] if isinstance(f, tuple) else f)
+gc.collect()
+if hasattr(gc, 'mem_free') and hasattr(gc, 'mem_alloc'):
+	print('ram', gc.mem_free() + gc.mem_alloc())
+try:
+	import esp
+	if hasattr(esp, 'flash_size'):
+		print('flash', esp.flash_size())
+except ImportError:
+	pass
+try:
+	import rp2
+	b = rp2.Flash()
+	print('flash', b.ioctl(4, 0) * b.ioctl(5, 0))
+except ImportError:
+	pass
+`
+
+// BoardInfo describes the connected board. Fields the port doesn't expose are
+// left empty.
+type BoardInfo struct {
+	Platform       string
+	Implementation string
+	Machine        string
+	ChipName       string
+	FreqHz         int64
+	FlashBytes     int64
+	// RAMBytes is the size of the MicroPython heap in bytes, as the
+	// device printed it.
+	RAMBytes string
+}
+
+// BoardInfo collects the chip name, CPU frequency, flash and RAM size of the
+// board.
+func (r *Repl) BoardInfo() (BoardInfo, error) {
+	var info BoardInfo
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(boardInfoCode), b)
+	if err != nil {
+		return info, err
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "platform":
+			info.Platform = kv[1]
+		case "implementation":
+			info.Implementation = kv[1]
+		case "machine":
+			info.Machine = kv[1]
+			// _machine looks like "Raspberry Pi Pico with RP2040"
+			if i := strings.LastIndex(kv[1], " with "); i >= 0 {
+				info.ChipName = kv[1][i+6:]
+			}
+		case "freq":
+			info.FreqHz, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "flash":
+			info.FlashBytes, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "ram":
+			info.RAMBytes = kv[1]
+		}
+	}
+	return info, nil
+}
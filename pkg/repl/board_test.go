@@ -0,0 +1,26 @@
+package repl
+
+import "testing"
+
+func TestBoardInfo(t *testing.T) {
+	p := newFakePort()
+	p.reply = rawREPL("platform rp2\r\nimplementation micropython 1.19.1\r\n" +
+		"machine Raspberry Pi Pico with RP2040\r\nfreq 125000000\r\nram 192064\r\nflash 1441792\r\n")
+	r := &Repl{Port: p}
+	info, err := r.BoardInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BoardInfo{
+		Platform:       "rp2",
+		Implementation: "micropython 1.19.1",
+		Machine:        "Raspberry Pi Pico with RP2040",
+		ChipName:       "RP2040",
+		FreqHz:         125000000,
+		FlashBytes:     1441792,
+		RAMBytes:       "192064",
+	}
+	if info != want {
+		t.Fatalf("got %+v", info)
+	}
+}
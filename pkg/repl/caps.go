@@ -0,0 +1,180 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Caps describes what the firmware on the device supports. EnterRawMode
+// probes it once per connection, so operations can check up front instead of
+// each trying and falling back.
+type Caps struct {
+	// Probed is set once the device was probed. Until then, or when the
+	// probe failed, the other fields are all false and operations find out
+	// for themselves.
+	Probed bool
+	// RawPaste is set when the raw REPL takes code in raw-paste mode, where
+	// the device paces what's sent so its input buffer can't overflow. Exec
+	// and everything built on it, like Put and Upload, use it then.
+	RawPaste bool
+	// Statvfs is set when uos.statvfs is there for DiskFree.
+	Statvfs bool
+	// Utime is set when uos.utime is there for SetMtime.
+	Utime bool
+	// Epoch is the Unix time the clock of the device counts from.
+	Epoch int64
+}
+
+// capsCode prints whether uos has statvfs and utime and the year time
+// counts from.
+const capsCode = osImport + `try:
+	import utime
+except ImportError:
+	import time as utime
+print(int(hasattr(uos, 'statvfs')), int(hasattr(uos, 'utime')), utime.gmtime(0)[0])
+`
+
+// Capabilities returns what EnterRawMode found out about the device.
+func (r *Repl) Capabilities() Caps {
+	r.capsMu.Lock()
+	defer r.capsMu.Unlock()
+	return r.caps
+}
+
+// probeCaps fills in Capabilities the first time the device is in raw mode.
+// The probe itself is sent in raw-paste mode to find out whether that works.
+// A failed probe leaves Capabilities unprobed rather than failing the
+// command.
+func (r *Repl) probeCaps() {
+	if r.Capabilities().Probed {
+		return
+	}
+	r.mu.Lock()
+	r.probePaste = true
+	r.mu.Unlock()
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(capsCode), b)
+	if err != nil {
+		return
+	}
+	var statvfs, utime, year int
+	_, err = fmt.Sscan(b.String(), &statvfs, &utime, &year)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	caps := Caps{
+		Probed:   true,
+		RawPaste: r.rawPaste,
+		Statvfs:  statvfs == 1,
+		Utime:    utime == 1,
+	}
+	r.mu.Unlock()
+	if year == 2000 {
+		caps.Epoch = epoch2000
+	}
+	r.capsMu.Lock()
+	r.caps = caps
+	r.capsMu.Unlock()
+	r.epochMu.Lock()
+	r.epochOffset = caps.Epoch
+	r.epochKnown = true
+	r.epochMu.Unlock()
+}
+
+// pasteRaw sends code in raw-paste mode, writing no more than the device
+// said it has room for. It reports false, with the raw REPL ready for code
+// sent the usual way, when the device doesn't support raw-paste mode.
+func (r *Repl) pasteRaw(code []byte) (bool, error) {
+	// ctrl-E A ctrl-A: ask for raw-paste mode
+	_, err := r.Port.Write([]byte("\x05A\x01"))
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(okTimeout)
+	resp, err := r.readN(2, deadline)
+	if errors.Is(err, ErrTimeout) {
+		return false, errors.New("could not exec command")
+	}
+	if err != nil {
+		return false, err
+	}
+	switch string(resp) {
+	case "R\x01":
+	case "R\x00":
+		// understood but not supported
+		return false, nil
+	default:
+		// firmware from before raw-paste mode took the ctrl-A for a fresh
+		// raw REPL and printed the banner again
+		banner := r.rawBanner()
+		if bytes.HasPrefix(banner, resp) {
+			banner = banner[len(resp):]
+		}
+		_, err = r.readUntil(banner, nil, deadline)
+		return false, err
+	}
+	b, err := r.readN(2, deadline)
+	if err != nil {
+		return false, err
+	}
+	window := int(binary.LittleEndian.Uint16(b))
+	room := window
+	for len(code) > 0 {
+		for room == 0 {
+			c, err := r.readN(1, time.Now().Add(okTimeout))
+			if err != nil {
+				return true, err
+			}
+			switch c[0] {
+			case 0x01:
+				room += window
+			case 0x04:
+				// the device ended the paste early, acknowledge it
+				_, err = r.Port.Write([]byte("\x04"))
+				return true, err
+			default:
+				return true, fmt.Errorf("unexpected %q in raw-paste flow control", c)
+			}
+		}
+		n := room
+		if n > len(code) {
+			n = len(code)
+		}
+		_, err = r.Port.Write(code[:n])
+		if err != nil {
+			return true, err
+		}
+		code = code[n:]
+		room -= n
+	}
+	// ctrl-D: end of code, the device answers with another once it has it
+	// all, skipping window updates that were still on the way
+	_, err = r.Port.Write([]byte("\x04"))
+	if err != nil {
+		return true, err
+	}
+	_, err = r.readUntil([]byte("\x04"), nil, time.Now().Add(okTimeout))
+	return true, err
+}
+
+// readN reads exactly n bytes, giving up with ErrTimeout after deadline.
+func (r *Repl) readN(n int, deadline time.Time) ([]byte, error) {
+	b := make([]byte, n)
+	got := 0
+	for got < n {
+		m, err := r.readPort(b[got:])
+		if err != nil {
+			return b[:got], err
+		}
+		got += m
+		if m == 0 && time.Now().After(deadline) {
+			return b[:got], ErrTimeout
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,203 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// crcCode defines _crc, the CRC32 function of the device, or None when the
+// firmware doesn't have one and only chunk lengths can be checked.
+const crcCode = `import ubinascii
+_crc=getattr(ubinascii,'crc32',None)
+`
+
+// putChunkDefs defines w, which writes a base64 chunk to the file f opened
+// by Put once it decodes and matches the CRC32 c. A chunk deflated on the
+// host is passed with z set. It returns 1 instead of writing a corrupted
+// chunk.
+const putChunkDefs = `from ubinascii import a2b_base64
+` + crcCode + `def w(c,x,z=0):
+	try:
+		d=a2b_base64(x)
+		if z:
+			d=_dz(d)
+	except Exception:
+		return 1
+	if _crc and _crc(d)&0xffffffff!=c:
+		return 1
+	f.write(d)
+`
+
+// putBatchSize is roughly how much code Put sends per raw REPL submission.
+// Each submission costs a round trip, so batching the chunks of w calls cuts
+// an 8 KB file from 32 submissions to 3 (uncompressed). BenchmarkBatching,
+// with 10ms per submission, puts the file in 1.05s instead of 1.51s over a
+// simulated 115200 baud UART, where the bytes on the wire dominate, and in
+// 0.15s instead of 0.49s over a simulated 1 Mbit/s native USB port.
+const putBatchSize = 4096
+
+// putChunkArgs returns the arguments of the w call writing chunk b,
+// compressed when that makes it smaller.
+func putChunkArgs(b []byte, compress bool) string {
+	crc := strconv.FormatUint(uint64(crc32.ChecksumIEEE(b)), 10)
+	if compress {
+		z := deflateChunk(b)
+		if len(z) < len(b) {
+			return "(" + crc + ",\"" + base64.StdEncoding.EncodeToString(z) + "\",1),"
+		}
+	}
+	return "(" + crc + ",\"" + base64.StdEncoding.EncodeToString(b) + "\"),"
+}
+
+// putBatchCode returns the device code calling w with each of args in turn.
+// It prints a dot per chunk written and stops at the first corrupted one.
+func putBatchCode(args []string) []byte {
+	return []byte("for a in (\n" + strings.Join(args, "\n") + "\n):\n\tif w(*a):\n\t\tbreak\n\tprint('.',end='')\n")
+}
+
+// putBatch writes chunks, the first of which starts at byte offset off of
+// the source, in one submission. When one arrives corrupted it and the
+// chunks after it are resent, up to Retries times.
+func (r *Repl) putBatch(off int64, chunks [][]byte, compress bool) error {
+	args := make([]string, len(chunks))
+	for i, b := range chunks {
+		args[i] = putChunkArgs(b, compress)
+	}
+	tries := 0
+	for {
+		var out bytes.Buffer
+		_, err := r.Exec(putBatchCode(args), &out)
+		if err != nil {
+			return err
+		}
+		n := strings.Count(out.String(), ".")
+		if n >= len(args) {
+			return nil
+		}
+		if n > 0 {
+			tries = 0
+		}
+		for _, b := range chunks[:n] {
+			off += int64(len(b))
+		}
+		chunks, args = chunks[n:], args[n:]
+		tries++
+		if tries > r.Retries {
+			return fmt.Errorf("chunk at byte offset %d was corrupted %d times", off, tries)
+		}
+	}
+}
+
+// getChunkDefs defines g, which prints the length, CRC32 (-1 without
+// _crc) and base64 data of the n bytes of the file f at offset o. The data
+// gets a z prefix when deflated and an r prefix when not.
+const getChunkDefs = `from ubinascii import b2a_base64
+` + crcCode + `def g(o,n,z=0):
+	f.seek(o)
+	d=f.read(n)
+	p=d
+	if z and d:
+		b=io.BytesIO()
+		c=deflate.DeflateIO(b,deflate.RAW,10)
+		c.write(d)
+		c.close()
+		if len(b.getvalue())<len(d):
+			p=b.getvalue()
+		else:
+			z=0
+	print(len(d),_crc(d)&0xffffffff if _crc else -1,('z' if z else 'r')+str(b2a_base64(p),'ascii').strip(),end='')
+`
+
+// getBatchChunks is how many chunks Get asks for per raw REPL submission. It
+// gets an 8 KB file in 3 submissions instead of 33, which BenchmarkBatching
+// times at 1.06s instead of 1.54s over the simulated UART and 0.15s instead
+// of 0.51s over the simulated USB port.
+const getBatchChunks = 16
+
+// getBatch reads up to count chunks of n bytes of the file opened by Get,
+// starting at byte offset off, in one submission. It returns their data and
+// whether the end of the file was reached. When a chunk arrives corrupted it
+// and the chunks after it are read again, up to Retries times.
+func (r *Repl) getBatch(off int64, n, count int, compress bool) ([]byte, bool, error) {
+	z := ""
+	if compress {
+		z = ",1"
+	}
+	var data []byte
+	tries := 0
+	for {
+		code := "for o in range(" + strconv.FormatInt(off, 10) + "," + strconv.FormatInt(off+int64(count*n), 10) + "," + strconv.Itoa(n) + "):\n\tg(o," + strconv.Itoa(n) + z + ")\n\tprint()\n"
+		var out bytes.Buffer
+		_, err := r.Exec([]byte(code), &out)
+		if err != nil {
+			return data, false, err
+		}
+		lines := strings.Split(strings.TrimRight(out.String(), "\r\n"), "\n")
+		got := 0
+		var bad error
+		for _, line := range lines {
+			x, err := parseGetChunk(line)
+			if err != nil {
+				bad = err
+				break
+			}
+			data = append(data, x...)
+			got++
+			if len(x) < n {
+				return data, true, nil
+			}
+		}
+		if got == count {
+			return data, false, nil
+		}
+		if bad == nil {
+			bad = fmt.Errorf("got %d of %d chunks", got, count)
+		}
+		if got > 0 {
+			tries = 0
+		}
+		off += int64(got * n)
+		count -= got
+		tries++
+		if tries > r.Retries {
+			return data, false, fmt.Errorf("chunk at byte offset %d failed %d times: %v", off, tries, bad)
+		}
+	}
+}
+
+// parseGetChunk decodes and checks a chunk printed by g.
+func parseGetChunk(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 || fields[2] == "" {
+		return nil, fmt.Errorf("malformed chunk %q", s)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed chunk length %q", fields[0])
+	}
+	crc, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed chunk CRC %q", fields[1])
+	}
+	x, err := base64.StdEncoding.DecodeString(fields[2][1:])
+	if err != nil {
+		return nil, err
+	}
+	if fields[2][0] == 'z' {
+		x, err = inflateChunk(x)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(x) != n {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(x), n)
+	}
+	if crc >= 0 && uint32(crc) != crc32.ChecksumIEEE(x) {
+		return nil, fmt.Errorf("CRC mismatch")
+	}
+	return x, nil
+}
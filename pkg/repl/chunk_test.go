@@ -0,0 +1,190 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkDevice simulates the device side of putBatch and getBatch over a
+// serial link: every submission costs latency, for the USB round trip and
+// the compiling of the code, and every byte either way 10 bits at baud.
+// With baud zero nothing is slowed down.
+type chunkDevice struct {
+	// file is what getBatch reads and putBatch appends to
+	file []byte
+	// submissions counts the code submitted
+	submissions int
+	latency     time.Duration
+	baud        int
+	code        []byte
+}
+
+var getRangePattern = regexp.MustCompile(`range\((\d+),(\d+),(\d+)\)`)
+
+func (d *chunkDevice) reply(b []byte) []byte {
+	d.code = append(d.code, b...)
+	if !bytes.HasSuffix(d.code, []byte{0x04}) {
+		return nil
+	}
+	code := string(d.code)
+	d.code = nil
+	d.submissions++
+	var out strings.Builder
+	if m := getRangePattern.FindStringSubmatch(code); m != nil {
+		start, _ := strconv.Atoi(m[1])
+		end, _ := strconv.Atoi(m[2])
+		n, _ := strconv.Atoi(m[3])
+		for o := start; o < end; o += n {
+			c := d.file[minInt(o, len(d.file)):minInt(o+n, len(d.file))]
+			fmt.Fprintf(&out, "%d %d r%s\r\n", len(c), crc32.ChecksumIEEE(c), base64.StdEncoding.EncodeToString(c))
+		}
+	}
+	for _, line := range strings.Split(code, "\n") {
+		if !strings.HasPrefix(line, "(") {
+			continue
+		}
+		args := strings.Split(strings.Trim(line, "(),"), ",")
+		c, _ := base64.StdEncoding.DecodeString(strings.Trim(args[1], `"`))
+		d.file = append(d.file, c...)
+		out.WriteString(".")
+	}
+	resp := []byte("OK" + out.String() + "\x04\x04>")
+	if d.baud > 0 {
+		wire := time.Duration(len(code)+len(resp)) * 10 * time.Second / time.Duration(d.baud)
+		time.Sleep(d.latency + wire)
+	}
+	return resp
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// testFile returns n bytes that don't compress.
+func testFile(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// putChunks writes data in chunks of size, perBatch chunks per putBatch.
+func putChunks(r *Repl, data []byte, size, perBatch int) error {
+	var batch [][]byte
+	off := int64(0)
+	for len(data) > 0 {
+		n := minInt(size, len(data))
+		batch = append(batch, data[:n])
+		data = data[n:]
+		if len(batch) == perBatch || len(data) == 0 {
+			err := r.putBatch(off, batch, false)
+			if err != nil {
+				return err
+			}
+			for _, b := range batch {
+				off += int64(len(b))
+			}
+			batch = nil
+		}
+	}
+	return nil
+}
+
+// getChunks reads the whole file in chunks of size, perBatch per getBatch.
+func getChunks(r *Repl, size, perBatch int) ([]byte, error) {
+	var data []byte
+	for {
+		x, eof, err := r.getBatch(int64(len(data)), size, perBatch, false)
+		data = append(data, x...)
+		if err != nil || eof {
+			return data, err
+		}
+	}
+}
+
+// putPerBatch is how many chunks Put packs into a batch, see PutWithOptions.
+func putPerBatch(size int) int {
+	return putBatchSize / (size*4/3 + 24)
+}
+
+func TestBatchSubmissions(t *testing.T) {
+	file := testFile(8 * 1024)
+	d := &chunkDevice{}
+	p := newFakePort()
+	p.reply = d.reply
+	r := &Repl{Port: p}
+	err := putChunks(r, file, 256, putPerBatch(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.file, file) {
+		t.Fatal("put corrupted the file")
+	}
+	if d.submissions > 3 {
+		t.Errorf("put took %d submissions", d.submissions)
+	}
+	d.submissions = 0
+	got, err := getChunks(r, 256, getBatchChunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Fatal("get corrupted the file")
+	}
+	if d.submissions > 3 {
+		t.Errorf("get took %d submissions", d.submissions)
+	}
+}
+
+// BenchmarkBatching compares one chunk per submission with the batches of
+// Put and Get for an 8 KB file, over a simulated UART at 115200 baud and a
+// simulated native USB port at about 1 Mbit/s, both with 10ms per
+// submission.
+func BenchmarkBatching(b *testing.B) {
+	file := testFile(8 * 1024)
+	for _, bc := range []struct {
+		name     string
+		baud     int
+		put      bool
+		perBatch int
+	}{
+		{"uart/put/single", 115200, true, 1},
+		{"uart/put/batched", 115200, true, putPerBatch(256)},
+		{"uart/get/single", 115200, false, 1},
+		{"uart/get/batched", 115200, false, getBatchChunks},
+		{"usb/put/single", 1000000, true, 1},
+		{"usb/put/batched", 1000000, true, putPerBatch(256)},
+		{"usb/get/single", 1000000, false, 1},
+		{"usb/get/batched", 1000000, false, getBatchChunks},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			d := &chunkDevice{file: file, latency: time.Millisecond * 10, baud: bc.baud}
+			p := newFakePort()
+			p.reply = d.reply
+			r := &Repl{Port: p}
+			for i := 0; i < b.N; i++ {
+				var err error
+				if bc.put {
+					d.file = nil
+					err = putChunks(r, file, 256, bc.perBatch)
+				} else {
+					_, err = getChunks(r, 256, bc.perBatch)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(d.submissions)/float64(b.N), "submissions/op")
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package repl
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+)
+
+// Transfers are compressed in independent raw deflate chunks of at most
+// compressChunkSize bytes so the device can use a window of 2^compressWbits.
+const (
+	compressChunkSize = 1024
+	compressWbits     = 10
+)
+
+// compressProbeCode prints the module the device can decompress with and
+// whether it can also compress.
+const compressProbeCode = `try:
+	import deflate, io
+	print('deflate', end='')
+	try:
+		deflate.DeflateIO(io.BytesIO(), deflate.RAW, 10).write(b'x')
+		print(' compress', end='')
+	except Exception:
+		pass
+except ImportError:
+	try:
+		import uzlib
+		print('uzlib', end='')
+	except ImportError:
+		pass
+`
+
+// compressCaps describes the compression support of the device.
+type compressCaps struct {
+	// decompress is the device code that defines _dz, a function inflating
+	// a raw deflate chunk. Empty when the device can't decompress.
+	decompress string
+	// compress is set when the device can deflate data for Get.
+	compress bool
+}
+
+// compression probes the device for a deflate implementation the first time
+// it's called. Nothing is used when NoCompress is set or the probe fails.
+func (r *Repl) compression() compressCaps {
+	if r.NoCompress {
+		return compressCaps{}
+	}
+	r.compressOnce.Do(func() {
+		b := &strings.Builder{}
+		_, err := r.Exec([]byte(compressProbeCode), b)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(b.String())
+		if len(fields) == 0 {
+			return
+		}
+		switch fields[0] {
+		case "deflate":
+			r.compressCaps.decompress = "import deflate, io\n" +
+				"_dz=lambda d:deflate.DeflateIO(io.BytesIO(d),deflate.RAW,10).read()\n"
+			r.compressCaps.compress = len(fields) > 1
+		case "uzlib":
+			r.compressCaps.decompress = "import uzlib\n" +
+				"_dz=lambda d:uzlib.decompress(d,-10)\n"
+		}
+	})
+	return r.compressCaps
+}
+
+// deflateChunk compresses b as a raw deflate stream.
+func deflateChunk(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+// inflateChunk decompresses a raw deflate stream.
+func inflateChunk(b []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+}
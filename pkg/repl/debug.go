@@ -0,0 +1,70 @@
+package repl
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugPort is a Port that dumps everything written to and read from the
+// underlying Port to *w, as long as it's not nil. ConnectWithOptions only
+// puts it in front of the port when ConnectOptions.Debug is set, so there's
+// no cost otherwise.
+type debugPort struct {
+	Port
+	w     *io.Writer
+	start time.Time
+	mu    sync.Mutex
+}
+
+func (p *debugPort) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	if n > 0 || err != nil {
+		p.log("<", b[:n], err)
+	}
+	return n, err
+}
+
+func (p *debugPort) Write(b []byte) (int, error) {
+	n, err := p.Port.Write(b)
+	p.log(">", b[:n], err)
+	return n, err
+}
+
+// ResetInputBuffer passes the call on when the underlying Port supports it.
+func (p *debugPort) ResetInputBuffer() error {
+	if ir, ok := p.Port.(inputResetter); ok {
+		p.log("-", nil, nil)
+		return ir.ResetInputBuffer()
+	}
+	return nil
+}
+
+// log writes b as hex and ASCII, each line preceded by the seconds since
+// the port was opened and dir: > for writes, < for reads and - for a reset
+// of the input buffer.
+func (p *debugPort) log(dir string, b []byte, err error) {
+	w := *p.w
+	if w == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := time.Since(p.start).Seconds()
+	if dir == "-" {
+		fmt.Fprintf(w, "%10.6f - reset input buffer\n", t)
+		return
+	}
+	if len(b) > 0 {
+		dump := strings.TrimSuffix(hex.Dump(b), "\n")
+		for _, line := range strings.Split(dump, "\n") {
+			fmt.Fprintf(w, "%10.6f %s %s\n", t, dir, line)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%10.6f %s error: %v\n", t, dir, err)
+	}
+}
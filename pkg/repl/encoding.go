@@ -0,0 +1,165 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error policies for bytes that aren't valid in the encoding of a
+// CatWithOptions, named like Python's.
+const (
+	DecodeReplace = "replace"
+	DecodeIgnore  = "ignore"
+	DecodeStrict  = "strict"
+)
+
+// CatOptions configures CatWithOptions.
+type CatOptions struct {
+	// Encoding is the text encoding of the file: utf-8, latin-1 or ascii.
+	// The file is decoded on the host and written to w as UTF-8. Empty
+	// writes the bytes unchanged.
+	Encoding string
+	// Errors is what happens to bytes that aren't valid in Encoding:
+	// DecodeReplace (the default) writes U+FFFD instead, DecodeIgnore drops
+	// them and DecodeStrict fails.
+	Errors string
+}
+
+// Validate reports an unsupported encoding or error policy so it can be
+// rejected before touching the device.
+func (o CatOptions) Validate() error {
+	if o.Encoding == "" {
+		return nil
+	}
+	_, err := newDecodeWriter(nil, o.Encoding, o.Errors)
+	return err
+}
+
+// CatWithOptions is Cat configured by opts. The file is still sent as is,
+// so the device never has to decode it.
+func (r *Repl) CatWithOptions(w io.Writer, f string, opts CatOptions) error {
+	if opts.Encoding == "" {
+		return r.Cat(w, f)
+	}
+	dw, err := newDecodeWriter(w, opts.Encoding, opts.Errors)
+	if err != nil {
+		return err
+	}
+	err = r.Cat(dw, f)
+	if err != nil {
+		return err
+	}
+	return dw.Flush()
+}
+
+// decodeWriter writes what's written to it to w as UTF-8, decoded from enc.
+type decodeWriter struct {
+	w      io.Writer
+	enc    string
+	errors string
+	// off is how many bytes were decoded so far, for error messages
+	off int64
+	// partial is the start of a UTF-8 sequence split across writes
+	partial []byte
+}
+
+func newDecodeWriter(w io.Writer, enc, errors string) (*decodeWriter, error) {
+	name := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(enc))
+	switch name {
+	case "utf8":
+		name = "utf-8"
+	case "latin1", "iso88591":
+		name = "latin-1"
+	case "ascii", "usascii":
+		name = "ascii"
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q (expected utf-8, latin-1 or ascii)", enc)
+	}
+	switch errors {
+	case "":
+		errors = DecodeReplace
+	case DecodeReplace, DecodeIgnore, DecodeStrict:
+	default:
+		return nil, fmt.Errorf("invalid error policy %q (expected replace, ignore or strict)", errors)
+	}
+	return &decodeWriter{w: w, enc: name, errors: errors}, nil
+}
+
+func (d *decodeWriter) Write(p []byte) (int, error) {
+	b := append(d.partial, p...)
+	d.partial = nil
+	out := make([]byte, 0, len(b)+8)
+	for len(b) > 0 {
+		var err error
+		switch d.enc {
+		case "utf-8":
+			r, size := utf8.DecodeRune(b)
+			if r == utf8.RuneError && size <= 1 {
+				if !utf8.FullRune(b) {
+					// the rest of the sequence comes with the next write
+					d.partial = append([]byte{}, b...)
+					b = nil
+					continue
+				}
+				out, err = d.invalid(out, b[0])
+				size = 1
+			} else {
+				out = append(out, b[:size]...)
+			}
+			b = b[size:]
+			d.off += int64(size)
+		case "latin-1":
+			out = append(out, string(rune(b[0]))...)
+			b = b[1:]
+			d.off++
+		case "ascii":
+			if b[0] < utf8.RuneSelf {
+				out = append(out, b[0])
+			} else {
+				out, err = d.invalid(out, b[0])
+			}
+			b = b[1:]
+			d.off++
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := d.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush handles a UTF-8 sequence cut short by the end of the file.
+func (d *decodeWriter) Flush() error {
+	var out []byte
+	for _, c := range d.partial {
+		var err error
+		out, err = d.invalid(out, c)
+		if err != nil {
+			return err
+		}
+		d.off++
+	}
+	d.partial = nil
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := d.w.Write(out)
+	return err
+}
+
+// invalid applies the error policy to the byte c at the current offset.
+func (d *decodeWriter) invalid(out []byte, c byte) ([]byte, error) {
+	switch d.errors {
+	case DecodeIgnore:
+		return out, nil
+	case DecodeStrict:
+		return out, fmt.Errorf("can't decode byte 0x%02x at offset %d as %s", c, d.off, d.enc)
+	}
+	return append(out, string(utf8.RuneError)...), nil
+}
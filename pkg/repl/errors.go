@@ -0,0 +1,239 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.bug.st/serial"
+)
+
+// errno values used by MicroPython
+const (
+	errnoENOENT  = 2
+	errnoEIO     = 5
+	errnoEEXIST  = 17
+	errnoENOTDIR = 20
+	errnoENOSPC  = 28
+)
+
+// ErrNoSpace matches (with errors.Is) the error raised when the device
+// filesystem is full.
+var ErrNoSpace = errors.New("no space left on device")
+
+// ErrExist matches (with errors.Is) the error raised when a file or
+// directory already exists.
+var ErrExist = errors.New("file exists")
+
+// ErrNotExist matches (with errors.Is) the error raised when a file or
+// directory doesn't exist.
+var ErrNotExist = errors.New("no such file or directory")
+
+// MicroPythonError is an exception raised by code running on the device.
+type MicroPythonError struct {
+	// Type is the exception class, like OSError.
+	Type string
+	// Message is the text following the exception class.
+	Message string
+	// Errno is the error number of an OSError, zero otherwise.
+	Errno int
+	// Traceback is the full traceback as printed by the device.
+	Traceback string
+}
+
+// Error returns the traceback as printed by the device.
+func (e *MicroPythonError) Error() string {
+	return e.Traceback
+}
+
+// Is reports whether e is one of the errors exported by this package.
+func (e *MicroPythonError) Is(target error) bool {
+	switch target {
+	case ErrNoSpace:
+		return e.Errno == errnoENOSPC
+	case ErrExist:
+		return e.Errno == errnoEEXIST
+	case ErrNotExist:
+		return e.Errno == errnoENOENT
+	}
+	return false
+}
+
+// NotMicroPythonError is returned by EnterRawMode when the device answers,
+// but not the way MicroPython does. It's usually another kind of device on
+// the port, like a GPS module or a modem.
+type NotMicroPythonError struct {
+	// Received is the start of what the device sent.
+	Received []byte
+}
+
+// receivedSnippet is how much of Received the message shows.
+const receivedSnippet = 64
+
+func (e *NotMicroPythonError) Error() string {
+	b := e.Received
+	more := ""
+	if len(b) > receivedSnippet {
+		b = b[:receivedSnippet]
+		more = "..."
+	}
+	q := strconv.Quote(string(b))
+	return "device did not enter raw REPL, is it running MicroPython? received: " + q[1:len(q)-1] + more
+}
+
+// ExitCodeError is returned when code on the device calls sys.exit, so the
+// exit status can be passed on.
+type ExitCodeError struct {
+	// Code is the status given to sys.exit: 0 for none and 1 for a value
+	// that isn't an integer, as in CPython.
+	Code int
+	// Exception is the SystemExit raised by the device.
+	Exception *MicroPythonError
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Unwrap returns the SystemExit raised by the device.
+func (e *ExitCodeError) Unwrap() error {
+	return e.Exception
+}
+
+// exceptionError returns the error for an exception raised on the device,
+// an ExitCodeError for SystemExit and e itself otherwise.
+func exceptionError(e *MicroPythonError) error {
+	if e.Type != "SystemExit" {
+		return e
+	}
+	code := 0
+	if e.Message != "" {
+		n, err := strconv.Atoi(e.Message)
+		if err != nil {
+			n = 1
+		}
+		code = n
+	}
+	return &ExitCodeError{Code: code, Exception: e}
+}
+
+// errnoPattern matches the message of an OSError: "[Errno 28] ENOSPC" or "28"
+var errnoPattern = regexp.MustCompile(`^(?:\[Errno (\d+)\]|(\d+)$)`)
+
+// parseException parses the traceback printed by the device. It returns nil
+// when tb is empty.
+func parseException(tb []byte) *MicroPythonError {
+	s := strings.TrimSpace(strings.Replace(string(tb), "\r\n", "\n", -1))
+	if s == "" {
+		return nil
+	}
+	e := &MicroPythonError{
+		Traceback: string(tb),
+	}
+	lines := strings.Split(s, "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if i := strings.Index(last, ":"); i >= 0 {
+		e.Type = last[:i]
+		e.Message = strings.TrimSpace(last[i+1:])
+	} else {
+		e.Type = last
+	}
+	if e.Type == "OSError" {
+		m := errnoPattern.FindStringSubmatch(e.Message)
+		if m != nil {
+			e.Errno, _ = strconv.Atoi(m[1] + m[2])
+		}
+	}
+	return e
+}
+
+// ErrPortBusy matches (with errors.Is) the error returned by Connect when
+// another program has the serial port open.
+var ErrPortBusy = errors.New("serial port is busy")
+
+// ErrPortPermission matches (with errors.Is) the error returned by Connect
+// when the user isn't allowed to open the serial port.
+var ErrPortPermission = errors.New("permission denied on serial port")
+
+// PortOpenError is returned by Connect when the serial port can't be opened
+// because it's busy or not accessible. Its message says how to fix that.
+type PortOpenError struct {
+	// Device is the name of the serial port.
+	Device string
+	// Err is ErrPortBusy or ErrPortPermission.
+	Err error
+	// Holders lists the processes that have the port open, like
+	// "screen (pid 1234)", when they can be found.
+	Holders []string
+	// Group is the group owning the port, like dialout, when known.
+	Group string
+}
+
+// Error describes the problem along with a hint to solve it.
+func (e *PortOpenError) Error() string {
+	if e.Err == ErrPortPermission {
+		msg := "permission denied opening " + e.Device
+		if e.Group != "" {
+			msg += fmt.Sprintf(", add your user to the %s group with 'sudo usermod -aG %s $USER' and log in again", e.Group, e.Group)
+		}
+		return msg
+	}
+	msg := e.Device + " is busy"
+	if len(e.Holders) > 0 {
+		msg += ", it's open in " + strings.Join(e.Holders, ", ")
+	} else {
+		msg += ", close other programs using it (another zap, screen, an IDE or ModemManager)"
+	}
+	return msg
+}
+
+// Unwrap returns ErrPortBusy or ErrPortPermission.
+func (e *PortOpenError) Unwrap() error {
+	return e.Err
+}
+
+// portOpenError converts the error from opening device to a PortOpenError
+// when it's busy or not accessible and returns other errors unchanged.
+func portOpenError(device string, err error) error {
+	var pe *serial.PortError
+	if !errors.As(err, &pe) {
+		return err
+	}
+	switch pe.Code() {
+	case serial.PortBusy:
+		return &PortOpenError{
+			Device:  device,
+			Err:     ErrPortBusy,
+			Holders: portHolders(device),
+		}
+	case serial.PermissionDenied:
+		return &PortOpenError{
+			Device: device,
+			Err:    ErrPortPermission,
+			Group:  portGroup(device),
+		}
+	}
+	return err
+}
+
+// IsPortError reports whether err is a failure to read from or write to the
+// port after it was opened, like when the device is unplugged in the middle
+// of a command or the bridge hangs up. Errors of local files don't count.
+func IsPortError(err error) bool {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	var pe *serial.PortError
+	var ne *net.OpError
+	var errno syscall.Errno
+	return errors.Is(err, ErrDeviceReset) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &pe) ||
+		errors.As(err, &ne) || errors.As(err, &errno)
+}
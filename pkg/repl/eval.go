@@ -0,0 +1,219 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Eval evaluates the Python expression expr on the device and returns its
+// repr.
+func (r *Repl) Eval(expr string) (string, error) {
+	code := []byte("print(repr(" + expr + "), end='')")
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// evalCode executes the statements h and then t. When t is an expression
+// its value is printed the way the interactive prompt would.
+const evalCode = `def _zap_eval(h, t):
+    g = globals()
+    exec(h, g)
+    try:
+        v = eval(t, g)
+    except SyntaxError:
+        exec(t, g)
+        return
+    if v is not None:
+        print(repr(v))
+try:
+    _zap_eval(%s, %s)
+finally:
+    del _zap_eval
+`
+
+// EvalCode runs src like a line typed at the REPL: it is executed and, if
+// its final statement is an expression, the repr of the value is written to
+// w along with any other output. Cancelling ctx interrupts it.
+func (r *Repl) EvalCode(ctx context.Context, src string, w io.Writer) error {
+	head, tail := splitLastStatement(src)
+	code := fmt.Sprintf(evalCode, pyString(head), pyString(tail))
+	return r.execChunks(ctx, [][]byte{[]byte(code)}, w)
+}
+
+// splitLastStatement splits src before its final simple statement so that
+// statement can be tried as an expression. The whole of src is returned as
+// head when the final statement is inside a block or follows a compound
+// statement header on the same line.
+func splitLastStatement(src string) (head, tail string) {
+	lineStart := 0 // start of the last logical line
+	next := 0      // start of the logical line to come, -1 if none yet
+	cut := 0       // start of the last statement on the line
+	colon := false // the line has a top-level colon
+	depth := 0
+	quote := ""
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if quote == "" && next >= 0 && c != '#' && c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			lineStart, cut, colon, next = next, next, false, -1
+		}
+		switch {
+		case quote != "":
+			if c == '\\' {
+				i++
+			} else if strings.HasPrefix(src[i:], quote) {
+				i += len(quote) - 1
+				quote = ""
+			}
+		case c == '#':
+			for i+1 < len(src) && src[i+1] != '\n' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = src[i : i+1]
+			if strings.HasPrefix(src[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+				i += 2
+			}
+		case c == '\\':
+			i++
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			if depth > 0 {
+				depth--
+			}
+		case depth > 0:
+		case c == ':':
+			colon = true
+		case c == ';':
+			if !colon {
+				cut = i + 1
+			}
+		case c == '\n':
+			next = i + 1
+		}
+	}
+	if quote != "" || depth > 0 || lineStart < len(src) && (src[lineStart] == ' ' || src[lineStart] == '\t') {
+		return src, ""
+	}
+	return src[:cut], strings.TrimSpace(src[cut:])
+}
+
+// EvalInt evaluates expr and parses the result as an int.
+func (r *Repl) EvalInt(expr string) (int64, error) {
+	s, err := r.Eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an int: %s", expr, s)
+	}
+	return n, nil
+}
+
+// EvalBool evaluates expr and parses the result as a bool.
+func (r *Repl) EvalBool(expr string) (bool, error) {
+	s, err := r.Eval(expr)
+	if err != nil {
+		return false, err
+	}
+	switch s {
+	case "True":
+		return true, nil
+	case "False":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a bool: %s", expr, s)
+}
+
+// EvalStringList evaluates expr and parses the result as a list or tuple of
+// strings, such as the result of uos.listdir().
+func (r *Repl) EvalStringList(expr string) ([]string, error) {
+	s, err := r.Eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseStringList(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a list of strings: %v", expr, err)
+	}
+	return list, nil
+}
+
+// parseStringList parses the repr of a list or tuple of str.
+func parseStringList(s string) ([]string, error) {
+	if len(s) < 2 || !(s[0] == '[' && s[len(s)-1] == ']' || s[0] == '(' && s[len(s)-1] == ')') {
+		return nil, fmt.Errorf("not a list: %s", s)
+	}
+	list := []string{}
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	for rest != "" {
+		str, n, err := parseStringRepr(rest)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, str)
+		rest = strings.TrimSpace(rest[n:])
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("expected , at %q", rest)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	return list, nil
+}
+
+// parseStringRepr parses the repr of a str at the start of s and returns it
+// along with the number of bytes it used.
+func parseStringRepr(s string) (string, int, error) {
+	if s == "" || s[0] != '\'' && s[0] != '"' {
+		return "", 0, fmt.Errorf("expected a string at %q", s)
+	}
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == quote {
+			return b.String(), i + 1, nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", 0, fmt.Errorf("bad escape in %q", s)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", 0, fmt.Errorf("bad escape in %q", s)
+			}
+			b.WriteRune(rune(v))
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %q", s)
+}
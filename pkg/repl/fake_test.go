@@ -0,0 +1,128 @@
+package repl
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+)
+
+// fakePort is a Port that plays canned device output. Each read returns at
+// most chunk bytes of the next segment, or all of it when chunk is zero. An
+// empty segment is one read that returns nothing after pause, like a read
+// timing out. Once everything was read, reads return (0, err).
+type fakePort struct {
+	segments [][]byte
+	chunk    int
+	pause    time.Duration
+	err      error
+	// eofOnTimeout makes empty segments return io.EOF instead of nothing,
+	// like drivers that report a read that timed out that way.
+	eofOnTimeout bool
+	// reply, when set, is called with every write and its result is queued
+	// as device output.
+	reply   func(b []byte) []byte
+	written bytes.Buffer
+	// reads counts the calls to Read.
+	reads int
+}
+
+// newFakePort returns a fakePort that plays segments.
+func newFakePort(segments ...string) *fakePort {
+	p := &fakePort{}
+	p.queue(segments...)
+	return p
+}
+
+// queue adds segments to the output of p.
+func (p *fakePort) queue(segments ...string) {
+	for _, s := range segments {
+		p.segments = append(p.segments, []byte(s))
+	}
+}
+
+// rest returns the output that wasn't read yet.
+func (p *fakePort) rest() []byte {
+	return bytes.Join(p.segments, nil)
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	p.reads++
+	if len(p.segments) == 0 {
+		return 0, p.err
+	}
+	s := p.segments[0]
+	if len(s) == 0 {
+		time.Sleep(p.pause)
+		if p.eofOnTimeout {
+			p.segments = p.segments[1:]
+			return 0, io.EOF
+		}
+	}
+	n := len(s)
+	if p.chunk > 0 && n > p.chunk {
+		n = p.chunk
+	}
+	n = copy(b, s[:n])
+	if n == len(s) {
+		p.segments = p.segments[1:]
+	} else {
+		p.segments[0] = s[n:]
+	}
+	return n, nil
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.written.Write(b)
+	if p.reply != nil {
+		if out := p.reply(b); len(out) > 0 {
+			p.segments = append(p.segments, out)
+		}
+	}
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error                         { return nil }
+func (p *fakePort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *fakePort) SetDTR(dtr bool) error                { return nil }
+func (p *fakePort) SetRTS(rts bool) error                { return nil }
+func (p *fakePort) Break(d time.Duration) error          { return nil }
+
+// rawREPL returns a reply for fakePort that answers code ended with ctrl-D
+// the way the raw REPL does, with out as its output.
+func rawREPL(out string) func(b []byte) []byte {
+	return func(b []byte) []byte {
+		if bytes.HasSuffix(b, []byte{0x04}) {
+			return []byte("OK" + out + "\x04\x04>")
+		}
+		return nil
+	}
+}
+
+// enoent is the response of the raw REPL to code that raised OSError ENOENT.
+const enoent = "OK\x04Traceback (most recent call last):\r\n" +
+	"  File \"<stdin>\", line 5, in <module>\r\nOSError: [Errno 2] ENOENT\r\n\x04>"
+
+// statDevice returns a reply for fakePort from a device that answers the
+// code of Stat for the paths in dirs and files and runs everything else
+// without output.
+func statDevice(dirs, files map[string]bool) func(b []byte) []byte {
+	var code []byte
+	return func(b []byte) []byte {
+		code = append(code, b...)
+		if !bytes.HasSuffix(code, []byte{0x04}) {
+			return nil
+		}
+		defer func() { code = nil }()
+		m := regexp.MustCompile(`s = uos\.stat\("([^"]*)"\)`).FindSubmatch(code)
+		switch {
+		case m == nil:
+			return []byte("OK\x04\x04>")
+		case dirs[string(m[1])]:
+			return []byte("OK16384 0\x04\x04>")
+		case files[string(m[1])]:
+			return []byte("OK0 10\x04\x04>")
+		}
+		return []byte(enoent)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build linux
+// +build linux
+
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const rtsctsSupported = true
+
+// ttyBauds maps the baudrates a tty can be set to without termios2 to
+// their speed flags.
+var ttyBauds = map[int]uint32{
+	1200:    unix.B1200,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	3000000: unix.B3000000,
+	4000000: unix.B4000000,
+}
+
+// ttyPort is a Port on a tty opened and configured directly, used for RTS/CTS
+// flow control, which the serial package has no way to set.
+type ttyPort struct {
+	fd          int
+	readTimeout time.Duration
+}
+
+// openRTSCTS opens device as a raw tty with the settings of opts and
+// hardware flow control, holding it exclusively like the serial package
+// does.
+func openRTSCTS(device string, opts ConnectOptions) (Port, error) {
+	speed, ok := ttyBauds[opts.Baud]
+	if !ok {
+		return nil, fmt.Errorf("baudrate %d isn't supported with RTS/CTS flow control", opts.Baud)
+	}
+	fd, err := unix.Open(device, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, ttyOpenError(device, err)
+	}
+	p := &ttyPort{fd: fd, readTimeout: opts.ReadTimeout}
+	err = p.configure(speed, opts)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("%s: %v", device, err)
+	}
+	return p, nil
+}
+
+// ttyOpenError converts the error from opening device to a PortOpenError
+// when it's busy or not accessible, like portOpenError.
+func ttyOpenError(device string, err error) error {
+	switch {
+	case errors.Is(err, unix.EBUSY):
+		return &PortOpenError{Device: device, Err: ErrPortBusy, Holders: portHolders(device)}
+	case errors.Is(err, unix.EACCES):
+		return &PortOpenError{Device: device, Err: ErrPortPermission, Group: portGroup(device)}
+	}
+	return fmt.Errorf("%s: %v", device, err)
+}
+
+// configure puts the tty in raw mode at speed with the framing of opts and
+// RTS/CTS flow control. Reads block from then on, Read waits with poll.
+func (p *ttyPort) configure(speed uint32, opts ConnectOptions) error {
+	err := unix.IoctlSetInt(p.fd, unix.TIOCEXCL, 0)
+	if err != nil {
+		return err
+	}
+	t, err := unix.IoctlGetTermios(p.fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR |
+		unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY | unix.INPCK
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CMSPAR | unix.CSTOPB | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | unix.CRTSCTS | speed
+	switch opts.Parity {
+	case ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+	case ParityEven:
+		t.Cflag |= unix.PARENB
+	}
+	if opts.StopBits == Stop2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(p.fd, unix.TCSETS, t)
+	if err != nil {
+		return err
+	}
+	return unix.SetNonblock(p.fd, false)
+}
+
+// Read returns zero bytes without an error when nothing arrives within the
+// read timeout, like the serial package.
+func (p *ttyPort) Read(b []byte) (int, error) {
+	timeout := -1
+	if p.readTimeout > 0 {
+		timeout = int(p.readTimeout / time.Millisecond)
+	}
+	fds := []unix.PollFd{{Fd: int32(p.fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		break
+	}
+	if fds[0].Revents&unix.POLLIN == 0 {
+		// hung up, the device is gone
+		return 0, io.EOF
+	}
+	for {
+		n, err := unix.Read(p.fd, b)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (p *ttyPort) Write(b []byte) (int, error) {
+	n, err := unix.Write(p.fd, b)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (p *ttyPort) Close() error {
+	return unix.Close(p.fd)
+}
+
+func (p *ttyPort) SetReadTimeout(t time.Duration) error {
+	p.readTimeout = t
+	return nil
+}
+
+// setModemBit sets or clears bit of the modem control lines.
+func (p *ttyPort) setModemBit(bit int, on bool) error {
+	req := uint(unix.TIOCMBIC)
+	if on {
+		req = unix.TIOCMBIS
+	}
+	return unix.IoctlSetPointerInt(p.fd, req, bit)
+}
+
+func (p *ttyPort) SetDTR(dtr bool) error {
+	return p.setModemBit(unix.TIOCM_DTR, dtr)
+}
+
+func (p *ttyPort) SetRTS(rts bool) error {
+	return p.setModemBit(unix.TIOCM_RTS, rts)
+}
+
+func (p *ttyPort) Break(d time.Duration) error {
+	err := unix.IoctlSetInt(p.fd, unix.TIOCSBRK, 0)
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return unix.IoctlSetInt(p.fd, unix.TIOCCBRK, 0)
+}
@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package repl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master side of a new pseudo terminal and the device
+// name of its other side.
+func openPTY(t *testing.T) (int, string) {
+	m, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals:", err)
+	}
+	t.Cleanup(func() { unix.Close(m) })
+	err = unix.IoctlSetPointerInt(m, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(m, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestOpenRTSCTS(t *testing.T) {
+	m, device := openPTY(t)
+	p, err := openRTSCTS(device, ConnectOptions{Baud: 115200, ReadTimeout: time.Millisecond * 100, Parity: ParityEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	tt, err := unix.IoctlGetTermios(p.(*ttyPort).fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a pseudo terminal has no parity to keep
+	if tt.Cflag&unix.CRTSCTS == 0 || tt.Lflag&unix.ICANON != 0 {
+		t.Fatalf("cflag %#x, lflag %#x", tt.Cflag, tt.Lflag)
+	}
+	// nothing to read times out
+	b := make([]byte, 16)
+	start := time.Now()
+	n, err := p.Read(b)
+	if n != 0 || err != nil || time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("got %d, %v after %v", n, err, time.Since(start))
+	}
+	unix.Write(m, []byte(">>> "))
+	n, err = p.Read(b)
+	if err != nil || string(b[:n]) != ">>> " {
+		t.Fatalf("got %q, %v", b[:n], err)
+	}
+	_, err = p.Write([]byte("\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = unix.Read(m, b)
+	if err != nil || string(b[:n]) != "\x01" {
+		t.Fatalf("device got %q, %v", b[:n], err)
+	}
+	// held exclusively
+	_, err = openRTSCTS(device, ConnectOptions{Baud: 115200})
+	if err == nil && unix.Geteuid() != 0 {
+		t.Fatal("opened the port twice")
+	}
+}
+
+func TestOpenRTSCTSBaud(t *testing.T) {
+	_, err := openRTSCTS("/dev/null", ConnectOptions{Baud: 123456})
+	if err == nil {
+		t.Fatal("odd baudrate accepted")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package repl
+
+import "errors"
+
+const rtsctsSupported = false
+
+func openRTSCTS(device string, opts ConnectOptions) (Port, error) {
+	return nil, errors.New("RTS/CTS flow control is not supported on this platform")
+}
@@ -0,0 +1,92 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// formatCode detects the port from sys.platform, recreates the filesystem on
+// its flash block device, remounts it, checks it with statvfs and prints
+// where it's mounted.
+const formatCode = osImport + `import sys
+_p = sys.platform
+if _p == 'esp32':
+	import esp32
+	_bdev = esp32.Partition.find(esp32.Partition.TYPE_DATA, label='vfs')[0]
+	_mp = '/'
+elif _p == 'esp8266':
+	from flashbdev import bdev as _bdev
+	_mp = '/'
+elif _p == 'rp2':
+	import rp2
+	_bdev = rp2.Flash()
+	_mp = '/'
+elif _p == 'pyboard':
+	import pyb
+	_bdev = pyb.Flash(start=0)
+	_mp = '/flash'
+else:
+	raise OSError('format is not supported on ' + _p)
+_fs = FSTYPE
+if _fs is None:
+	_fs = uos.VfsFat if _p == 'pyboard' else uos.VfsLfs2
+uos.chdir('/')
+try:
+	uos.umount(_mp)
+except OSError:
+	pass
+_fs.mkfs(_bdev)
+uos.mount(_fs(_bdev), _mp)
+uos.chdir(_mp)
+uos.statvfs(_mp)
+print(_mp, end='')
+del _p, _bdev, _mp, _fs
+`
+
+var fsTypes = map[string]string{
+	"":     "None",
+	"fat":  "uos.VfsFat",
+	"lfs1": "uos.VfsLfs1",
+	"lfs2": "uos.VfsLfs2",
+}
+
+// remountTimeout is how long FormatFS waits for the new filesystem to be
+// listable.
+const remountTimeout = time.Second * 5
+
+// Format erases the device filesystem and recreates it as the usual
+// filesystem for the port, see FormatFS.
+func (r *Repl) Format() error {
+	return r.FormatFS("")
+}
+
+// FormatFS erases the device filesystem by recreating it as fstype (fat, lfs1
+// or lfs2). An empty fstype picks the usual filesystem for the port. The new
+// filesystem is mounted and FormatFS only returns once its mount point, like
+// /flash on a pyboard, can be listed.
+func (r *Repl) FormatFS(fstype string) error {
+	fs, ok := fsTypes[strings.ToLower(fstype)]
+	if !ok {
+		return fmt.Errorf("unknown filesystem type %q (expected fat, lfs1 or lfs2)", fstype)
+	}
+	code := strings.Replace(formatCode, "FSTYPE", fs, 1)
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
+	if err != nil {
+		return err
+	}
+	mp := b.String()
+	deadline := time.Now().Add(remountTimeout)
+	for {
+		_, err = r.Exec([]byte(osImport+"uos.listdir("+pyString(mp)+")"), nil)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err != nil {
+		return fmt.Errorf("filesystem not mounted after format: %w", err)
+	}
+	return nil
+}
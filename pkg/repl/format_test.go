@@ -0,0 +1,36 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormatListsMountPoint(t *testing.T) {
+	// a pyboard mounts its flash at /flash, the root is a virtual directory
+	var listed []string
+	var code []byte
+	p := newFakePort()
+	p.reply = func(b []byte) []byte {
+		code = append(code, b...)
+		if !bytes.HasSuffix(code, []byte{0x04}) {
+			return nil
+		}
+		defer func() { code = nil }()
+		if bytes.Contains(code, []byte("_fs.mkfs(_bdev)")) {
+			return []byte("OK/flash\x04\x04>")
+		}
+		if i := bytes.Index(code, []byte("uos.listdir(")); i >= 0 {
+			listed = append(listed, string(code[i:bytes.IndexByte(code[i:], ')')+i+1]))
+		}
+		return []byte("OK\x04\x04>")
+	}
+	r := &Repl{Port: p}
+	err := r.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, ",") != `uos.listdir("/flash")` {
+		t.Fatalf("listed %q", listed)
+	}
+}
@@ -0,0 +1,145 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// helperVersion is bumped whenever helperCode changes so a stale helper left
+// in RAM by another zap version is replaced.
+const helperVersion = "3"
+
+// helperCode defines _zap, a class of functions the other operations call
+// instead of sending the same code every time. It lives in the globals of
+// the REPL only, nothing is written to the filesystem. get and put work on
+// the global f opened by Get and Put, like g and w do.
+const helperCode = osImport + `import ubinascii
+class _zap:
+	V = ` + helperVersion + `
+	crc = getattr(ubinascii, 'crc32', None)
+	@staticmethod
+	def stat(p, i):
+		print(uos.stat(p)[i], end='')
+	@staticmethod
+	def sizes(ps):
+		for p in ps:
+			print(uos.stat(p)[6])
+	@staticmethod
+	def walk(d):
+		for e in uos.ilistdir(d):
+			p = (d if d.endswith('/') else d + '/') + e[0]
+			if e[1] & 0x4000:
+				print('d\t0\t' + p)
+				_zap.walk(p)
+			else:
+				print('f\t%d\t%s' % (uos.stat(p)[6], p))
+	@staticmethod
+	def hash(p):
+		try:
+			import uhashlib
+		except ImportError:
+			import hashlib as uhashlib
+		h = uhashlib.sha256()
+		with open(p, 'rb') as f:
+			while True:
+				b = f.read(256)
+				if not b:
+					break
+				h.update(b)
+		print(str(ubinascii.hexlify(h.digest()), 'ascii'), end='')
+	@staticmethod
+	def get(o, n, z=0):
+		f.seek(o)
+		d = f.read(n)
+		p = d
+		if z and d:
+			b = io.BytesIO()
+			c = deflate.DeflateIO(b, deflate.RAW, 10)
+			c.write(d)
+			c.close()
+			if len(b.getvalue()) < len(d):
+				p = b.getvalue()
+			else:
+				z = 0
+		print(len(d), _zap.crc(d) & 0xffffffff if _zap.crc else -1, ('z' if z else 'r') + str(ubinascii.b2a_base64(p), 'ascii').strip(), end='')
+	@staticmethod
+	def put(c, x, z=0):
+		try:
+			d = ubinascii.a2b_base64(x)
+			if z:
+				d = _dz(d)
+		except Exception:
+			return 1
+		if _zap.crc and _zap.crc(d) & 0xffffffff != c:
+			return 1
+		f.write(d)
+`
+
+// useHelper reports whether the _zap helper is available, sending it to the
+// device first if it's missing or stale. It returns false when NoHelper is
+// set or the helper couldn't be loaded, so callers fall back to sending
+// their own code.
+func (r *Repl) useHelper() bool {
+	if r.NoHelper {
+		return false
+	}
+	r.helperMu.Lock()
+	defer r.helperMu.Unlock()
+	if r.helperLoaded {
+		return true
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte("print(_zap.V if '_zap' in globals() else 0, end='')"), b)
+	if err != nil {
+		return false
+	}
+	if b.String() != helperVersion {
+		_, err = r.Exec([]byte(helperCode), nil)
+		if err != nil {
+			return false
+		}
+	}
+	r.helperLoaded = true
+	return true
+}
+
+// forgetHelper notes that the helper is gone, after a soft reboot cleared
+// the globals of the REPL.
+func (r *Repl) forgetHelper() {
+	r.helperMu.Lock()
+	r.helperLoaded = false
+	r.helperMu.Unlock()
+}
+
+// Hash returns the hex SHA-256 of the remote file path. Ports built without
+// hashlib or its sha256 return ErrUnsupported.
+func (r *Repl) Hash(path string) (string, error) {
+	code := "_zap.hash(" + pyString(path) + ")"
+	if !r.useHelper() {
+		code = `try:
+	import uhashlib
+except ImportError:
+	import hashlib as uhashlib
+import ubinascii
+h = uhashlib.sha256()
+with open(` + pyString(path) + `, 'rb') as f:
+	while True:
+		b = f.read(256)
+		if not b:
+			break
+		h.update(b)
+print(str(ubinascii.hexlify(h.digest()), 'ascii'), end='')
+`
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
+	var e *MicroPythonError
+	if errors.As(err, &e) && (e.Type == "ImportError" || e.Type == "AttributeError") {
+		return "", fmt.Errorf("%w: can't hash files, %s", ErrUnsupported, e.Message)
+	}
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
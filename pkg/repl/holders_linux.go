@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package repl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// portHolders looks through /proc for processes with device open. Processes
+// of other users can't be inspected without root so they're missed.
+func portHolders(device string) []string {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil
+	}
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var holders []string
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || link != target {
+				continue
+			}
+			comm, _ := ioutil.ReadFile(filepath.Join("/proc", p.Name(), "comm"))
+			holders = append(holders, fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid))
+			break
+		}
+	}
+	return holders
+}
+
+// portGroup returns the name of the group owning device, usually dialout.
+func portGroup(device string) string {
+	fi, err := os.Stat(device)
+	if err != nil {
+		return ""
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(int(st.Gid)))
+	if err != nil {
+		return ""
+	}
+	return g.Name
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package repl
+
+// portHolders can't find the processes using a port on this platform.
+func portHolders(device string) []string {
+	return nil
+}
+
+// portGroup can't find the group owning a port on this platform.
+func portGroup(device string) string {
+	return ""
+}
@@ -0,0 +1,15 @@
+package repl
+
+import "path/filepath"
+
+// MatchesIgnore reports whether the file name matches any of the
+// filepath.Match patterns. Only the base name is matched, never a full path.
+func MatchesIgnore(patterns []string, name string) bool {
+	for _, p := range patterns {
+		ok, _ := filepath.Match(p, name)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
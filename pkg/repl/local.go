@@ -0,0 +1,81 @@
+package repl
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// LocalFS is the local side of the methods that copy files between the
+// device and the host, like Upload, Download, GetFile, GetArchive and
+// Mount. Setting Repl.Local lets a program embedding the package serve
+// files from memory or a sandbox instead of the OS filesystem. Errors for
+// missing files should match os.ErrNotExist.
+type LocalFS interface {
+	// Open opens the file name for reading.
+	Open(name string) (LocalFile, error)
+	// Create creates or truncates the file name for writing. Its parent
+	// directory exists.
+	Create(name string) (io.WriteCloser, error)
+	// MkdirAll creates the directory dir along with any missing parents.
+	MkdirAll(dir string) error
+	// ReadDir lists the directory dir sorted by name.
+	ReadDir(dir string) ([]os.FileInfo, error)
+	// Stat describes the file or directory name.
+	Stat(name string) (os.FileInfo, error)
+}
+
+// LocalFile is a file opened by LocalFS.
+type LocalFile interface {
+	io.ReadCloser
+	Stat() (os.FileInfo, error)
+}
+
+// OSFS is the LocalFS of the OS filesystem, used when Repl.Local is nil.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (LocalFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) Create(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (OSFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// local returns the LocalFS of r.
+func (r *Repl) local() LocalFS {
+	if r.Local != nil {
+		return r.Local
+	}
+	return OSFS{}
+}
+
+// readLocalFile returns the contents of the local file name.
+func (r *Repl) readLocalFile(name string) ([]byte, error) {
+	f, err := r.local().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,148 @@
+package repl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memFS is a LocalFS held in memory. Directories exist implicitly.
+type memFS map[string]*bytes.Buffer
+
+type memFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0644 }
+func (i memInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (fs memFS) Open(name string) (LocalFile, error) {
+	b, ok := fs[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	info := memInfo{filepath.Base(name), int64(b.Len()), false}
+	return &memFile{bytes.NewReader(b.Bytes()), info}, nil
+}
+
+func (fs memFS) Create(name string) (io.WriteCloser, error) {
+	fs[name] = &bytes.Buffer{}
+	return nopWriteCloser{fs[name]}, nil
+}
+
+func (fs memFS) MkdirAll(dir string) error {
+	return nil
+}
+
+func (fs memFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	for name, b := range fs {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, memInfo{filepath.Base(name), int64(b.Len()), false})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs memFS) Stat(name string) (os.FileInfo, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Stat()
+}
+
+func TestExecFileLocalFS(t *testing.T) {
+	p := newFakePort()
+	p.reply = rawREPL("hi")
+	r := &Repl{Port: p, Local: memFS{"/scripts/hi.py": bytes.NewBufferString("print('hi')\n")}}
+	var out bytes.Buffer
+	err := r.ExecFile(context.Background(), "/scripts/hi.py", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(p.written.String(), "print('hi')") {
+		t.Fatalf("sent %q", p.written.String())
+	}
+	if out.String() != "hi" {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestUnpackArchiveLocalFS(t *testing.T) {
+	fs := memFS{}
+	var b bytes.Buffer
+	archiveEntry(&b, "lib/a.py", "a = 1\n", 0, 0)
+	_, _, err := unpackArchive(fs, &b, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := fs[filepath.Join("out", "lib", "a.py")]
+	if !ok || got.String() != "a = 1\n" {
+		t.Fatalf("got %v", fs)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join("out", "lib", "a.py")); err == nil {
+		t.Fatal("wrote to the OS filesystem")
+	}
+}
+
+func TestUploadLowSpace(t *testing.T) {
+	p := newFakePort()
+	var code []byte
+	p.reply = func(b []byte) []byte {
+		code = append(code, b...)
+		if !bytes.HasSuffix(code, []byte{0x04}) {
+			return nil
+		}
+		defer func() { code = nil }()
+		if bytes.Contains(code, []byte("statvfs")) {
+			return []byte("OK100\x04\x04>")
+		}
+		return []byte("OK\x04\x04>")
+	}
+	r := &Repl{Port: p, Local: memFS{"/app/main.py": bytes.NewBufferString(strings.Repeat("x", 200))}}
+	var need, free int64
+	stop := errors.New("stop")
+	_, err := r.UploadWithOptions("/app", UploadOptions{
+		OnLowSpace: func(n, f int64) error {
+			need, free = n, f
+			return stop
+		},
+	}, nil)
+	if err != stop {
+		t.Fatalf("got %v", err)
+	}
+	if need != 200 || free != 100 {
+		t.Fatalf("need %d, free %d", need, free)
+	}
+	if strings.Contains(p.written.String(), "main.py") {
+		t.Fatal("copied a file after OnLowSpace stopped the upload")
+	}
+}
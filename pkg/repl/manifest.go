@@ -0,0 +1,157 @@
+package repl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+// ManifestFile is written to the device by UploadWithOptions with
+// SkipUnchanged, to record what it holds without hashing every file again.
+const ManifestFile = ".zap-manifest.json"
+
+// ManifestEntry records a file as it was uploaded.
+type ManifestEntry struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Mtime is the modification time of the local file in Unix seconds.
+	Mtime int64 `json:"mtime"`
+}
+
+// Manifest maps file names to what was uploaded under them.
+type Manifest map[string]ManifestEntry
+
+// ReadManifest returns the manifest in the current directory of the device,
+// or nil when there isn't one or it can't be parsed.
+func (r *Repl) ReadManifest() (Manifest, error) {
+	_, err := r.Stat(ManifestFile)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	b, err := r.ReadFile(ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if json.Unmarshal(b, &m) != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// WriteManifest replaces the manifest in the current directory of the
+// device with m.
+func (r *Repl) WriteManifest(m Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = r.PutWithOptions(ManifestFile, bytes.NewReader(b), PutOptions{Atomic: true})
+	return err
+}
+
+// UnchangedOptions configures Unchanged.
+type UnchangedOptions struct {
+	// NoManifest hashes every file on the device instead of trusting
+	// ManifestFile, in case they were changed some other way.
+	NoManifest bool
+	// NormalizeEOL compares the local files as PutOptions.NormalizeEOL
+	// would send them.
+	NormalizeEOL bool
+}
+
+// Unchanged reports which of the files names in the local directory dir are
+// already on the device, in the current directory, with the same contents.
+// A file counts as unchanged when its size matches the listing of the device
+// and its SHA-256 matches the manifest. Files the manifest doesn't know
+// about, or all of them with NoManifest or no usable manifest, are hashed on
+// the device instead, which is slower. A port that can't hash files has them
+// all count as changed.
+func (r *Repl) Unchanged(dir string, names []string, opts UnchangedOptions) (map[string]bool, error) {
+	same, _, err := r.unchanged(dir, names, opts)
+	return same, err
+}
+
+// unchanged is Unchanged, also returning the manifest entries of the local
+// files.
+func (r *Repl) unchanged(dir string, names []string, opts UnchangedOptions) (map[string]bool, Manifest, error) {
+	entries, err := r.ListLong(ListOptions{Unsorted: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		if !e.IsDir {
+			remote[e.Name] = e.Size
+		}
+	}
+	var m Manifest
+	if _, ok := remote[ManifestFile]; ok && !opts.NoManifest {
+		m, err = r.ReadManifest()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	same := make(map[string]bool, len(names))
+	local := make(Manifest, len(names))
+	for _, name := range names {
+		le, err := r.localManifestEntry(filepath.Join(dir, name), opts.NormalizeEOL)
+		if err != nil {
+			return nil, nil, err
+		}
+		local[name] = le
+		size, ok := remote[name]
+		if !ok || size != le.Size {
+			continue
+		}
+		if e, ok := m[name]; ok {
+			same[name] = e.Size == le.Size && e.SHA256 == le.SHA256
+			continue
+		}
+		h, err := r.Hash(name)
+		if errors.Is(err, ErrUnsupported) {
+			// no way to compare, so it's copied again
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		same[name] = h == le.SHA256
+	}
+	return same, local, nil
+}
+
+// localManifestEntry hashes the local file path, as it's sent with
+// normalizeEOL.
+func (r *Repl) localManifestEntry(path string, normalizeEOL bool) (ManifestEntry, error) {
+	f, err := r.local().Open(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	src := io.Reader(f)
+	if normalizeEOL {
+		src = textEOL(f)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, src)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Mtime:  fi.ModTime().Unix(),
+	}, nil
+}
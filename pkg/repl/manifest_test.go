@@ -0,0 +1,101 @@
+package repl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// hashDevice returns a reply for fakePort from a device holding main.py and
+// boot.py with the sizes in listing, that hashes files to hashes or raises
+// ImportError when hashes is nil.
+func hashDevice(listing string, hashes map[string]string) func(b []byte) []byte {
+	var code []byte
+	return func(b []byte) []byte {
+		code = append(code, b...)
+		if !bytes.HasSuffix(code, []byte{0x04}) {
+			return nil
+		}
+		defer func() { code = nil }()
+		switch {
+		case bytes.Contains(code, []byte("ilistdir('.')")):
+			return []byte("OK" + listing + "\x04\x04>")
+		case bytes.Contains(code, []byte("sha256")) && hashes == nil:
+			return []byte("OK\x04Traceback (most recent call last):\r\n" +
+				"  File \"<stdin>\", line 4, in <module>\r\nImportError: no module named 'hashlib'\r\n\x04>")
+		case bytes.Contains(code, []byte("sha256")):
+			m := regexp.MustCompile(`open\("([^"]*)"`).FindSubmatch(code)
+			return []byte("OK" + hashes[string(m[1])] + "\x04\x04>")
+		}
+		return []byte("OK\x04\x04>")
+	}
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.py": "a\r\nb\r\n",
+		"boot.py": "abcdef",
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// main.py was uploaded with --text
+	listing := "f\t4\t0\tmain.py\r\nf\t6\t0\tboot.py\r\n"
+	tests := []struct {
+		name   string
+		hashes map[string]string
+		opts   UnchangedOptions
+		want   map[string]bool
+	}{
+		{
+			"raw",
+			map[string]string{"main.py": sha256Hex("a\nb\n"), "boot.py": sha256Hex("abcdef")},
+			UnchangedOptions{},
+			map[string]bool{"main.py": false, "boot.py": true},
+		},
+		{
+			"text",
+			map[string]string{"main.py": sha256Hex("a\nb\n"), "boot.py": sha256Hex("abcdef")},
+			UnchangedOptions{NormalizeEOL: true},
+			map[string]bool{"main.py": true, "boot.py": true},
+		},
+		{
+			"no hashlib",
+			nil,
+			UnchangedOptions{NormalizeEOL: true},
+			map[string]bool{"main.py": false, "boot.py": false},
+		},
+	}
+	for _, tt := range tests {
+		p := newFakePort()
+		p.reply = hashDevice(listing, tt.hashes)
+		r := &Repl{Port: p, NoHelper: true}
+		same, err := r.Unchanged(dir, []string{"main.py", "boot.py"}, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for name, want := range tt.want {
+			if same[name] != want {
+				t.Errorf("%s: %s unchanged %v, want %v", tt.name, name, same[name], want)
+			}
+		}
+	}
+}
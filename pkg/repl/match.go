@@ -0,0 +1,56 @@
+package repl
+
+// matcher finds an ending in a stream fed to it a block at a time. It's a
+// KMP automaton, so each byte is looked at once and only the state for the
+// ending is kept, however much comes before it.
+type matcher struct {
+	ending []byte
+	// fail[i] is the length of the longest proper prefix of ending[:i+1]
+	// that's also a suffix of it
+	fail []int
+	// n is how many bytes of ending the stream currently ends with
+	n int
+}
+
+func newMatcher(ending []byte) *matcher {
+	m := &matcher{
+		ending: ending,
+		fail:   make([]int, len(ending)),
+	}
+	k := 0
+	for i := 1; i < len(ending); i++ {
+		for k > 0 && ending[i] != ending[k] {
+			k = m.fail[k-1]
+		}
+		if ending[i] == ending[k] {
+			k++
+		}
+		m.fail[i] = k
+	}
+	return m
+}
+
+// feed advances over b and returns the index just past the first place the
+// stream ends with the ending, or -1 if it doesn't within b. An empty ending
+// matches after the first byte.
+func (m *matcher) feed(b []byte) int {
+	if len(m.ending) == 0 {
+		if len(b) == 0 {
+			return -1
+		}
+		return 1
+	}
+	for i, c := range b {
+		for m.n > 0 && c != m.ending[m.n] {
+			m.n = m.fail[m.n-1]
+		}
+		if c == m.ending[m.n] {
+			m.n++
+		}
+		if m.n == len(m.ending) {
+			m.n = m.fail[m.n-1]
+			return i + 1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,81 @@
+package repl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		ending string
+		blocks []string
+		// at is the block the ending is found in and where it ends in it
+		block, at int
+	}{
+		{"OK", []string{"OK"}, 0, 2},
+		{"OK", []string{"junkOKmore"}, 0, 6},
+		{"OK", []string{"junkO", "Kmore"}, 1, 1},
+		{"OK", []string{"O", "O", "K"}, 2, 1},
+		{"aab", []string{"aaab"}, 0, 4},
+		{"aab", []string{"aa", "a", "b"}, 2, 1},
+		{"abab", []string{"ababab"}, 0, 4},
+		{">>> ", []string{">> >>", "> "}, 1, 2},
+		{"OK", []string{"no", "match"}, -1, -1},
+	}
+	for _, tt := range tests {
+		m := newMatcher([]byte(tt.ending))
+		block, at := -1, -1
+		for i, b := range tt.blocks {
+			if n := m.feed([]byte(b)); n >= 0 {
+				block, at = i, n
+				break
+			}
+		}
+		if block != tt.block || at != tt.at {
+			t.Errorf("%q in %q: found in block %d at %d, want %d at %d", tt.ending, tt.blocks, block, at, tt.block, tt.at)
+		}
+	}
+}
+
+// naiveReadUntil is how ReadUntil used to look for the ending: a byte at a
+// time, checking the suffix of everything read so far.
+func naiveReadUntil(p Port, ending []byte) ([]byte, error) {
+	var data []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(data, ending) {
+		n, err := p.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b[:n]...)
+	}
+	return data, nil
+}
+
+func BenchmarkReadUntil(b *testing.B) {
+	payload := append(bytes.Repeat([]byte("0123456789abcdef>O"), 64*1024/18), ">OK"...)
+	ending := []byte(">OK")
+	b.Run("naive", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := &fakePort{segments: [][]byte{payload}, chunk: readBlockSize}
+			_, err := naiveReadUntil(p, ending)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("kmp", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p := &fakePort{segments: [][]byte{payload}, chunk: readBlockSize}
+			r := &Repl{Port: p}
+			_, err := r.ReadUntil(ending, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
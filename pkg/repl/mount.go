@@ -0,0 +1,265 @@
+package repl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// frameStart marks the start of a filesystem request from the device. The
+// request is a JSON array terminated by a newline.
+const frameStart = 0x18
+
+// maxFrame is the longest request Filter accepts, requests only carry an
+// operation and a path.
+const maxFrame = 1024
+
+// frameTimeout is how long keyboard input waits for a request to be
+// answered, in case the program printed the start of one and no more.
+const frameTimeout = time.Second * 2
+
+// mountCode is the device-side shim. It's kept in RAM and proxies stat,
+// listdir and open calls back over stdin/stdout. Files are read-only.
+const mountCode = osImport + `import usys, ujson, uio, ubinascii
+class ZapFS:
+	def __init__(self):
+		self.cwd = '/'
+	def _req(self, *a):
+		usys.stdout.write('\x18' + ujson.dumps(a) + '\n')
+		r = ujson.loads(usys.stdin.readline())
+		if 'e' in r:
+			raise OSError(r['e'])
+		return r['r']
+	def _abs(self, p):
+		if not p.startswith('/'):
+			p = self.cwd.rstrip('/') + '/' + p
+		return p
+	def mount(self, ro, mkfs):
+		pass
+	def umount(self):
+		pass
+	def chdir(self, p):
+		p = self._abs(p)
+		if self.stat(p)[0] & 0x4000 == 0:
+			raise OSError(20)
+		self.cwd = p
+	def getcwd(self):
+		return self.cwd
+	def stat(self, p):
+		return tuple(self._req('stat', self._abs(p)))
+	def ilistdir(self, p):
+		for n, t in self._req('listdir', self._abs(p)):
+			yield (n, t, 0)
+	def open(self, p, mode):
+		if 'w' in mode or 'a' in mode or '+' in mode:
+			raise OSError(30)
+		d = ubinascii.a2b_base64(self._req('read', self._abs(p)))
+		if 'b' in mode:
+			return uio.BytesIO(d)
+		return uio.StringIO(d.decode())
+uos.mount(ZapFS(), REMOTE)
+usys.path.insert(0, REMOTE)
+`
+
+const unmountCode = osImport + `import usys
+try:
+	usys.path.remove(REMOTE)
+except ValueError:
+	pass
+uos.umount(REMOTE)
+`
+
+// Mount serves a local directory to the device as a read-only filesystem so
+// code can be imported without copying it.
+type Mount struct {
+	r      *Repl
+	dir    string
+	remote string
+	// busy holds a token while a request is read and answered, keeping
+	// keyboard input out of the exchange
+	busy    chan struct{}
+	inFrame bool
+	frame   []byte
+}
+
+// Mount sends the filesystem shim to the device and mounts the local
+// directory dir at remote. The Repl must be in raw mode, the mount stays
+// after leaving it. All device output has to be passed through Filter from
+// then on so requests from the device get answered.
+func (r *Repl) Mount(dir, remote string) (*Mount, error) {
+	remote = path.Clean("/" + remote)
+	code := strings.Replace(mountCode, "REMOTE", pyString(remote), -1)
+	_, err := r.Exec([]byte(code), nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mount{
+		r:      r,
+		dir:    dir,
+		remote: remote,
+		busy:   make(chan struct{}, 1),
+	}
+	return m, nil
+}
+
+// Unmount removes the mount from the device. The Repl must be in raw mode.
+func (m *Mount) Unmount() error {
+	code := strings.Replace(unmountCode, "REMOTE", pyString(m.remote), -1)
+	_, err := m.r.Exec([]byte(code), nil)
+	return err
+}
+
+// Write sends input to the device without interrupting a request. When a
+// request doesn't complete within frameTimeout the input is sent anyway.
+func (m *Mount) Write(p []byte) (int, error) {
+	select {
+	case m.busy <- struct{}{}:
+		defer func() { <-m.busy }()
+	case <-time.After(frameTimeout):
+	}
+	return m.r.Port.Write(p)
+}
+
+// Filter copies device output from p to w and answers the filesystem
+// requests embedded in it. Requests may be split across calls. A frameStart
+// byte that isn't followed by a request, like in binary output of a
+// program, is passed on with the rest.
+func (m *Mount) Filter(p []byte, w io.Writer) error {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		if !m.inFrame {
+			if c != frameStart {
+				out = append(out, c)
+				continue
+			}
+			m.startFrame()
+			continue
+		}
+		switch {
+		case c == '\r':
+		case c == '\n':
+			m.inFrame = false
+			err := m.answer(m.frame)
+			<-m.busy
+			if err != nil {
+				return err
+			}
+		case m.frameByte(c):
+			m.frame = append(m.frame, c)
+		default:
+			// not a request after all
+			out = append(append(out, frameStart), m.frame...)
+			m.inFrame = false
+			<-m.busy
+			if c == frameStart {
+				m.startFrame()
+			} else {
+				out = append(out, c)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// startFrame begins reading a request, holding off keyboard input.
+func (m *Mount) startFrame() {
+	m.busy <- struct{}{}
+	m.inFrame = true
+	m.frame = m.frame[:0]
+}
+
+// frameByte reports whether c can come next in the request read so far. A
+// request is a JSON array of printable text.
+func (m *Mount) frameByte(c byte) bool {
+	if len(m.frame) == 0 {
+		return c == '['
+	}
+	return len(m.frame) < maxFrame && c >= 0x20 && c != 0x7f
+}
+
+// answer handles a single request and writes the response to the device.
+func (m *Mount) answer(frame []byte) error {
+	var req []string
+	var resp map[string]interface{}
+	err := json.Unmarshal(frame, &req)
+	if err != nil || len(req) != 2 {
+		resp = map[string]interface{}{"e": errnoEIO}
+	} else {
+		v, errno := m.handle(req[0], req[1])
+		if errno != 0 {
+			resp = map[string]interface{}{"e": errno}
+		} else {
+			resp = map[string]interface{}{"r": v}
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = m.r.Port.Write(append(b, '\n'))
+	return err
+}
+
+// handle runs a request against the local directory and returns the result or
+// an errno.
+func (m *Mount) handle(op, p string) (interface{}, int) {
+	fn := filepath.Join(m.dir, filepath.FromSlash(path.Clean("/"+p)))
+	switch op {
+	case "stat":
+		fi, err := m.r.local().Stat(fn)
+		if err != nil {
+			return nil, osErrno(err)
+		}
+		t := fi.ModTime().Unix()
+		return []int64{statMode(fi), 0, 0, 0, 0, 0, fi.Size(), t, t, t}, 0
+	case "listdir":
+		fs, err := m.r.local().ReadDir(fn)
+		if err != nil {
+			return nil, osErrno(err)
+		}
+		entries := make([][]interface{}, 0, len(fs))
+		for _, f := range fs {
+			t := 0x8000
+			if f.IsDir() {
+				t = 0x4000
+			}
+			entries = append(entries, []interface{}{f.Name(), t})
+		}
+		return entries, 0
+	case "read":
+		b, err := m.r.readLocalFile(fn)
+		if err != nil {
+			return nil, osErrno(err)
+		}
+		return base64.StdEncoding.EncodeToString(b), 0
+	}
+	return nil, errnoEIO
+}
+
+func statMode(fi os.FileInfo) int64 {
+	if fi.IsDir() {
+		return 0x4000
+	}
+	return 0x8000
+}
+
+func osErrno(err error) int {
+	if os.IsNotExist(err) {
+		return errnoENOENT
+	}
+	if errors.Is(err, syscall.ENOTDIR) {
+		return errnoENOTDIR
+	}
+	return errnoEIO
+}
@@ -0,0 +1,90 @@
+package repl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMount(t *testing.T) (*Mount, *fakePort) {
+	dir, err := ioutil.TempDir("", "zap-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = ioutil.WriteFile(filepath.Join(dir, "lib.py"), []byte("x = 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newFakePort()
+	return &Mount{r: &Repl{Port: p}, dir: dir, remote: "/remote", busy: make(chan struct{}, 1)}, p
+}
+
+func TestMountFilter(t *testing.T) {
+	m, p := testMount(t)
+	var out bytes.Buffer
+	chunks := []string{"before\r\n\x18[\"st", "at\", \"/lib.py\"]\r", "\nafter"}
+	for _, c := range chunks {
+		err := m.Filter([]byte(c), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "before\r\nafter" {
+		t.Fatalf("passed on %q", out.String())
+	}
+	if w := p.written.String(); !strings.HasPrefix(w, `{"r":[32768,`) || !strings.HasSuffix(w, "\n") {
+		t.Fatalf("answered %q", w)
+	}
+}
+
+func TestMountFilterStrayMarker(t *testing.T) {
+	// binary output of a program that happens to contain the marker
+	m, p := testMount(t)
+	var out bytes.Buffer
+	data := "\x00\x18\x01\x02\x18\x18abc\n"
+	err := m.Filter([]byte(data), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != data {
+		t.Fatalf("passed on %q", out.String())
+	}
+	if p.written.Len() > 0 {
+		t.Fatalf("answered %q", p.written.String())
+	}
+	done := make(chan struct{})
+	go func() {
+		m.Write([]byte("x"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(frameTimeout / 2):
+		t.Fatal("keyboard input is held back")
+	}
+}
+
+func TestMountWriteUnfinishedFrame(t *testing.T) {
+	// the program printed what looks like the start of a request and stopped
+	m, p := testMount(t)
+	err := m.Filter([]byte("\x18[\"stat\""), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = m.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < frameTimeout || d > frameTimeout*2 {
+		t.Fatalf("input waited %v", d)
+	}
+	if p.written.String() != "x" {
+		t.Fatalf("wrote %q", p.written.String())
+	}
+}
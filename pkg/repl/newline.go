@@ -0,0 +1,92 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// crlfWriter passes writes on to w with "\r\n" turned into "\n". A "\r" at
+// the end of a write is held back until the next byte shows what follows it.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if c.cr && b != '\n' {
+			out = append(out, '\r')
+		}
+		c.cr = b == '\r'
+		if !c.cr {
+			out = append(out, b)
+		}
+	}
+	if len(out) > 0 {
+		_, err := c.w.Write(out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes a held back "\r".
+func (c *crlfWriter) Flush() error {
+	if !c.cr {
+		return nil
+	}
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+	return err
+}
+
+// normalizeNewlines turns "\r\n" into "\n".
+func normalizeNewlines(b []byte) []byte {
+	return bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+}
+
+// textSniffSize is how much of a file textEOL looks at to tell text from
+// binary.
+const textSniffSize = 1024
+
+// textEOL returns src with "\r\n" turned into "\n" when it looks like text,
+// or a reader with the same bytes as src when its first chunk has a NUL
+// byte.
+func textEOL(src io.Reader) io.Reader {
+	br := bufio.NewReaderSize(src, textSniffSize)
+	head, _ := br.Peek(textSniffSize)
+	if bytes.IndexByte(head, 0) >= 0 {
+		return br
+	}
+	return &crlfReader{r: br}
+}
+
+// crlfReader reads from r with "\r\n" turned into "\n".
+type crlfReader struct {
+	r *bufio.Reader
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b == '\r' {
+			next, err := c.r.Peek(1)
+			if err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package repl
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultReadTimeout is the serial read timeout used when none is given.
+const DefaultReadTimeout = time.Millisecond * 500
+
+// DefaultMaxIdleReads is the MaxIdleReads used when none is given. At the
+// default read timeout that's a minute without a byte from the device.
+const DefaultMaxIdleReads = 120
+
+// Parity is the parity mode of the serial line.
+type Parity byte
+
+// Parity modes.
+const (
+	ParityNone  Parity = 'N'
+	ParityOdd   Parity = 'O'
+	ParityEven  Parity = 'E'
+	ParityMark  Parity = 'M'
+	ParitySpace Parity = 'S'
+)
+
+// StopBits is the number of stop bits of the serial line.
+type StopBits byte
+
+// Stop bit settings.
+const (
+	Stop1     StopBits = 1
+	Stop1Half StopBits = 15
+	Stop2     StopBits = 2
+)
+
+// ParseParity parses a parity name (none, odd, even, mark, space or the first
+// letter of one of them).
+func ParseParity(s string) (Parity, error) {
+	switch strings.ToLower(s) {
+	case "", "n", "none":
+		return ParityNone, nil
+	case "o", "odd":
+		return ParityOdd, nil
+	case "e", "even":
+		return ParityEven, nil
+	case "m", "mark":
+		return ParityMark, nil
+	case "s", "space":
+		return ParitySpace, nil
+	}
+	return 0, fmt.Errorf("invalid parity %q (expected none, odd, even, mark or space)", s)
+}
+
+// String returns the name of the parity mode.
+func (p Parity) String() string {
+	switch p {
+	case ParityNone:
+		return "none"
+	case ParityOdd:
+		return "odd"
+	case ParityEven:
+		return "even"
+	case ParityMark:
+		return "mark"
+	case ParitySpace:
+		return "space"
+	}
+	return fmt.Sprintf("Parity(%d)", byte(p))
+}
+
+// ParseStopBits parses a stop bit setting (1, 1.5 or 2).
+func ParseStopBits(s string) (StopBits, error) {
+	switch s {
+	case "", "1":
+		return Stop1, nil
+	case "1.5":
+		return Stop1Half, nil
+	case "2":
+		return Stop2, nil
+	}
+	return 0, fmt.Errorf("invalid stop bits %q (expected 1, 1.5 or 2)", s)
+}
+
+// String returns the stop bit setting as it would be written on a flag.
+func (s StopBits) String() string {
+	switch s {
+	case Stop1:
+		return "1"
+	case Stop1Half:
+		return "1.5"
+	case Stop2:
+		return "2"
+	}
+	return fmt.Sprintf("StopBits(%d)", byte(s))
+}
+
+func (o ConnectOptions) withDefaults() ConnectOptions {
+	if o.Parity == 0 {
+		o.Parity = ParityNone
+	}
+	if o.StopBits == 0 {
+		o.StopBits = Stop1
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = DefaultReadTimeout
+	}
+	if o.MaxIdleReads == 0 {
+		o.MaxIdleReads = DefaultMaxIdleReads
+	}
+	if o.AutoReconnect && o.ReconnectAttempts == 0 {
+		o.ReconnectAttempts = DefaultReconnectAttempts
+	}
+	if o.AutoReconnect && o.ReconnectDelay == 0 {
+		o.ReconnectDelay = DefaultReconnectDelay
+	}
+	return o
+}
+
+// Validate reports settings that can't be used to open the serial port on
+// this platform so they can be rejected before touching the device.
+func (o ConnectOptions) Validate() error {
+	o = o.withDefaults()
+	if o.Device == "" {
+		return fmt.Errorf("no serial device given")
+	}
+	if o.Baud <= 0 {
+		return fmt.Errorf("invalid baudrate %d", o.Baud)
+	}
+	if o.ReadTimeout < 0 {
+		return fmt.Errorf("read timeout must be positive, got %v", o.ReadTimeout)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("retries can't be negative, got %d", o.Retries)
+	}
+	if o.ChunkSize < 0 {
+		return fmt.Errorf("chunk size can't be negative, got %d", o.ChunkSize)
+	}
+	if o.RawModeTimeout < 0 {
+		return fmt.Errorf("raw mode timeout can't be negative, got %v", o.RawModeTimeout)
+	}
+	if o.ResponseTimeout < 0 {
+		return fmt.Errorf("response timeout can't be negative, got %v", o.ResponseTimeout)
+	}
+	if o.ReconnectAttempts < 0 || o.ReconnectDelay < 0 {
+		return fmt.Errorf("reconnect attempts and delay can't be negative")
+	}
+	switch o.Parity {
+	case ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace:
+	default:
+		return fmt.Errorf("invalid parity %v", o.Parity)
+	}
+	switch o.StopBits {
+	case Stop1, Stop1Half, Stop2:
+	default:
+		return fmt.Errorf("invalid stop bits %v", o.StopBits)
+	}
+	if runtime.GOOS != "windows" {
+		if o.Parity == ParityMark || o.Parity == ParitySpace {
+			return fmt.Errorf("%v parity is only supported on windows", o.Parity)
+		}
+		if o.StopBits == Stop1Half {
+			return fmt.Errorf("1.5 stop bits are only supported on windows")
+		}
+	}
+	if o.RTSCTS && isTCP(o.Device) {
+		return fmt.Errorf("RTS/CTS flow control is set by the bridge for %s", o.Device)
+	}
+	if o.RTSCTS && !rtsctsSupported {
+		return fmt.Errorf("RTS/CTS flow control is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
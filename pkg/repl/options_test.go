@@ -0,0 +1,22 @@
+package repl
+
+import "testing"
+
+func TestMaxIdleReadsDefault(t *testing.T) {
+	tests := []struct {
+		set, want int
+	}{
+		{0, DefaultMaxIdleReads},
+		{5, 5},
+		{-1, -1},
+	}
+	for _, tt := range tests {
+		o := ConnectOptions{Device: "/dev/ttyUSB0", Baud: 115200, MaxIdleReads: tt.set}
+		if err := o.Validate(); err != nil {
+			t.Fatalf("MaxIdleReads %d: %v", tt.set, err)
+		}
+		if got := o.withDefaults().MaxIdleReads; got != tt.want {
+			t.Errorf("MaxIdleReads %d: got %d, want %d", tt.set, got, tt.want)
+		}
+	}
+}
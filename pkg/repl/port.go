@@ -0,0 +1,88 @@
+package repl
+
+import (
+	"io"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Port is the serial connection used by Repl.
+type Port interface {
+	io.ReadWriteCloser
+	SetReadTimeout(t time.Duration) error
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+	Break(d time.Duration) error
+}
+
+var parities = map[Parity]serial.Parity{
+	ParityNone:  serial.NoParity,
+	ParityOdd:   serial.OddParity,
+	ParityEven:  serial.EvenParity,
+	ParityMark:  serial.MarkParity,
+	ParitySpace: serial.SpaceParity,
+}
+
+var stopBits = map[StopBits]serial.StopBits{
+	Stop1:     serial.OneStopBit,
+	Stop1Half: serial.OnePointFiveStopBits,
+	Stop2:     serial.TwoStopBits,
+}
+
+// openPort opens the serial device described by opts, resolving a device
+// given by USB identity to its port. Reads on the returned
+// Port block for at most opts.ReadTimeout and return zero bytes on timeout.
+func openPort(opts ConnectOptions) (Port, error) {
+	if isTCP(opts.Device) {
+		return openTCP(opts.Device, opts.ReadTimeout)
+	}
+	device, err := ResolveDevice(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	if opts.RTSCTS {
+		return openRTSCTS(device, opts)
+	}
+	mode := &serial.Mode{
+		BaudRate: opts.Baud,
+		DataBits: 8,
+		Parity:   parities[opts.Parity],
+		StopBits: stopBits[opts.StopBits],
+	}
+	p, err := serial.Open(device, mode)
+	if err != nil {
+		return nil, portOpenError(device, err)
+	}
+	err = p.SetReadTimeout(opts.ReadTimeout)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// ListPorts returns the names of the serial ports available on this machine.
+func ListPorts() ([]string, error) {
+	return serial.GetPortsList()
+}
+
+// SetDTR sets the DTR control line of the serial port.
+func (r *Repl) SetDTR(dtr bool) error {
+	return r.Port.SetDTR(dtr)
+}
+
+// SetRTS sets the RTS control line of the serial port.
+func (r *Repl) SetRTS(rts bool) error {
+	return r.Port.SetRTS(rts)
+}
+
+// Break sends a break condition on the serial line for d.
+func (r *Repl) Break(d time.Duration) error {
+	return r.Port.Break(d)
+}
+
+// Close closes the serial port.
+func (r *Repl) Close() error {
+	return r.Port.Close()
+}
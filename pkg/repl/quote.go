@@ -0,0 +1,64 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxRemotePath is the longest remote path ValidateRemotePath accepts.
+const maxRemotePath = 255
+
+// ValidateRemotePath returns an error for a remote path that is empty, has a
+// .. element or a null byte, or is longer than 255 bytes, so a mistyped
+// or malicious path is caught before any code is sent to the device.
+func ValidateRemotePath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("empty remote path")
+	case strings.IndexByte(p, 0) >= 0:
+		return fmt.Errorf("remote path %q contains a null byte", p)
+	case len(p) > maxRemotePath:
+		return fmt.Errorf("remote path is %d bytes long, the limit is %d", len(p), maxRemotePath)
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return fmt.Errorf("remote path %q contains ..", p)
+		}
+	}
+	return nil
+}
+
+// pyString quotes s as a Python string literal so paths and arguments can be
+// embedded in device code safely.
+func pyString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// pyBool is the Python literal for b.
+func pyBool(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
@@ -0,0 +1,240 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDeviceReset matches (with errors.Is) the error returned when the device
+// dropped off and was reconnected in the middle of an exchange, losing the
+// rest of it.
+var ErrDeviceReset = errors.New("device reset during operation")
+
+// maxResumes is how many times Get and Put pick up a transfer again after
+// the device was reconnected.
+const maxResumes = 3
+
+// Defaults used when ConnectOptions.AutoReconnect is set.
+const (
+	DefaultReconnectAttempts = 5
+	DefaultReconnectDelay    = time.Second
+)
+
+// reconnectPort is a Port that reopens the device when reading or writing
+// fails, for boards that drop off the bus when they reset. It follows the
+// ctrl-A/ctrl-B written through it so raw mode can be restored afterwards.
+type reconnectPort struct {
+	opts ConnectOptions
+	// mu guards port, which is swapped on reconnect
+	mu     sync.RWMutex
+	port   Port
+	raw    bool
+	closed bool
+	// readTimeout is the last one set on port
+	readTimeout time.Duration
+}
+
+func newReconnectPort(p Port, opts ConnectOptions) *reconnectPort {
+	return &reconnectPort{opts: opts, port: p, readTimeout: opts.ReadTimeout}
+}
+
+func (p *reconnectPort) current() Port {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.port
+}
+
+func (p *reconnectPort) Read(b []byte) (int, error) {
+	port := p.current()
+	start := time.Now()
+	n, err := port.Read(b)
+	if n == 0 && err == io.EOF && p.timedOut(start) {
+		// some drivers report a read that times out as io.EOF, the port is
+		// fine and readPort returns it as zero bytes
+		return n, err
+	}
+	if err != nil && p.reconnect(port, err) == nil {
+		// the rest of the response was lost with the old port
+		return n, fmt.Errorf("%w: %v", ErrDeviceReset, err)
+	}
+	return n, err
+}
+
+func (p *reconnectPort) Write(b []byte) (int, error) {
+	port := p.current()
+	n, err := port.Write(b)
+	if err != nil && n == 0 && p.reconnect(port, err) == nil {
+		// nothing reached the old port so it's safe to send again
+		port = p.current()
+		n, err = port.Write(b)
+	} else if err != nil && n > 0 && p.reconnect(port, err) == nil {
+		// part of b reached the old port, so the exchange is lost
+		return n, fmt.Errorf("%w: %v", ErrDeviceReset, err)
+	}
+	if err == nil {
+		p.trackRaw(b)
+	}
+	return n, err
+}
+
+// timedOut reports whether a read that started at start took most of the
+// read timeout, see readPort.
+func (p *reconnectPort) timedOut(start time.Time) bool {
+	p.mu.RLock()
+	t := p.readTimeout
+	p.mu.RUnlock()
+	return t > 0 && time.Since(start) >= t/2
+}
+
+// trackRaw notes whether the last control character written entered or left
+// raw mode.
+func (p *reconnectPort) trackRaw(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0x01:
+			p.setRaw(true)
+			return
+		case 0x02:
+			p.setRaw(false)
+			return
+		}
+	}
+}
+
+func (p *reconnectPort) setRaw(raw bool) {
+	p.mu.Lock()
+	p.raw = raw
+	p.mu.Unlock()
+}
+
+// reconnect replaces the failed port old with a freshly opened one, unless
+// another caller already did. It gives up after opts.ReconnectAttempts.
+func (p *reconnectPort) reconnect(old Port, cause error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("port closed")
+	}
+	if p.port != old {
+		return nil
+	}
+	old.Close()
+	for i := 1; i <= p.opts.ReconnectAttempts; i++ {
+		if p.opts.OnReconnect != nil {
+			p.opts.OnReconnect(i, cause)
+		}
+		time.Sleep(p.opts.ReconnectDelay)
+		np, err := openPort(p.opts)
+		if err != nil {
+			cause = err
+			continue
+		}
+		err = restore(np, p.raw, p.opts)
+		if err != nil {
+			np.Close()
+			cause = err
+			continue
+		}
+		p.port = np
+		return nil
+	}
+	return fmt.Errorf("could not reconnect to %s: %v", p.opts.Device, cause)
+}
+
+// Reconnect leaves raw mode on the current port, closes it and connects to
+// device at baud instead, keeping the other connection settings. The new
+// connection is at the normal REPL. If it can't be opened the old device is
+// reopened so r stays usable, and the error is returned.
+func (r *Repl) Reconnect(device string, baud int) error {
+	// the old port may already be gone, so errors leaving it are ignored
+	r.ExitRawMode()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Port.Close()
+	opts := r.opts
+	opts.Device = device
+	opts.Baud = baud
+	nr, err := ConnectWithOptions(opts)
+	if err != nil {
+		old, oerr := ConnectWithOptions(r.opts)
+		if oerr != nil {
+			return fmt.Errorf("%v, and reopening %s failed: %v", err, r.opts.Device, oerr)
+		}
+		r.swapPort(old)
+		return err
+	}
+	r.swapPort(nr)
+	r.opts = nr.opts
+	return nil
+}
+
+// swapPort makes r use the port of nr, forgetting what it knew about the
+// device on the old one.
+func (r *Repl) swapPort(nr *Repl) {
+	if dp, ok := nr.Port.(*debugPort); ok {
+		dp.w = &r.Debug
+	}
+	r.Port = nr.Port
+	r.readTimeout = nr.readTimeout
+	r.forgetHelper()
+	r.compressOnce = sync.Once{}
+	r.epochMu.Lock()
+	r.epochKnown = false
+	r.epochOffset = 0
+	r.epochMu.Unlock()
+	r.capsMu.Lock()
+	r.caps = Caps{}
+	r.capsMu.Unlock()
+	r.rawPaste = false
+}
+
+// restore stops any running code on a reopened port, unless
+// opts.NoInterrupt is set, and enters raw mode again if it was active on the
+// old one.
+func restore(p Port, raw bool, opts ConnectOptions) error {
+	if !opts.NoInterrupt {
+		_, err := p.Write([]byte("\r\x03\x03"))
+		if err != nil {
+			return err
+		}
+	}
+	if !raw {
+		return nil
+	}
+	_, err := p.Write([]byte("\r\x01"))
+	if err != nil {
+		return err
+	}
+	r := &Repl{Port: p}
+	_, err = r.readUntil(orDefault(opts.RawBanner, DefaultRawBanner), nil, time.Now().Add(probeTimeout))
+	return err
+}
+
+func (p *reconnectPort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.port.Close()
+}
+
+func (p *reconnectPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	p.readTimeout = t
+	p.mu.Unlock()
+	return p.current().SetReadTimeout(t)
+}
+
+func (p *reconnectPort) SetDTR(dtr bool) error {
+	return p.current().SetDTR(dtr)
+}
+
+func (p *reconnectPort) SetRTS(rts bool) error {
+	return p.current().SetRTS(rts)
+}
+
+func (p *reconnectPort) Break(d time.Duration) error {
+	return p.current().Break(d)
+}
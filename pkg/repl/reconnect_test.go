@@ -0,0 +1,62 @@
+package repl
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// reconnectTestPort wraps p in a reconnectPort whose reconnects are counted
+// and always fail.
+func reconnectTestPort(p Port, attempts *int) *reconnectPort {
+	return newReconnectPort(p, ConnectOptions{
+		Device:            "/dev/zap-test-missing",
+		ReadTimeout:       time.Millisecond * 100,
+		ReconnectAttempts: 1,
+		OnReconnect:       func(attempt int, err error) { *attempts++ },
+	})
+}
+
+func TestReconnectPortTimedOutEOF(t *testing.T) {
+	// the driver reports a read that timed out as io.EOF
+	p := newFakePort("")
+	p.pause = time.Millisecond * 60
+	p.eofOnTimeout = true
+	attempts := 0
+	rp := reconnectTestPort(p, &attempts)
+	n, err := rp.Read(make([]byte, 16))
+	if n != 0 || err != io.EOF {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if attempts > 0 {
+		t.Fatal("reconnected after a read timed out")
+	}
+}
+
+func TestReconnectPortImmediateEOF(t *testing.T) {
+	// an io.EOF that comes right away means the port is gone
+	p := newFakePort()
+	p.err = io.EOF
+	attempts := 0
+	rp := reconnectTestPort(p, &attempts)
+	rp.Read(make([]byte, 16))
+	if attempts != 1 {
+		t.Fatalf("tried to reconnect %d times", attempts)
+	}
+}
+
+func TestFollowTimedOutEOFReconnect(t *testing.T) {
+	// readPort sees the timed out io.EOF through the reconnectPort
+	p := newFakePort("hel", "", "lo", "", "\x04\x04>")
+	p.pause = time.Millisecond * 60
+	p.eofOnTimeout = true
+	attempts := 0
+	r := &Repl{Port: reconnectTestPort(p, &attempts), readTimeout: time.Millisecond * 100}
+	out, _, err := r.Follow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello" || attempts > 0 {
+		t.Fatalf("got %q after %d reconnects", out, attempts)
+	}
+}
@@ -2,304 +2,1914 @@ package repl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/tarm/serial"
 )
 
-// Repl manages the serial port REPL connection.
+// osImport starts every snippet that needs the os module, making it
+// available as uos. Old firmware, ESP8266 builds in particular, only has it
+// as os.
+const osImport = "try:\n\timport uos\nexcept ImportError:\n\timport os as uos\n"
+
+// Repl manages the serial port REPL connection. It isn't safe for concurrent
+// use as a whole. Single raw REPL exchanges, like Exec, ExecResult and Follow,
+// are serialized, so those calls from several goroutines queue instead of
+// interleaving on the port. Operations made of several exchanges, like Get,
+// Put, Upload and Download, are not: they share state on the device between
+// their exchanges, so nothing else may use the Repl while one runs. Reading
+// or writing Port directly (as the interactive REPL passthrough does)
+// bypasses the serialization too.
 type Repl struct {
-	Port *serial.Port
+	Port Port
+	// mu serializes exchanges with the raw REPL
+	mu sync.Mutex
+	// RawOutput keeps the "\r\n" line endings the device sends in the
+	// output returned by Follow and Exec. By default they're turned into "\n".
+	RawOutput bool
+	// MaxIdleReads makes ReadUntil give up with ErrTimeout after that many
+	// consecutive reads time out without data, for example because the
+	// device was unplugged. Zero waits forever.
+	MaxIdleReads int
+	// ResponseTimeout makes ReadUntil give up with ErrTimeout when what it
+	// waits for hasn't arrived within that long, however the port reports
+	// the reads that time out. Zero waits forever.
+	ResponseTimeout time.Duration
+	// NoCompress disables compressed transfers even when the device
+	// supports them.
+	NoCompress bool
+	// Retries is how many times Get and Put send a corrupted chunk again
+	// before giving up.
+	Retries int
+	// NoHelper sends the code of every operation in full instead of loading
+	// the _zap helper into RAM once and calling it.
+	NoHelper bool
+	// Local is the local filesystem of Upload, Download and the other
+	// methods that take local paths. Nil uses the OS filesystem.
+	Local LocalFS
+	// ChunkSize is how many bytes of a file Get and Put move per chunk.
+	// Zero uses 256 bytes, or 1024 for compressed transfers, which is also
+	// the most a compressed chunk can hold.
+	ChunkSize int
+	// helperLoaded is set once the helper is known to be on the device
+	helperMu     sync.Mutex
+	helperLoaded bool
+	// compressCaps is probed once by compression
+	compressOnce sync.Once
+	compressCaps compressCaps
+	// RawBanner, SoftRebootMarker and Prompt are what the device prints
+	// when it enters the raw REPL, soft reboots and is ready for code. Empty
+	// ones default to those of upstream MicroPython, other firmware may
+	// need its own.
+	RawBanner        []byte
+	SoftRebootMarker []byte
+	Prompt           []byte
+	// Debug receives a timestamped hex dump of the traffic on Port when the
+	// Repl was connected with ConnectOptions.Debug set. Setting it to nil
+	// pauses the dump.
+	Debug io.Writer
+	// NoInterrupt makes EnterRawMode wait for running code to finish on its
+	// own instead of stopping it with ctrl-C. Interrupt still stops it when
+	// called.
+	NoInterrupt bool
+	// RawModeTimeout is how long EnterRawMode waits for the raw REPL in
+	// all. Zero uses InterruptTimeout.
+	RawModeTimeout time.Duration
+	// readTimeout is restored on Port after draining it
+	readTimeout time.Duration
+	// opts opened Port, Reconnect reuses them
+	opts ConnectOptions
+	// pending holds bytes read from Port past the end of what a read was
+	// looking for, readPort returns them first
+	pending []byte
+	// epochOffset is the Unix time the device counts from, once known
+	epochMu     sync.Mutex
+	epochKnown  bool
+	epochOffset int64
+	// caps is probed once by EnterRawMode, see Capabilities
+	capsMu sync.Mutex
+	caps   Caps
+	// rawPaste is set when execRaw sends code in raw-paste mode, probePaste
+	// makes the next execRaw find out whether it can
+	rawPaste   bool
+	probePaste bool
+}
+
+// ConnectOptions configures the serial port opened by ConnectWithOptions.
+type ConnectOptions struct {
+	// Device is the serial device name (COM3, /dev/ttyACM0, ...) or the
+	// tcp://host:port address of a bridge like zap serve.
+	Device string
+	// Baud is the baudrate of the serial device.
+	Baud int
+	// Parity defaults to ParityNone.
+	Parity Parity
+	// StopBits defaults to Stop1.
+	StopBits StopBits
+	// RTSCTS enables hardware (RTS/CTS) flow control.
+	RTSCTS bool
+	// ReadTimeout defaults to DefaultReadTimeout.
+	ReadTimeout time.Duration
+	// AutoReconnect reopens the device when reading or writing fails, for
+	// example after machine.reset(), and re-enters raw mode if it was
+	// active. The call that hit the failure still returns an error, one
+	// that matches ErrDeviceReset, unless nothing had been sent yet. Get and
+	// Put resume the transfer instead where they can.
+	AutoReconnect bool
+	// ReconnectAttempts defaults to DefaultReconnectAttempts.
+	ReconnectAttempts int
+	// ReconnectDelay is the wait before each attempt and defaults to
+	// DefaultReconnectDelay.
+	ReconnectDelay time.Duration
+	// OnReconnect is called before each reconnect attempt when set.
+	OnReconnect func(attempt int, err error)
+	// MaxIdleReads sets Repl.MaxIdleReads. Zero uses DefaultMaxIdleReads and
+	// a negative value waits forever.
+	MaxIdleReads int
+	// ResponseTimeout sets Repl.ResponseTimeout.
+	ResponseTimeout time.Duration
+	// NoCompress sets Repl.NoCompress.
+	NoCompress bool
+	// Retries sets Repl.Retries.
+	Retries int
+	// NoHelper sets Repl.NoHelper.
+	NoHelper bool
+	// ChunkSize sets Repl.ChunkSize.
+	ChunkSize int
+	// RawBanner, SoftRebootMarker and Prompt set the sentinels of the Repl.
+	RawBanner        []byte
+	SoftRebootMarker []byte
+	Prompt           []byte
+	// Debug sets Repl.Debug. The reads and writes of the connection are only
+	// logged when it's set here.
+	Debug io.Writer
+	// NoInterrupt leaves code running on the device alone instead of
+	// stopping it with ctrl-C on connect, and sets Repl.NoInterrupt. Call
+	// Interrupt to stop it later.
+	NoInterrupt bool
+	// RawModeTimeout sets Repl.RawModeTimeout.
+	RawModeTimeout time.Duration
+}
+
+// ConnectOption changes a setting of the connection opened by Connect.
+type ConnectOption func(*ConnectOptions)
+
+// WithPortTimeout sets the serial read timeout, see
+// ConnectOptions.ReadTimeout. It's applied again whenever the port is
+// reopened.
+func WithPortTimeout(d time.Duration) ConnectOption {
+	return func(o *ConnectOptions) {
+		o.ReadTimeout = d
+	}
+}
+
+// WithNoInterrupt connects without stopping code running on the device, see
+// ConnectOptions.NoInterrupt.
+func WithNoInterrupt() ConnectOption {
+	return func(o *ConnectOptions) {
+		o.NoInterrupt = true
+	}
+}
+
+// Connect opens a connection to the serial port and returns Repl instance.
+func Connect(device string, baud int, options ...ConnectOption) (*Repl, error) {
+	opts := ConnectOptions{
+		Device: device,
+		Baud:   baud,
+	}
+	for _, o := range options {
+		o(&opts)
+	}
+	return ConnectWithOptions(opts)
+}
+
+// ConnectWithOptions opens a connection to the serial port described by opts
+// and returns Repl instance.
+func ConnectWithOptions(opts ConnectOptions) (*Repl, error) {
+	opts = opts.withDefaults()
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	idle := opts.MaxIdleReads
+	if idle < 0 {
+		idle = 0
+	}
+	r := &Repl{
+		MaxIdleReads:     idle,
+		ResponseTimeout:  opts.ResponseTimeout,
+		NoCompress:       opts.NoCompress,
+		Retries:          opts.Retries,
+		NoHelper:         opts.NoHelper,
+		ChunkSize:        opts.ChunkSize,
+		RawBanner:        opts.RawBanner,
+		SoftRebootMarker: opts.SoftRebootMarker,
+		Prompt:           opts.Prompt,
+		Debug:            opts.Debug,
+		NoInterrupt:      opts.NoInterrupt,
+		RawModeTimeout:   opts.RawModeTimeout,
+		readTimeout:      opts.ReadTimeout,
+		opts:             opts,
+	}
+	p, err := openPort(opts)
+	if err != nil {
+		return nil, err
+	}
+	var dp *debugPort
+	if opts.Debug != nil {
+		dp = &debugPort{Port: p, w: &r.Debug, start: time.Now()}
+		p = dp
+	}
+	err = flushInput(p, opts.ReadTimeout)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	if !opts.NoInterrupt {
+		// send ctrl-C twice to stop any running code
+		_, err = p.Write([]byte("\r\x03\x03"))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if opts.AutoReconnect {
+		// reconnect beneath the dump so it carries on with the new port
+		if dp != nil {
+			dp.Port = newReconnectPort(dp.Port, opts)
+		} else {
+			p = newReconnectPort(p, opts)
+		}
+	}
+	r.Port = p
+	return r, nil
+}
+
+// probeTimeout is how long DetectBaud waits for the raw REPL at each rate.
+const probeTimeout = time.Second * 2
+
+// DetectBaud tries each baudrate in candidates in order and returns the first
+// one at which the device enters raw mode.
+func DetectBaud(device string, candidates []int) (int, error) {
+	return DetectBaudWithOptions(ConnectOptions{Device: device}, candidates)
+}
+
+// DetectBaudWithOptions is DetectBaud for a port described by opts. The Baud
+// field of opts is ignored.
+func DetectBaudWithOptions(opts ConnectOptions, candidates []int) (int, error) {
+	var lastErr error
+	opts.AutoReconnect = false
+	for _, baud := range candidates {
+		opts.Baud = baud
+		r, err := ConnectWithOptions(opts)
+		if err != nil {
+			// the OS may not support every rate
+			lastErr = err
+			continue
+		}
+		err = r.enterRawMode(time.Now().Add(probeTimeout))
+		if err == nil {
+			r.ExitRawMode()
+		}
+		r.Close()
+		if err == nil {
+			return baud, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return 0, errors.New("no baudrates to try")
+	}
+	return 0, fmt.Errorf("device didn't answer at any baudrate in %v: %v", candidates, lastErr)
+}
+
+// Read reads directly from the serial port. A read that times out without any
+// data returns io.EOF so standard readers stop once the device goes quiet
+// instead of spinning on empty reads.
+func (r *Repl) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := r.readPort(p)
+	if n == 0 && err == nil {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// ReadOutput reads device output for passing it through, like a terminal
+// does. It starts with output that an earlier command read past the end of
+// its response, which reading Port directly would lose. Unlike Read, a read
+// that times out without any data returns zero bytes and no error.
+func (r *Repl) ReadOutput(p []byte) (int, error) {
+	return r.readPort(p)
+}
+
+// Write writes directly to the serial port.
+func (r *Repl) Write(p []byte) (int, error) {
+	return r.Port.Write(p)
+}
+
+// ErrTimeout is returned when the device doesn't answer in time.
+var ErrTimeout = errors.New("timed out waiting for device")
+
+// ReadUntil reads from the Repl until the ending byte string is found. If w is
+// supplied it'll Write data there instead of accumulating it.
+func (r *Repl) ReadUntil(ending []byte, w io.Writer) ([]byte, error) {
+	return r.readUntil(ending, w, time.Time{})
+}
+
+// readUntil is ReadUntil giving up with ErrTimeout once deadline passes. A
+// zero deadline waits forever, or for ResponseTimeout when that's set.
+func (r *Repl) readUntil(ending []byte, w io.Writer, deadline time.Time) ([]byte, error) {
+	deadline = r.responseDeadline(deadline)
+	b := make([]byte, readBlockSize)
+	m := newMatcher(ending)
+	// data is everything read when w is nil, the ending once it's found
+	// otherwise
+	var data []byte
+	idle := 0
+	for {
+		n, err := r.readPort(b)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// read timed out without data
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return data, ErrTimeout
+			}
+			idle++
+			if r.MaxIdleReads > 0 && idle >= r.MaxIdleReads {
+				return data, fmt.Errorf("%w: nothing received in %d reads", ErrTimeout, idle)
+			}
+			continue
+		}
+		idle = 0
+		chunk := b[:n]
+		i := m.feed(chunk)
+		found := i >= 0
+		if found {
+			r.unread(chunk[i:])
+			chunk = chunk[:i]
+		}
+		if w == nil {
+			data = append(data, chunk...)
+		} else if found {
+			data = append(data, ending...)
+		}
+		if w != nil {
+			_, err = w.Write(bytes.Replace(chunk, []byte{0x04}, nil, -1))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if found {
+			return data, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return data, ErrTimeout
+		}
+	}
+}
+
+// responseDeadline returns deadline, or ResponseTimeout from now when that's
+// sooner or deadline is zero.
+func (r *Repl) responseDeadline(deadline time.Time) time.Time {
+	if r.ResponseTimeout > 0 {
+		d := time.Now().Add(r.ResponseTimeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			return d
+		}
+	}
+	return deadline
+}
+
+// readBlockSize is how much is asked of the port per read.
+const readBlockSize = 256
+
+// unread puts b back in front of what readPort returns next.
+func (r *Repl) unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	r.pending = append(append([]byte{}, b...), r.pending...)
+}
+
+// readPort reads from Port into b, starting with what was unread. Some drivers report a read that times out
+// without data as io.EOF instead of zero bytes, so an io.EOF that comes after
+// waiting out most of the read timeout is returned as zero bytes. One that
+// comes right away means the port is gone.
+func (r *Repl) readPort(b []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(b, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	start := time.Now()
+	n, err := r.Port.Read(b)
+	if n == 0 && err == io.EOF && r.readTimeout > 0 && time.Since(start) >= r.readTimeout/2 {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Sentinels of upstream MicroPython, used unless the Repl sets its own.
+var (
+	// DefaultRawBanner is printed by the device when it enters the raw REPL.
+	DefaultRawBanner = []byte("raw REPL; CTRL-B to exit\r\n")
+	// DefaultSoftRebootMarker is printed by the device when it soft reboots.
+	DefaultSoftRebootMarker = []byte("soft reboot\r\n")
+	// DefaultPrompt is printed by the raw REPL when it's ready for code.
+	DefaultPrompt = []byte(">")
+)
+
+// orDefault returns b, or def when b is empty.
+func orDefault(b, def []byte) []byte {
+	if len(b) == 0 {
+		return def
+	}
+	return b
+}
+
+func (r *Repl) rawBanner() []byte {
+	return orDefault(r.RawBanner, DefaultRawBanner)
+}
+
+func (r *Repl) softRebootMarker() []byte {
+	return orDefault(r.SoftRebootMarker, DefaultSoftRebootMarker)
+}
+
+func (r *Repl) prompt() []byte {
+	return orDefault(r.Prompt, DefaultPrompt)
+}
+
+// ErrInterrupt is returned when code running on the device doesn't stop for
+// ctrl-C.
+var ErrInterrupt = errors.New("could not interrupt running program")
+
+// ErrBusy is returned by EnterRawMode with NoInterrupt set when the code
+// running on the device doesn't finish in time.
+var ErrBusy = errors.New("device is still running a program, not interrupting it")
+
+// Code busy in a tight loop can miss a ctrl-C, so EnterRawMode and
+// Interrupt send it up to interruptAttempts times, waiting
+// InterruptTimeout/interruptAttempts for the prompt after each.
+const (
+	interruptAttempts = 5
+	interruptSettle   = time.Millisecond * 100
+)
+
+// EnterRawMode will send ctrl-A to Repl to enter raw terminal mode. When the
+// device doesn't answer it sends ctrl-C to stop any running code and tries
+// again a few times, for RawModeTimeout in all, before giving up with
+// ErrInterrupt. With NoInterrupt it only tries again, giving the code time to
+// finish, and then gives up with ErrBusy. A device that sends something but
+// never a prompt or banner of MicroPython, even after ctrl-C, isn't taken
+// for MicroPython, it fails with a *NotMicroPythonError. The
+// first time it succeeds it probes the device for Capabilities.
+func (r *Repl) EnterRawMode() error {
+	err := r.enterRawModeRetrying()
+	if err != nil {
+		return err
+	}
+	r.probeCaps()
+	return nil
+}
+
+// enterRawModeRetrying is EnterRawMode without probing Capabilities.
+func (r *Repl) enterRawModeRetrying() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timeout := r.RawModeTimeout
+	if timeout == 0 {
+		timeout = InterruptTimeout
+	}
+	wait := timeout / interruptAttempts
+	// received is the start of what the device sent instead of the banner
+	var received []byte
+	// last is what the device sent during the last attempt
+	var last []byte
+	// micropython is set once something received looks like MicroPython
+	micropython := false
+	for i := 0; i < interruptAttempts; i++ {
+		if i > 0 && !r.NoInterrupt {
+			// ctrl-C twice: try to break into running code
+			_, err := r.Port.Write([]byte("\r\x03\x03"))
+			if err != nil {
+				return err
+			}
+			time.Sleep(interruptSettle)
+		}
+		data, err := r.enterRawModeLocked(time.Now().Add(wait))
+		if !errors.Is(err, ErrTimeout) {
+			return err
+		}
+		received = appendReceived(received, data)
+		micropython = micropython || r.looksLikeMicroPython(data)
+		if len(data) > 0 {
+			last = data
+		}
+		if i == 0 && !r.NoInterrupt {
+			// MicroPython answers a blank line with its prompt, unless a
+			// program is running, which the blank line would be input to
+			data, err = r.probePrompt()
+			if err != nil {
+				return err
+			}
+			received = appendReceived(received, data)
+			micropython = micropython || r.looksLikeMicroPython(data)
+			if len(data) > 0 {
+				last = data
+			}
+		}
+	}
+	if r.NoInterrupt {
+		// a program left running can print anything
+		return ErrBusy
+	}
+	// a running program can print anything too, but not after ctrl-C
+	// stopped it, so only a device that never showed a prompt or banner
+	// is on the wrong port, unless it left off at a prompt after all
+	if len(received) > 0 && !micropython && replStateOf(last, r.rawBanner()) == StateUnknown {
+		return &NotMicroPythonError{Received: received}
+	}
+	// say what the device is doing instead, without poking a program
+	// that's left to run with NoInterrupt
+	return r.stateError(ErrInterrupt, last)
+}
+
+// promptProbeTimeout is how long probePrompt waits for the friendly prompt.
+const promptProbeTimeout = time.Millisecond * 500
+
+// probePrompt sends a blank line and returns what came back until the
+// friendly prompt or promptProbeTimeout.
+func (r *Repl) probePrompt() ([]byte, error) {
+	_, err := r.Port.Write([]byte("\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.readUntil(friendlyPrompt, nil, time.Now().Add(promptProbeTimeout))
+	if errors.Is(err, ErrTimeout) {
+		err = nil
+	}
+	return data, err
+}
+
+// maxReceived is how much of what a device sent instead of the raw REPL
+// banner EnterRawMode keeps for its error.
+const maxReceived = 256
+
+// looksLikeMicroPython reports whether data holds one of the prompts or
+// banners of MicroPython, or the traceback of an interrupted program.
+func (r *Repl) looksLikeMicroPython(data []byte) bool {
+	markers := [][]byte{
+		friendlyPrompt,
+		continuationPrompt,
+		pasteBanner,
+		bytes.TrimRight(r.rawBanner(), "\r\n"),
+		[]byte("MicroPython"),
+		[]byte("KeyboardInterrupt"),
+	}
+	for _, m := range markers {
+		if bytes.Contains(data, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendReceived(received, data []byte) []byte {
+	if n := maxReceived - len(received); len(data) > n {
+		data = data[:n]
+	}
+	return append(received, data...)
+}
+
+// enterRawMode is a single EnterRawMode attempt giving up with ErrTimeout
+// once deadline passes. A zero deadline waits forever.
+func (r *Repl) enterRawMode(deadline time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.enterRawModeLocked(deadline)
+	return err
+}
+
+// enterRawModeLocked returns what was read while waiting for the banner.
+func (r *Repl) enterRawModeLocked(deadline time.Time) ([]byte, error) {
+	// ctrl-A: enter raw REPL
+	_, err := r.Port.Write([]byte("\r\x01"))
+	if err != nil {
+		return nil, err
+	}
+	return r.readUntil(r.rawBanner(), nil, deadline)
+}
+
+// exitTimeout bounds how long ExitRawMode waits for the friendly prompt.
+const exitTimeout = time.Second
+
+// friendlyPrompt is printed by the friendly REPL when it's ready for input.
+var friendlyPrompt = []byte(">>> ")
+
+// ExitRawMode returns the device to the friendly REPL. After a failure the
+// raw REPL may be left with half sent code or a command still running, so it
+// sends ctrl-C before ctrl-B and then reads until the friendly prompt, which
+// is consumed. Firmware that doesn't print the usual prompt only costs
+// exitTimeout.
+func (r *Repl) ExitRawMode() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// ctrl-C: abort pending code, ctrl-B: enter friendly REPL
+	_, err := r.Port.Write([]byte("\x03\x02"))
+	if err != nil {
+		return err
+	}
+	_, err = r.readUntil(friendlyPrompt, nil, time.Now().Add(exitTimeout))
+	if errors.Is(err, ErrTimeout) {
+		return nil
+	}
+	return err
+}
+
+// AwaitPrompt reads until the friendly prompt and returns everything read,
+// prompt included. After timeout it gives up with ErrTimeout, still
+// returning what was read.
+func (r *Repl) AwaitPrompt(timeout time.Duration) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readUntil(friendlyPrompt, nil, time.Now().Add(timeout))
+}
+
+// InterruptTimeout is how long Interrupt and EnterRawMode wait for the
+// prompt in total.
+const InterruptTimeout = time.Second * 5
+
+// Interrupt sends ctrl-C to stop any running code and waits for the
+// friendly REPL prompt to confirm the interrupt was received. Like
+// EnterRawMode it tries a few times before giving up with ErrInterrupt. It
+// works the same with NoInterrupt set, which only affects Connect and
+// EnterRawMode.
+func (r *Repl) Interrupt() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wait := InterruptTimeout / interruptAttempts
+	for i := 0; i < interruptAttempts; i++ {
+		// ctrl-C twice: interrupt running code
+		_, err := r.Port.Write([]byte("\r\x03\x03"))
+		if err != nil {
+			return err
+		}
+		_, err = r.readUntil([]byte(">>> "), nil, time.Now().Add(wait))
+		if !errors.Is(err, ErrTimeout) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: no >>> prompt", ErrInterrupt)
+}
+
+// InterruptRunning is the same as Interrupt.
+//
+// Deprecated: use Interrupt.
+func (r *Repl) InterruptRunning() error {
+	return r.Interrupt()
+}
+
+// SoftReboot will send ctrl-D to Repl to perform a soft reboot.
+func (r *Repl) SoftReboot() error {
+	r.forgetHelper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.Port.Write([]byte("\x04"))
+	if err != nil {
+		return err
+	}
+	_, err = r.ReadUntil(r.softRebootMarker(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = r.ReadUntil(r.rawBanner(), nil)
+	return err
+}
+
+// runMainCode runs main.py the way the friendly REPL does after a reboot.
+const runMainCode = `try:
+	f = open('main.py')
+except OSError:
+	f = None
+if f:
+	c = f.read()
+	f.close()
+	del f
+	exec(c, {'__name__': '__main__'})
+`
+
+// SoftRebootAndFollow performs a soft reboot and then runs main.py from the
+// fresh raw REPL, streaming its output to w. The raw REPL doesn't run main.py
+// by itself after a reboot. It returns when main.py finishes or with the error
+// it raised. Cancelling ctx interrupts main.py.
+func (r *Repl) SoftRebootAndFollow(ctx context.Context, w io.Writer) error {
+	err := r.SoftReboot()
+	if err != nil {
+		return err
+	}
+	defer r.interruptOnCancel(ctx)()
+	_, err = r.Exec([]byte(runMainCode), w)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// RebootAndStream leaves raw mode and soft reboots from the normal REPL, so
+// the device runs boot.py and main.py like it does at power on, then copies
+// everything it prints to w until ctx is cancelled. Code still running then
+// is left alone.
+func (r *Repl) RebootAndStream(ctx context.Context, w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forgetHelper()
+	// ctrl-B: leave raw mode, ctrl-C: drop anything typed, ctrl-D: reboot
+	_, err := r.Port.Write([]byte("\x02\r\x03\x04"))
+	if err != nil {
+		return err
+	}
+	if !r.RawOutput {
+		cw := &crlfWriter{w: w}
+		defer cw.Flush()
+		w = cw
+	}
+	b := make([]byte, 256)
+	for ctx.Err() == nil {
+		n, err := r.readPort(b)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			_, err = w.Write(b[:n])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// interruptOnCancel sends ctrl-C to the device if ctx is cancelled before the
+// returned stop function is called.
+func (r *Repl) interruptOnCancel(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// ctrl-C: interrupt running code
+			r.Port.Write([]byte("\x03"))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// ExecRaw will execute code without following the results. Use Exec to keep
+// the whole exchange atomic when the Repl is shared between goroutines.
+func (r *Repl) ExecRaw(code []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.execRaw(code)
+}
+
+func (r *Repl) execRaw(code []byte) error {
+	// the raw REPL doesn't need to have printed its > prompt yet, input is
+	// buffered until ctrl-D, so drop anything left over instead of waiting
+	err := r.drain()
+	if err != nil {
+		return err
+	}
+	if r.rawPaste || r.probePaste {
+		r.probePaste = false
+		ok, err := r.pasteRaw(code)
+		if err != nil {
+			return err
+		}
+		r.rawPaste = ok
+		if ok {
+			return nil
+		}
+	}
+	_, err = r.Port.Write(code)
+	if err != nil {
+		return err
+	}
+	_, err = r.Port.Write([]byte("\x04"))
+	if err != nil {
+		return err
+	}
+	// skip a late > prompt or other stray bytes in front of the OK
+	_, err = r.readUntil([]byte("OK"), nil, time.Now().Add(okTimeout))
+	if errors.Is(err, ErrTimeout) {
+		return errors.New("could not exec command")
+	}
+	return err
+}
+
+const (
+	// okTimeout bounds the wait for the raw REPL to acknowledge code.
+	okTimeout = time.Second * 5
+	// drainTimeout is the quiet period that ends draining stale input.
+	drainTimeout = time.Millisecond * 10
+	// drainLimit stops draining a device that never goes quiet.
+	drainLimit = time.Second
+)
+
+// drain discards input that's already waiting so it can't be mistaken for the
+// response to the next command.
+func (r *Repl) drain() error {
+	t := r.readTimeout
+	if t == 0 {
+		t = DefaultReadTimeout
+	}
+	r.pending = nil
+	return drainPort(r.Port, t)
+}
+
+// drainPort reads and discards input from p until it's quiet for
+// drainTimeout, then sets the read timeout of p back to readTimeout.
+func drainPort(p Port, readTimeout time.Duration) error {
+	err := p.SetReadTimeout(drainTimeout)
+	if err != nil {
+		return err
+	}
+	defer p.SetReadTimeout(readTimeout)
+	b := make([]byte, 256)
+	deadline := time.Now().Add(drainLimit)
+	for time.Now().Before(deadline) {
+		n, err := p.Read(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// inputResetter is implemented by serial ports that can discard what the
+// OS has buffered in one call.
+type inputResetter interface {
+	ResetInputBuffer() error
+}
+
+// flushInput discards bytes left in the receive buffer of a freshly opened
+// p, e.g. by an earlier session, so they aren't taken for a banner.
+func flushInput(p Port, readTimeout time.Duration) error {
+	if ir, ok := p.(inputResetter); ok {
+		err := ir.ResetInputBuffer()
+		if err != nil {
+			return err
+		}
+	}
+	return drainPort(p, readTimeout)
+}
+
+// Follow will read the response data and/or error from executing code. Only
+// the output itself is returned, without the raw REPL framing, and "\r\n" is
+// turned into "\n" unless RawOutput is set.
+func (r *Repl) Follow(w io.Writer) ([]byte, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.follow(w)
+}
+
+func (r *Repl) follow(w io.Writer) ([]byte, []byte, error) {
+	return r.followBoth(w, nil)
+}
+
+// ExecResult is the outcome of code executed with Repl.ExecResult.
+type ExecResult struct {
+	// Stdout is the output of the code unless it was passed to a writer.
+	Stdout []byte
+	// Stderr is the error output of the code unless it was passed to a
+	// writer.
+	Stderr []byte
+	// Exception is the exception the code raised, if any.
+	Exception *MicroPythonError
+}
+
+// ExecResult will execute code and return both its output and the exception
+// it raised, if any. Output is passed to stdout and stderr when they aren't
+// nil. The error is only set when talking to the device failed.
+func (r *Repl) ExecResult(code []byte, stdout, stderr io.Writer) (ExecResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.execResult(code, stdout, stderr)
+}
+
+func (r *Repl) execResult(code []byte, stdout, stderr io.Writer) (ExecResult, error) {
+	var res ExecResult
+	err := r.execRaw(code)
+	if err != nil {
+		return res, err
+	}
+	var tb bytes.Buffer
+	errw := io.Writer(&tb)
+	if stderr != nil {
+		errw = io.MultiWriter(stderr, &tb)
+	}
+	data, _, err := r.followBoth(stdout, errw)
+	if err != nil {
+		return res, err
+	}
+	if stdout == nil {
+		res.Stdout = data
+	}
+	if stderr == nil {
+		res.Stderr = tb.Bytes()
+	}
+	res.Exception = parseException(tb.Bytes())
+	return res, nil
+}
+
+// Exec will execute code and read the response or error. If w is supplied it
+// will call Write to pass the data instead of accumulating it. Output from
+// before an exception is dropped, see ExecCapture to keep it.
+func (r *Repl) Exec(code []byte, w io.Writer) ([]byte, error) {
+	if w == nil {
+		stdout, _, err := r.ExecCapture(code)
+		if err != nil {
+			return nil, err
+		}
+		return stdout, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res, err := r.execResult(code, w, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.Exception != nil {
+		return nil, exceptionError(res.Exception)
+	}
+	return res.Stdout, nil
+}
+
+// ExecCapture will execute code and return everything it printed to stdout
+// and stderr, including the output from before an exception. The error is
+// the one Exec would return, so a *MicroPythonError (or *ExitCodeError for
+// SystemExit) when the code raised.
+func (r *Repl) ExecCapture(code []byte) ([]byte, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res, err := r.execResult(code, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Exception != nil {
+		return res.Stdout, res.Stderr, exceptionError(res.Exception)
+	}
+	return res.Stdout, res.Stderr, nil
+}
+
+// execChunkSize is roughly how much code ExecFile sends per raw REPL
+// submission so large scripts don't exhaust the device's paste buffer.
+const execChunkSize = 4096
+
+// ExecFile executes the local Python file at path on the device without
+// writing it to the device filesystem. Output is streamed to w and errors
+// raised by the script are returned. Cancelling ctx interrupts the script.
+func (r *Repl) ExecFile(ctx context.Context, path string, w io.Writer) error {
+	code, err := r.readLocalFile(path)
+	if err != nil {
+		return err
+	}
+	return r.execChunks(ctx, splitStatements(code, execChunkSize), w)
+}
+
+// RunFileArgs is ExecFile with sys.argv set to the script path followed by
+// args, so parameterized scripts can be reused.
+func (r *Repl) RunFileArgs(ctx context.Context, path string, args []string, w io.Writer) error {
+	code, err := r.readLocalFile(path)
+	if err != nil {
+		return err
+	}
+	argv := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{path}, args...) {
+		argv = append(argv, pyString(a))
+	}
+	setArgv := []byte("import sys\nsys.argv = [" + strings.Join(argv, ", ") + "]")
+	chunks := append([][]byte{setArgv}, splitStatements(code, execChunkSize)...)
+	return r.execChunks(ctx, chunks, w)
+}
+
+// execChunks executes each chunk in turn, stopping at the first error.
+func (r *Repl) execChunks(ctx context.Context, chunks [][]byte, w io.Writer) error {
+	defer r.interruptOnCancel(ctx)()
+	for _, chunk := range chunks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, err := r.Exec(chunk, w)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitStatements splits Python code into chunks of about size bytes. Chunks
+// only end at a blank line followed by an unindented line so every chunk
+// holds complete top-level statements. A statement longer than size is
+// kept whole.
+func splitStatements(code []byte, size int) [][]byte {
+	lines := bytes.SplitAfter(code, []byte("\n"))
+	var chunks [][]byte
+	var chunk []byte
+	blank := false
+	for _, line := range lines {
+		trimmed := bytes.TrimSpace(line)
+		top := len(trimmed) > 0 && line[0] != ' ' && line[0] != '\t'
+		if blank && top && len(chunk) >= size {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		chunk = append(chunk, line...)
+		blank = len(trimmed) == 0
+	}
+	if len(bytes.TrimSpace(chunk)) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Cat writes the remote file f to w byte for byte. It's sent base64 encoded
+// like Get, so binary files arrive intact.
+func (r *Repl) Cat(w io.Writer, f string) error {
+	_, err := r.Get(w, f)
+	return err
+}
+
+// catMultipleCode sends each of FILES as a tab separated line: f and its
+// index when it's opened, then d and base64 encoded data for its contents,
+// or e, its index and the OSError when it can't be opened.
+const catMultipleCode = `from ubinascii import b2a_base64
+for _i, _p in enumerate(FILES):
+	try:
+		_f = open(_p, 'rb')
+	except OSError as _e:
+		print('e\t%d\t%s' % (_i, _e))
+		continue
+	print('f\t%d' % _i)
+	while True:
+		_b = _f.read(192)
+		if not _b:
+			break
+		print('d\t' + str(b2a_base64(_b), 'ascii'), end='')
+	_f.close()
+`
+
+// CatError is returned by CatMultiple when some of the files couldn't be
+// read.
+type CatError struct {
+	// Errors has an error for each of those files, in order, starting with
+	// its name and wrapping the OSError raised for it.
+	Errors []error
+}
+
+func (e *CatError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// CatMultiple writes the remote files to w one after the other, in a single
+// exchange. A file that can't be opened is skipped, the others are still
+// written and a *CatError lists what was skipped.
+func (r *Repl) CatMultiple(w io.Writer, files ...string) error {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = pyString(f)
+	}
+	code := strings.Replace(catMultipleCode, "FILES", "["+strings.Join(names, ", ")+"]", 1)
+	var errs []error
+	lw := &lineWriter{w: ioutil.Discard}
+	lw.fn = func(line []byte) error {
+		parts := strings.SplitN(strings.TrimSuffix(string(line), "\r"), "\t", 3)
+		switch {
+		case parts[0] == "d" && len(parts) == 2:
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return fmt.Errorf("corrupted cat data: %v", err)
+			}
+			_, err = w.Write(b)
+			return err
+		case parts[0] == "f" && len(parts) == 2:
+			return nil
+		case parts[0] == "e" && len(parts) == 3:
+			i, err := strconv.Atoi(parts[1])
+			if err != nil || i < 0 || i >= len(files) {
+				break
+			}
+			e := parseException([]byte("OSError: " + parts[2]))
+			errs = append(errs, fmt.Errorf("%s: %w", files[i], e))
+			return nil
+		}
+		return fmt.Errorf("unexpected cat output %q", line)
+	}
+	_, err := r.Exec([]byte(code), lw)
+	if err == nil {
+		err = lw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &CatError{Errors: errs}
+	}
+	return nil
+}
+
+// CatText writes the remote text file f to w as printed by the device, with
+// "\r\n" turned into "\n" unless RawOutput is set.
+func (r *Repl) CatText(w io.Writer, f string) error {
+	code := []byte(`with open(` + pyString(f) + `) as f:
+	while True:
+		b = f.read(256)
+		if not b:
+			break
+		print(b, end='')`)
+	_, err := r.Exec(code, w)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Cd changes the current working directory
+func (r *Repl) Cd(d string) error {
+	code := []byte(osImport + "uos.chdir(" + pyString(d) + ")")
+	_, err := r.Exec(code, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TransferFunc is called by Upload and Download for every file they copy. It
+// is called with nil stats before the transfer starts and again with the
+// stats of the file once it finished.
+type TransferFunc func(name string, stats *TransferStats)
+
+// Download copies all files from the current directory of the MicroPython
+// device to the local directory dir. If fn isn't nil it's called for each file.
+func (r *Repl) Download(dir string, fn TransferFunc) (TransferStats, error) {
+	var total TransferStats
+	fs, err := r.Ls()
+	if err != nil {
+		return total, err
+	}
+	for _, name := range fs {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		if fn != nil {
+			fn(name, nil)
+		}
+		stats, err := r.GetFile(filepath.Join(dir, name), name)
+		if err != nil {
+			return total, err
+		}
+		if fn != nil {
+			fn(name, &stats)
+		}
+		total = total.Add(stats)
+	}
+	return total, nil
+}
+
+// GetFile copies the file src from the MicroPython device to the local file
+// dst, creating the parent directories of dst if they're missing.
+func (r *Repl) GetFile(dst, src string) (TransferStats, error) {
+	err := r.local().MkdirAll(filepath.Dir(dst))
+	if err != nil {
+		return TransferStats{}, err
+	}
+	f, err := r.local().Create(dst)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	stats, err := r.Get(f, src)
+	cerr := f.Close()
+	if err != nil {
+		return stats, err
+	}
+	return stats, cerr
+}
+
+// ReadFile returns the contents of the remote file path, copied like Get so
+// binary files come through unchanged. The whole file is held in memory, so
+// use Get with a local file for anything too big for that.
+func (r *Repl) ReadFile(path string) ([]byte, error) {
+	b := &bytes.Buffer{}
+	_, err := r.Get(b, path)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteFile replaces the remote file path with data, copied like Put. The
+// device only ever holds one chunk of it at a time, but data itself has to
+// fit in memory on the host, so use Put with a reader for large files.
+func (r *Repl) WriteFile(path string, data []byte) error {
+	_, err := r.Put(path, bytes.NewReader(data))
+	return err
+}
+
+// Get copies the file src from the MicroPython device to w.
+func (r *Repl) Get(w io.Writer, src string) (TransferStats, error) {
+	var stats TransferStats
+	compress := r.compression().compress
+	open := func() error {
+		code := "f=open(" + pyString(src) + ",'rb')\n"
+		if r.useHelper() {
+			code += "g=_zap.get\n"
+		} else {
+			code += getChunkDefs
+		}
+		if compress {
+			code = "import deflate, io\n" + code
+		}
+		_, err := r.Exec([]byte(code), nil)
+		return err
+	}
+	err := open()
+	if err != nil {
+		return stats, err
+	}
+	size := r.chunkSize(compress)
+	start := time.Now()
+	resumes := 0
+	for {
+		x, eof, err := r.getBatch(stats.Bytes, size, getBatchChunks, compress)
+		if errors.Is(err, ErrDeviceReset) && resumes < maxResumes {
+			// chunks are read at their offset, so opening the file again
+			// is enough to carry on
+			resumes++
+			r.forgetHelper()
+			err = open()
+			if err == nil {
+				continue
+			}
+		}
+		if err == nil && len(x) > 0 {
+			_, err = w.Write(x)
+		}
+		if err != nil {
+			r.Exec([]byte("f.close()"), nil)
+			return stats, err
+		}
+		stats.Bytes += int64(len(x))
+		if eof {
+			break
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	_, err = r.Exec([]byte("f.close()"), nil)
+	if err != nil {
+		return stats, err
+	}
+	if compress {
+		err = r.checkSize(src, stats.Bytes)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// ReadRange reads n bytes of the remote file path starting at off, or
+// everything from off on when n is negative. Only that window crosses the
+// serial link. Reading past the end of the file returns what's there, if
+// anything.
+func (r *Repl) ReadRange(path string, off, n int64) ([]byte, error) {
+	code := `from ubinascii import b2a_base64
+with open(` + pyString(path) + `, 'rb') as f:
+	f.seek(` + strconv.FormatInt(off, 10) + `)
+	n = ` + strconv.FormatInt(n, 10) + `
+	while n != 0:
+		b = f.read(512 if n < 0 else min(512, n))
+		if not b:
+			break
+		print(str(b2a_base64(b), 'ascii').strip())
+		if n > 0:
+			n -= len(b)
+`
+	var b bytes.Buffer
+	_, err := r.Exec([]byte(code), &b)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, line := range strings.Fields(b.String()) {
+		x, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, x...)
+	}
+	return data, nil
+}
+
+// DiskFree returns the number of bytes available on the filesystem holding
+// the current directory. Ports without uos.statvfs return ErrUnsupported.
+func (r *Repl) DiskFree() (int64, error) {
+	caps := r.Capabilities()
+	if caps.Probed && !caps.Statvfs {
+		return 0, ErrUnsupported
+	}
+	code := []byte(osImport + "s=uos.statvfs('.')\nprint(s[1]*s[4],end='')")
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(b.String(), 10, 64)
+}
+
+// ErrUnsupported is returned when the port lacks a feature.
+var ErrUnsupported = errors.New("not supported by this port")
+
+// epoch2000 is the Unix time of 2000-01-01, the epoch of time on most
+// MicroPython ports. Others count from 1970 like Unix.
+const epoch2000 = 946684800
+
+// epoch returns the Unix time of the epoch the device counts time from. It's
+// asked once per connection.
+func (r *Repl) epoch() (int64, error) {
+	r.epochMu.Lock()
+	defer r.epochMu.Unlock()
+	if r.epochKnown {
+		return r.epochOffset, nil
+	}
+	code := []byte("import utime\nprint(utime.gmtime(0)[0],end='')")
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
+	if err != nil {
+		return 0, err
+	}
+	if b.String() == "2000" {
+		r.epochOffset = epoch2000
+	}
+	r.epochKnown = true
+	return r.epochOffset, nil
 }
 
-// Connect opens a connection to the serial port and returns Repl instance.
-func Connect(device string, baud int) (*Repl, error) {
-	c := &serial.Config{
-		Name:        device,
-		Baud:        baud,
-		ReadTimeout: time.Millisecond * 500,
+// Mtime returns the modification time of a file on the device, or the zero
+// time when the device doesn't keep one.
+func (r *Repl) Mtime(path string) (time.Time, error) {
+	epoch, err := r.epoch()
+	if err != nil {
+		return time.Time{}, err
 	}
-	p, err := serial.OpenPort(c)
+	code := []byte(osImport + "print(uos.stat(" + pyString(path) + ")[8],end='')")
+	b := &strings.Builder{}
+	_, err = r.Exec(code, b)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	// send ctrl-C twice to stop any running code
-	_, err = p.Write([]byte("\r\x03\x03"))
+	sec, err := strconv.ParseInt(b.String(), 10, 64)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	r := &Repl{
-		Port: p,
+	if sec == 0 {
+		// boards without a clock report the epoch itself
+		return time.Time{}, nil
 	}
-	return r, nil
+	return time.Unix(sec+epoch, 0), nil
 }
 
-// ReadUntil reads from the Repl until the ending byte string is found. If w is
-// supplied it'll Write data there instead of accumulating it.
-func (r *Repl) ReadUntil(ending []byte, w io.Writer) ([]byte, error) {
-	b := make([]byte, 1)
-	data := make([]byte, 0, 1024)
-	for {
-		_, err := r.Port.Read(b)
-		if err != nil {
-			return nil, err
-		}
-		if w == nil {
-			data = append(data, b[0])
-		} else {
-			if b[0] != 0x04 {
-				_, err = w.Write(b)
-				if err != nil {
-					return nil, err
-				}
-			}
-			data = b
-		}
-		if bytes.HasSuffix(data, ending) {
-			return data, nil
-		}
+// SetMtime sets the modification time of a file on the device. Ports without
+// uos.utime return ErrUnsupported. Times before the epoch of the device are
+// clamped to it, and FAT filesystems round them to 2 seconds.
+func (r *Repl) SetMtime(path string, t time.Time) error {
+	caps := r.Capabilities()
+	if caps.Probed && !caps.Utime {
+		return ErrUnsupported
 	}
-}
-
-// EnterRawMode will send ctrl-A to Repl to enter raw terminal mode.
-func (r *Repl) EnterRawMode() error {
-	// ctrl-A: enter raw REPL
-	_, err := r.Port.Write([]byte("\r\x01"))
+	epoch, err := r.epoch()
 	if err != nil {
 		return err
 	}
-	_, err = r.ReadUntil([]byte("raw REPL; CTRL-B to exit\r\n"), nil)
-	return err
+	s := t.Unix() - epoch
+	if s < 0 {
+		s = 0
+	}
+	sec := strconv.FormatInt(s, 10)
+	code := []byte(osImport + `if hasattr(uos, 'utime'):
+	uos.utime(` + pyString(path) + `, (` + sec + `, ` + sec + `))
+	print('ok', end='')
+`)
+	b := &strings.Builder{}
+	_, err = r.Exec(code, b)
+	if err != nil {
+		return err
+	}
+	if b.String() != "ok" {
+		return ErrUnsupported
+	}
+	return nil
 }
 
-// ExitRawMode will send ctrl-B to Repl to return to normal terminal mode.
-func (r *Repl) ExitRawMode() error {
-	// ctrl-B: enter friendly REPL
-	_, err := r.Port.Write([]byte("\r\x02"))
-	return err
+// Ls lists the contents of the current directory sorted by name
+func (r *Repl) Ls() ([]string, error) {
+	return r.List(ListOptions{})
 }
 
-// SoftReboot will send ctrl-D to Repl to perform a soft reboot.
-func (r *Repl) SoftReboot() error {
-	_, err := r.Port.Write([]byte("\x04"))
-	if err != nil {
-		return err
+// LsAbsolute lists the contents of the current directory as absolute paths
+// sorted by name
+func (r *Repl) LsAbsolute() ([]string, error) {
+	return r.List(ListOptions{Absolute: true})
+}
+
+// ListOptions configures List.
+type ListOptions struct {
+	// Absolute returns absolute paths instead of names.
+	Absolute bool
+	// Unsorted keeps the order the filesystem returns entries in.
+	Unsorted bool
+	// Mtime fills in FileEntry.Mtime for ListLong, at the cost of a stat
+	// per entry.
+	Mtime bool
+}
+
+// List lists the contents of the current directory. Directories get a
+// trailing slash.
+func (r *Repl) List(opts ListOptions) ([]string, error) {
+	prefix := ""
+	if opts.Absolute {
+		prefix = "uos.getcwd().rstrip('/') + '/' + "
 	}
-	_, err = r.ReadUntil([]byte("soft reboot\r\n"), nil)
+	entries, err := r.ls(prefix, false, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = r.ReadUntil([]byte("raw REPL; CTRL-B to exit\r\n"), nil)
-	return err
+	fs := make([]string, len(entries))
+	for i, e := range entries {
+		fs[i] = e.Name
+		if e.IsDir {
+			fs[i] += "/"
+		}
+	}
+	if !opts.Unsorted {
+		sort.Strings(fs)
+	}
+	return fs, nil
 }
 
-// ExecRaw will execute code without following the results.
-func (r *Repl) ExecRaw(code []byte) error {
-	_, err := r.ReadUntil([]byte(">"), nil)
+// ListDir lists the names in the remote directory dir in the order the
+// filesystem returns them. Directories get a trailing slash.
+func (r *Repl) ListDir(dir string) ([]string, error) {
+	code := []byte(osImport + "print(repr([e[0] + ('/' if e[1] & 0x4000 else '') for e in uos.ilistdir(" + pyString(dir) + ")]), end='')")
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = r.Port.Write(code)
+	names, err := parseStringList(strings.TrimSpace(b.String()))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unexpected listing of %s: %v", dir, err)
 	}
-	_, err = r.Port.Write([]byte("\x04"))
+	return names, nil
+}
+
+// FileEntry is a file or directory listed by ListLong.
+type FileEntry struct {
+	// Name is the name, or the absolute path with ListOptions.Absolute.
+	Name  string
+	IsDir bool
+	// Size is the size of a file in bytes, zero for directories.
+	Size int64
+	// Mtime is the modification time with ListOptions.Mtime, zero when
+	// the device doesn't keep one.
+	Mtime time.Time
+}
+
+// Stat returns the entry of the remote path, with an error matching
+// ErrNotExist when there's nothing there.
+func (r *Repl) Stat(path string) (FileEntry, error) {
+	code := []byte(osImport + "s = uos.stat(" + pyString(path) + ")\nprint(s[0] & 0x4000, s[6], end='')")
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
 	if err != nil {
-		return err
+		return FileEntry{}, err
 	}
-	resp := make([]byte, 2)
-	_, err = io.ReadAtLeast(r.Port, resp, 2)
+	var mode, size int64
+	_, err = fmt.Sscan(b.String(), &mode, &size)
 	if err != nil {
-		return err
+		return FileEntry{}, fmt.Errorf("unexpected stat output %q", b.String())
 	}
-	if !bytes.Equal(resp, []byte("OK")) {
-		return errors.New("could not exec command")
+	e := FileEntry{Name: path, IsDir: mode != 0}
+	if !e.IsDir {
+		e.Size = size
 	}
-	return nil
+	return e, nil
 }
 
-// Follow will read the response data and/or error from executing code.
-func (r *Repl) Follow(w io.Writer) ([]byte, []byte, error) {
-	data, err := r.ReadUntil([]byte("\x04"), w)
-	if err != nil {
-		return nil, nil, err
+// TargetPath returns where a file called name ends up when copied to dst,
+// the way cp does it: inside dst when that's an existing directory or ends
+// with a slash, and dst itself otherwise. A dst ending with a slash that
+// doesn't exist yet is created.
+func (r *Repl) TargetPath(dst, name string) (string, error) {
+	if strings.HasSuffix(dst, "/") {
+		err := r.MkdirAll(strings.TrimRight(dst, "/"))
+		if err != nil {
+			return "", err
+		}
+		return dst + name, nil
 	}
-	if len(data) > 0 {
-		data = data[:len(data)-1]
+	e, err := r.Stat(dst)
+	if errors.Is(err, ErrNotExist) {
+		return dst, nil
 	}
-	dataErr, err := r.ReadUntil([]byte("\x04"), nil)
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
-	if len(dataErr) > 0 {
-		dataErr = dataErr[:len(dataErr)-1]
+	if e.IsDir {
+		return path.Join(dst, name), nil
 	}
-	return data, dataErr, nil
+	return dst, nil
 }
 
-// Exec will execute code and read the response or error. If w is supplied it
-// will call Write to pass the data instead of accumulating it.
-func (r *Repl) Exec(code []byte, w io.Writer) ([]byte, error) {
-	err := r.ExecRaw(code)
+// ListLong lists the contents of the current directory along with the size
+// of each file, and the modification time with ListOptions.Mtime. Ports
+// whose listing leaves out sizes cost a stat per file, so it may be slower
+// than List.
+func (r *Repl) ListLong(opts ListOptions) ([]FileEntry, error) {
+	prefix := ""
+	if opts.Absolute {
+		prefix = "uos.getcwd().rstrip('/') + '/' + "
+	}
+	entries, err := r.ls(prefix, true, opts.Mtime)
 	if err != nil {
 		return nil, err
 	}
-	data, dataErr, err := r.Follow(w)
+	if !opts.Unsorted {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+	}
+	return entries, nil
+}
+
+// lsCode prints a tab separated line for each entry in the current
+// directory: d or f, the size (-1 when ilistdir leaves it out and SIZE isn't
+// set), the mtime (0 unless MTIME is set) and the name with PREFIX in front,
+// last so spaces and tabs in it survive.
+const lsCode = osImport + `for _f in uos.ilistdir('.'):
+	_d = _f[1] & 0x4000
+	_s = _f[3] if len(_f) > 3 else -1
+	_t = 0
+	if SIZE and not _d and _s < 0 or MTIME:
+		_st = uos.stat(_f[0])
+		_s = _st[6]
+		_t = _st[8]
+	print('%s\t%d\t%d\t%s' % ('d' if _d else 'f', 0 if _d else _s, _t, PREFIX_f[0]))
+`
+
+// ls lists the current directory with prefix prepended to each name on the
+// device. Sizes are only sure to be there with size set and times with
+// mtime set.
+func (r *Repl) ls(prefix string, size, mtime bool) ([]FileEntry, error) {
+	code := strings.Replace(lsCode, "PREFIX", prefix, 1)
+	code = strings.Replace(code, "SIZE", pyBool(size), 1)
+	code = strings.Replace(code, "MTIME", pyBool(mtime), 1)
+	var epoch int64
+	if mtime {
+		var err error
+		epoch, err = r.epoch()
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
 	if err != nil {
 		return nil, err
 	}
-	if len(dataErr) > 0 {
-		return nil, errors.New(string(dataErr))
+	var entries []FileEntry
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed listing %q", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed listing %q", line)
+		}
+		sec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed listing %q", line)
+		}
+		e := FileEntry{
+			Name:  fields[3],
+			IsDir: fields[0] == "d",
+			Size:  size,
+		}
+		if sec != 0 {
+			e.Mtime = time.Unix(sec+epoch, 0)
+		}
+		entries = append(entries, e)
 	}
-	return data, nil
+	return entries, nil
 }
 
-// Cat reads the contents of a file
-func (r *Repl) Cat(w io.Writer, f string) error {
-	code := []byte(`with open("` + f + `") as f:
-	while True:
-		b = f.read(256)
-		if not b:
-			break
-		print(b, end='')`)
-	_, err := r.Exec(code, w)
+// Mkdir makes a new directory
+func (r *Repl) Mkdir(d string) error {
+	code := []byte(osImport + "uos.mkdir(" + pyString(d) + ")")
+	_, err := r.Exec(code, nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Cd changes the current working directory
-func (r *Repl) Cd(d string) error {
-	code := []byte("import uos\nuos.chdir(\"" + d + "\")")
+// MkdirAll makes the directory d along with any missing parents. Directories
+// that already exist are left alone.
+func (r *Repl) MkdirAll(d string) error {
+	if d == "" || d == "." || d == "/" {
+		return nil
+	}
+	code := []byte(osImport + `_p = '/' if ` + pyString(d) + `.startswith('/') else ''
+for _c in ` + pyString(d) + `.split('/'):
+	if not _c:
+		continue
+	_p += _c
+	try:
+		uos.stat(_p)
+	except OSError:
+		uos.mkdir(_p)
+	_p += '/'
+`)
 	_, err := r.Exec(code, nil)
-	if err != nil {
-		return err
+	return err
+}
+
+// Put copies everything read from src to the file dst on the MicroPython
+// device.
+func (r *Repl) Put(dst string, src io.Reader) (TransferStats, error) {
+	return r.PutMode(dst, src, "w")
+}
+
+// PutReader is Put for callers that don't need the TransferStats, such as
+// those copying from a pipe.
+func (r *Repl) PutReader(dst string, src io.Reader) error {
+	_, err := r.Put(dst, src)
+	return err
+}
+
+// putModes maps the modes accepted by PutMode to Python open modes.
+var putModes = map[string]string{
+	"w":  "wb",
+	"a":  "ab",
+	"wx": "xb",
+}
+
+// PutMode is Put opening dst with mode: "w" replaces the file, "a" appends
+// to it and "wx" fails if it already exists.
+func (r *Repl) PutMode(dst string, src io.Reader, mode string) (TransferStats, error) {
+	return r.PutWithOptions(dst, src, PutOptions{Mode: mode})
+}
+
+// PutOptions configures PutWithOptions.
+type PutOptions struct {
+	// Mode is the PutMode mode and defaults to "w".
+	Mode string
+	// MakeDirs creates the missing parent directories of dst first.
+	MakeDirs bool
+	// NormalizeEOL turns "\r\n" into "\n" on the host before sending, if
+	// src looks like text: there are no NUL bytes in its first chunk.
+	// Binary files are sent unchanged.
+	NormalizeEOL bool
+	// Atomic writes to dst with ".tmp" appended first and only renames that
+	// over dst once all of it arrived, so an interrupted Put leaves dst as
+	// it was. It only works with mode "w".
+	Atomic bool
+	// Verify compares the SHA-256 of the temporary file with what was sent
+	// before the rename, when Atomic is set.
+	Verify bool
+}
+
+// atomicSuffix is appended to the temporary file of an atomic Put.
+const atomicSuffix = ".tmp"
+
+// CriticalFile reports whether the remote file name is one the device runs
+// at boot, where a half written copy can leave the board unusable. Upload
+// always puts those atomically.
+func CriticalFile(name string) bool {
+	switch path.Clean("/" + name) {
+	case "/boot.py", "/main.py":
+		return true
 	}
-	return nil
+	return false
 }
 
-// Download all files from the MicroPython device to the local directory
-func (r *Repl) Download() error {
-	fs, err := r.Ls()
-	if err != nil {
-		return err
+// PutWithOptions is Put configured by opts.
+func (r *Repl) PutWithOptions(dst string, src io.Reader, opts PutOptions) (TransferStats, error) {
+	var stats TransferStats
+	mode := opts.Mode
+	if mode == "" {
+		mode = "w"
 	}
-	for _, fn := range fs {
-		if strings.HasSuffix(fn, "/") {
-			continue
+	pyMode, ok := putModes[mode]
+	if !ok {
+		return stats, fmt.Errorf("invalid put mode %q, want w, a or wx", mode)
+	}
+	if opts.Atomic {
+		if mode != "w" {
+			return stats, fmt.Errorf("atomic put needs mode w, not %q", mode)
 		}
-		fmt.Println("Downloading", fn, "...")
-		err = r.Get(fn, fn)
+		return r.putAtomic(dst, src, opts)
+	}
+	if opts.MakeDirs {
+		err := r.MkdirAll(path.Dir(dst))
 		if err != nil {
-			return err
+			return stats, err
 		}
 	}
-	return nil
-}
-
-// Get copies a file from the MicroPython device to the local machine
-func (r *Repl) Get(dst, src string) error {
-	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
+	if opts.NormalizeEOL {
+		src = textEOL(src)
+	}
+	caps := r.compression()
+	compress := caps.decompress != ""
+	open := func(pyMode string) error {
+		code := "f=open(" + pyString(dst) + ",'" + pyMode + "')\n"
+		if r.useHelper() {
+			code += "w=_zap.put\n"
+		} else {
+			code += putChunkDefs
+		}
+		if compress {
+			code += caps.decompress
+		}
+		_, err := r.Exec([]byte(code), nil)
 		return err
 	}
-	_, err = r.Exec([]byte(`from ubinascii import b2a_base64
-f=open("`+src+`",'rb')
-`), nil)
+	err := open(pyMode)
 	if err != nil {
-		return err
+		return stats, err
 	}
+	resumes := 0
+	start := time.Now()
+	size := r.chunkSize(compress)
+	// about how much code a chunk adds to a batch once base64 encoded
+	perChunk := size*4/3 + 24
+	var batch [][]byte
+	var batchBytes int64
 	for {
-		var b bytes.Buffer
-		_, err = r.Exec([]byte(`d=str(b2a_base64(f.read(256)),'ascii')
-print(d.strip(),end='')
-`), &b)
-		if err != nil {
-			return err
+		b := make([]byte, size)
+		n, err := io.ReadFull(src, b)
+		if n > 0 {
+			batch = append(batch, b[:n])
+			batchBytes += int64(n)
 		}
-		x, err := base64.StdEncoding.DecodeString(string(b.Bytes()))
-		if err != nil {
-			return err
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			r.Exec([]byte("f.close()"), nil)
+			return stats, err
+		}
+		if len(batch) > 0 && (done || (len(batch)+1)*perChunk > putBatchSize) {
+			err := r.putBatch(stats.Bytes, batch, compress)
+			for errors.Is(err, ErrDeviceReset) && resumes < maxResumes {
+				resumes++
+				err = r.resumePut(dst, stats.Bytes, open)
+				if err == nil {
+					err = r.putBatch(stats.Bytes, batch, compress)
+				}
+			}
+			if err != nil {
+				// don't leave the remote file open, e.g. after ENOSPC
+				r.Exec([]byte("f.close()"), nil)
+				return stats, err
+			}
+			stats.Bytes += batchBytes
+			batch, batchBytes = nil, 0
 		}
-		if len(x) == 0 {
+		if done {
 			break
 		}
-		f.Write(x)
 	}
-	return nil
-}
-
-// Ls lists the contents of the current directory
-func (r *Repl) Ls() ([]string, error) {
-	code := []byte(`import uos
-for f in uos.ilistdir('.'):
-	print(f[0], end='/ ' if f[1] & 0x4000 else ' ')
-`)
-	b := &strings.Builder{}
-	_, err := r.Exec(code, b)
+	stats.Elapsed = time.Since(start)
+	_, err = r.Exec([]byte("f.close()"), nil)
 	if err != nil {
-		return nil, err
+		return stats, err
+	}
+	if compress && mode != "a" {
+		err = r.checkSize(dst, stats.Bytes)
+		if err != nil {
+			return stats, err
+		}
 	}
-	s := strings.TrimRight(b.String(), " ")
-	return strings.Split(s, " "), nil
+	return stats, nil
 }
 
-// Mkdir makes a new directory
-func (r *Repl) Mkdir(d string) error {
-	code := []byte("import uos\nuos.mkdir('" + d + "')")
-	_, err := r.Exec(code, nil)
+// resumePut opens dst again after the device was reconnected in the middle
+// of a Put, to append from off. That only works when everything sent before
+// the batch that failed made it to the filesystem, which a reset often
+// prevents.
+func (r *Repl) resumePut(dst string, off int64, open func(pyMode string) error) error {
+	r.forgetHelper()
+	size, err := r.Size(dst)
 	if err != nil {
 		return err
 	}
-	return nil
+	if size != off {
+		return fmt.Errorf("%w: can't resume %s, sent %d bytes but the device kept %d", ErrDeviceReset, dst, off, size)
+	}
+	return open("ab")
 }
 
-// Put copies a file from the local machine to the MicroPython device
-func (r *Repl) Put(dst, src string) error {
-	f, err := os.OpenFile(src, os.O_RDONLY, 0666)
-	if err != nil {
-		return err
+// putAtomic is PutWithOptions for opts.Atomic. When anything fails the
+// temporary file is removed and dst is left alone.
+func (r *Repl) putAtomic(dst string, src io.Reader, opts PutOptions) (TransferStats, error) {
+	if opts.NormalizeEOL {
+		// hash what's sent, not what was read
+		src = textEOL(src)
+		opts.NormalizeEOL = false
+	}
+	opts.Atomic = false
+	h := sha256.New()
+	tmp := dst + atomicSuffix
+	stats, err := r.PutWithOptions(tmp, io.TeeReader(src, h), opts)
+	if err == nil && opts.Verify {
+		var sum string
+		sum, err = r.Hash(tmp)
+		if err == nil && sum != hex.EncodeToString(h.Sum(nil)) {
+			err = fmt.Errorf("verifying %s: SHA-256 mismatch", tmp)
+		}
+	}
+	if err == nil {
+		err = r.Mv(tmp, dst)
 	}
-	_, err = r.Exec([]byte(`from ubinascii import a2b_base64
-f=open("`+dst+`",'wb')
-w=lambda x:f.write(a2b_base64(x))
-`), nil)
 	if err != nil {
-		return err
+		r.Rm(tmp)
+		return stats, err
 	}
-	b := make([]byte, 256)
-	for {
-		n, err := f.Read(b)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		e := base64.StdEncoding.EncodeToString(b[:n])
-		_, err = r.Exec([]byte("w(\""+e+"\")\n"), nil)
-		if err != nil {
-			return err
+	return stats, nil
+}
+
+// chunkSize returns how many bytes of a file Get and Put move per chunk.
+func (r *Repl) chunkSize(compress bool) int {
+	size := r.ChunkSize
+	if size <= 0 {
+		size = 256
+		if compress {
+			size = compressChunkSize
 		}
 	}
-	_, err = r.Exec([]byte("f.close()"), nil)
+	if compress && size > compressChunkSize {
+		size = compressChunkSize
+	}
+	return size
+}
+
+// checkSize makes sure the remote file f is n bytes long after a compressed
+// transfer.
+func (r *Repl) checkSize(f string, n int64) error {
+	size, err := r.Size(f)
 	if err != nil {
 		return err
 	}
+	if size != n {
+		return fmt.Errorf("%s: transferred %d bytes but the file has %d", f, n, size)
+	}
 	return nil
 }
 
 // Cwd returns the current working directory
 func (r *Repl) Cwd() (string, error) {
-	code := []byte("import uos\nprint(uos.getcwd(),end='')")
+	code := []byte(osImport + "print(uos.getcwd(),end='')")
 	b := &strings.Builder{}
 	_, err := r.Exec(code, b)
 	if err != nil {
@@ -310,7 +1920,7 @@ func (r *Repl) Cwd() (string, error) {
 
 // Rm removes a file
 func (r *Repl) Rm(f string) error {
-	code := []byte("import uos\nuos.remove(\"" + f + "\")")
+	code := []byte(osImport + "uos.remove(" + pyString(f) + ")")
 	_, err := r.Exec(code, nil)
 	if err != nil {
 		return err
@@ -318,9 +1928,22 @@ func (r *Repl) Rm(f string) error {
 	return nil
 }
 
+// Mv renames the remote path src to dst, replacing dst when it's a file.
+// Filesystems that won't rename over an existing file, like FAT, get dst
+// removed just before, so there's a moment without it.
+func (r *Repl) Mv(src, dst string) error {
+	s, d := pyString(src), pyString(dst)
+	code := []byte(osImport + "try:\n\tuos.rename(" + s + ", " + d + ")\n" +
+		"except OSError as e:\n" +
+		"\tif e.args[0] != 17:\n\t\traise\n" +
+		"\tuos.remove(" + d + ")\n\tuos.rename(" + s + ", " + d + ")")
+	_, err := r.Exec(code, nil)
+	return err
+}
+
 // Rmdir removes a directory
 func (r *Repl) Rmdir(d string) error {
-	code := []byte("import uos\nuos.rmdir('" + d + "')")
+	code := []byte(osImport + "uos.rmdir(" + pyString(d) + ")")
 	_, err := r.Exec(code, nil)
 	if err != nil {
 		return err
@@ -328,22 +1951,214 @@ func (r *Repl) Rmdir(d string) error {
 	return nil
 }
 
-// Upload all files from the local directory to the MicroPython device
-func (r *Repl) Upload() error {
-	fs, err := ioutil.ReadDir(".")
+// Upload copies all files from the local directory dir to the current
+// directory of the MicroPython device. If fn isn't nil it's called for each
+// file. Files that fail are recorded in the summary and skipped.
+func (r *Repl) Upload(dir string, fn TransferFunc) (UploadSummary, error) {
+	return r.UploadExcluding(dir, nil, fn)
+}
+
+// UploadExcluding is Upload skipping files whose names match any of the
+// exclude patterns, see MatchesIgnore.
+func (r *Repl) UploadExcluding(dir string, exclude []string, fn TransferFunc) (UploadSummary, error) {
+	return r.UploadWithOptions(dir, UploadOptions{Exclude: exclude}, fn)
+}
+
+// UploadOptions configures UploadWithOptions.
+type UploadOptions struct {
+	// Exclude skips files whose names match any of the patterns, see
+	// MatchesIgnore.
+	Exclude []string
+	// NormalizeEOL is passed on to PutOptions.
+	NormalizeEOL bool
+	// FailFast stops at the first file that fails instead of recording the
+	// error and moving on.
+	FailFast bool
+	// SkipExisting leaves files that already exist on the device alone,
+	// without comparing their contents.
+	SkipExisting bool
+	// OnSkipExisting is called with the name of each file SkipExisting
+	// leaves out when set.
+	OnSkipExisting func(name string)
+	// Atomic puts every file atomically, see PutOptions.Atomic. Those that
+	// CriticalFile picks out always are.
+	Atomic bool
+	// SkipUnchanged leaves files that are already on the device with the
+	// same contents alone, see Unchanged, and writes ManifestFile afterwards
+	// for the next time.
+	SkipUnchanged bool
+	// NoManifest makes SkipUnchanged hash every file on the device instead
+	// of trusting ManifestFile, in case they were changed some other way.
+	NoManifest bool
+	// OnUnchanged is called with the name of each file SkipUnchanged leaves
+	// out when set.
+	OnUnchanged func(name string)
+	// OnLowSpace, when set, is called before anything is copied if the
+	// files don't fit in the free space on the device, with the bytes they
+	// need and the bytes free, see UploadSpace. An error it returns stops
+	// the upload.
+	OnLowSpace func(need, free int64) error
+}
+
+// UploadWithOptions is Upload configured by opts.
+func (r *Repl) UploadWithOptions(dir string, opts UploadOptions, fn TransferFunc) (UploadSummary, error) {
+	var sum UploadSummary
+	start := time.Now()
+	fs, err := r.local().ReadDir(dir)
 	if err != nil {
-		return err
+		return sum, err
 	}
-	for _, f := range fs {
-		if f.IsDir() {
+	if opts.OnLowSpace != nil {
+		need, free, err := r.UploadSpace(dir, opts.Exclude)
+		if err == nil && free < need {
+			err = opts.OnLowSpace(need, free)
+		}
+		if err != nil && err != ErrUnsupported {
+			return sum, err
+		}
+	}
+	var same map[string]bool
+	var local, manifest Manifest
+	if opts.SkipUnchanged {
+		var names []string
+		for _, fi := range fs {
+			if !fi.IsDir() && fi.Name() != ManifestFile && !MatchesIgnore(opts.Exclude, fi.Name()) {
+				names = append(names, fi.Name())
+			}
+		}
+		same, local, err = r.unchanged(dir, names, UnchangedOptions{
+			NoManifest:   opts.NoManifest,
+			NormalizeEOL: opts.NormalizeEOL,
+		})
+		if err != nil {
+			return sum, err
+		}
+		manifest = make(Manifest, len(names))
+	}
+	for _, fi := range fs {
+		if fi.IsDir() {
+			continue
+		}
+		name := fi.Name()
+		if MatchesIgnore(opts.Exclude, name) || opts.SkipUnchanged && name == ManifestFile {
+			sum.FilesSkipped++
+			continue
+		}
+		if same[name] {
+			sum.FilesUnchanged++
+			manifest[name] = local[name]
+			if opts.OnUnchanged != nil {
+				opts.OnUnchanged(name)
+			}
+			continue
+		}
+		if opts.SkipExisting {
+			_, err := r.Stat(name)
+			if err == nil {
+				sum.FilesSkipped++
+				if opts.OnSkipExisting != nil {
+					opts.OnSkipExisting(name)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrNotExist) {
+				err = fmt.Errorf("%s: %w", name, err)
+				if opts.FailFast {
+					sum.Duration = time.Since(start)
+					return sum, err
+				}
+				sum.Errors = append(sum.Errors, err)
+				continue
+			}
+		}
+		if fn != nil {
+			fn(name, nil)
+		}
+		stats, err := r.uploadFile(filepath.Join(dir, name), name, opts)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			if opts.FailFast {
+				sum.Duration = time.Since(start)
+				return sum, err
+			}
+			sum.Errors = append(sum.Errors, err)
 			continue
 		}
-		fn := f.Name()
-		fmt.Println("Uploading", fn, "...")
-		err = r.Put(fn, fn)
+		if fn != nil {
+			fn(name, &stats)
+		}
+		if manifest != nil {
+			manifest[name] = local[name]
+		}
+		sum.FilesUploaded++
+		sum.BytesTransferred += stats.Bytes
+	}
+	if manifest != nil {
+		// files that failed are left out, so they're compared again
+		err = r.WriteManifest(manifest)
 		if err != nil {
-			return err
+			sum.Duration = time.Since(start)
+			return sum, fmt.Errorf("%s: %w", ManifestFile, err)
 		}
 	}
-	return nil
+	sum.Duration = time.Since(start)
+	return sum, nil
+}
+
+// UploadSpace returns the bytes Upload needs on the device to copy the files
+// from dir that don't match exclude, and the bytes free there. Files that
+// are already on the device get replaced, so the space they use counts as
+// free. Only local sizes count since the encoding used on the wire isn't
+// stored. Ports without uos.statvfs return ErrUnsupported.
+func (r *Repl) UploadSpace(dir string, exclude []string) (int64, int64, error) {
+	fs, err := r.local().ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	local := map[string]bool{}
+	var need int64
+	for _, fi := range fs {
+		if !fi.IsDir() && !MatchesIgnore(exclude, fi.Name()) {
+			local[fi.Name()] = true
+			need += fi.Size()
+		}
+	}
+	remote, err := r.Ls()
+	if err != nil {
+		return 0, 0, err
+	}
+	var existing []string
+	for _, name := range remote {
+		if local[name] {
+			existing = append(existing, name)
+		}
+	}
+	if len(existing) > 0 {
+		sizes, err := r.Sizes(existing)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, n := range sizes {
+			need -= n
+		}
+	}
+	free, err := r.DiskFree()
+	if err != nil {
+		return 0, 0, err
+	}
+	return need, free, nil
+}
+
+// uploadFile copies the local file src to the remote file dst for Upload.
+func (r *Repl) uploadFile(src, dst string, opts UploadOptions) (TransferStats, error) {
+	f, err := r.local().Open(src)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	defer f.Close()
+	return r.PutWithOptions(dst, f, PutOptions{
+		MakeDirs:     true,
+		NormalizeEOL: opts.NormalizeEOL,
+		Atomic:       opts.Atomic || CriticalFile(dst),
+	})
 }
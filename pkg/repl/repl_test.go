@@ -0,0 +1,259 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chattyDevice returns a reply for fakePort from a device that keeps printing
+// line until ctrl-C stops it, and then enters the raw REPL on ctrl-A. With
+// interruptible false ctrl-C doesn't stop it.
+func chattyDevice(line string, interruptible bool) func(b []byte) []byte {
+	running := true
+	return func(b []byte) []byte {
+		switch {
+		case running && interruptible && bytes.Contains(b, []byte{0x03}):
+			running = false
+			return []byte("Traceback (most recent call last):\r\n" +
+				"  File \"main.py\", line 4, in <module>\r\n" +
+				"KeyboardInterrupt: \r\nMicroPython v1.19 on 2022-06-18; ESP32\r\n>>> ")
+		case running:
+			return []byte(line)
+		case bytes.Contains(b, []byte{0x01}):
+			return DefaultRawBanner
+		}
+		return nil
+	}
+}
+
+func TestEnterRawModeChattyProgram(t *testing.T) {
+	p := newFakePort()
+	p.reply = chattyDevice("temperature 21.5\r\n", true)
+	r := &Repl{Port: p, RawModeTimeout: time.Millisecond * 250}
+	err := r.enterRawModeRetrying()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnterRawModeWrongDevice(t *testing.T) {
+	p := newFakePort()
+	p.reply = chattyDevice("$GPGGA,123519,4807.038,N,01131.000,E\r\n", false)
+	r := &Repl{Port: p, RawModeTimeout: time.Millisecond * 250}
+	err := r.enterRawModeRetrying()
+	var nerr *NotMicroPythonError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("got %v, want a NotMicroPythonError", err)
+	}
+	if !bytes.HasPrefix(nerr.Received, []byte("$GPGGA")) {
+		t.Fatalf("received %q", nerr.Received)
+	}
+}
+
+func TestEnterRawModeNoInterrupt(t *testing.T) {
+	p := newFakePort()
+	p.reply = chattyDevice("temperature 21.5\r\n", true)
+	r := &Repl{Port: p, RawModeTimeout: time.Millisecond * 250, NoInterrupt: true}
+	err := r.enterRawModeRetrying()
+	if err != ErrBusy {
+		t.Fatalf("got %v, want ErrBusy", err)
+	}
+	if w := p.written.Bytes(); bytes.ContainsAny(w, "\x03\n") {
+		t.Fatalf("program was poked with %q", w)
+	}
+}
+
+func TestEnterRawModePasteMode(t *testing.T) {
+	// a device stuck in paste mode that ignores ctrl-C and ctrl-A
+	p := newFakePort()
+	p.reply = func(b []byte) []byte {
+		return []byte("\r\n=== ")
+	}
+	r := &Repl{Port: p, RawModeTimeout: time.Millisecond * 250}
+	err := r.enterRawModeRetrying()
+	if !errors.Is(err, ErrInterrupt) {
+		t.Fatalf("got %v, want ErrInterrupt", err)
+	}
+	if want := StatePaste.hint(); !strings.Contains(err.Error(), want) {
+		t.Fatalf("got %q, want it to say %q", err, want)
+	}
+}
+
+func TestExecSkipsJunkBeforeOK(t *testing.T) {
+	// stale output from an interrupted transfer, and a late prompt and echo
+	// in front of the OK
+	p := newFakePort("ets Jun  8 2016 00:22:57\r\n", "\x00\xffrst:0x1")
+	p.reply = func(b []byte) []byte {
+		if bytes.HasSuffix(b, []byte{0x04}) {
+			return []byte(">\r\nKO\x04OOKhello\x04\x04>")
+		}
+		return nil
+	}
+	r := &Repl{Port: p}
+	out, err := r.Exec([]byte("print('hello', end='')"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello" {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestReadUntilIdleReads(t *testing.T) {
+	// the device was unplugged halfway, reads keep returning (0, nil)
+	p := newFakePort("partial")
+	r := &Repl{Port: p, MaxIdleReads: 3}
+	data, err := r.ReadUntil([]byte("OK"), nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if string(data) != "partial" {
+		t.Fatalf("got %q", data)
+	}
+	if p.reads > 5 {
+		t.Fatalf("gave up after %d reads", p.reads)
+	}
+}
+
+func TestReadUntilIdleReadsReset(t *testing.T) {
+	// empty reads in between data don't add up
+	p := newFakePort("a", "", "", "b", "", "", "c", "", "", "OK")
+	r := &Repl{Port: p, MaxIdleReads: 3}
+	data, err := r.ReadUntil([]byte("OK"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcOK" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestExitRawModeDrainsUntilPrompt(t *testing.T) {
+	// a command left running prints until ctrl-C, then the friendly REPL
+	// comes up after ctrl-B
+	p := newFakePort("partial output of a failed command\r\n")
+	p.reply = func(b []byte) []byte {
+		if bytes.Contains(b, []byte{0x03}) && bytes.Contains(b, []byte{0x02}) {
+			return []byte("Traceback (most recent call last):\r\nKeyboardInterrupt: \r\n" +
+				"MicroPython v1.19 on 2022-06-18; ESP32\r\nType \"help()\" for more information.\r\n>>> ")
+		}
+		return nil
+	}
+	p.queue("more output")
+	r := &Repl{Port: p}
+	err := r.ExitRawMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := p.written.String(); w != "\x03\x02" {
+		t.Fatalf("wrote %q", w)
+	}
+	if rest := append(r.pending, p.rest()...); len(rest) > 0 {
+		t.Fatalf("left %q", rest)
+	}
+}
+
+func TestExitRawModeNoPrompt(t *testing.T) {
+	// firmware that doesn't print the usual prompt only costs the timeout
+	p := newFakePort("whatever\r\n")
+	p.pause = time.Millisecond * 10
+	for i := 0; i < 1000; i++ {
+		p.queue("")
+	}
+	r := &Repl{Port: p}
+	start := time.Now()
+	err := r.ExitRawMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > exitTimeout*2 {
+		t.Fatalf("took %v", d)
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	dirs := map[string]bool{"/lib": true}
+	files := map[string]bool{"/main.py": true}
+	tests := []struct {
+		dst   string
+		want  string
+		mkdir bool
+	}{
+		// a file is overwritten
+		{"/main.py", "/main.py", false},
+		// a directory gets the file inside
+		{"/lib", "/lib/foo.py", false},
+		{"/lib/", "/lib/foo.py", true},
+		// a missing path is the new name, unless it ends with a slash
+		{"/new.py", "/new.py", false},
+		{"/new/", "/new/foo.py", true},
+	}
+	for _, tt := range tests {
+		p := newFakePort()
+		p.reply = statDevice(dirs, files)
+		r := &Repl{Port: p}
+		got, err := r.TargetPath(tt.dst, "foo.py")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.dst, err)
+		}
+		if got != tt.want {
+			t.Errorf("TargetPath(%q) = %q, want %q", tt.dst, got, tt.want)
+		}
+		if mkdir := strings.Contains(p.written.String(), "uos.mkdir"); mkdir != tt.mkdir {
+			t.Errorf("TargetPath(%q) made a directory: %v", tt.dst, mkdir)
+		}
+	}
+}
+
+func TestListDir(t *testing.T) {
+	p := newFakePort()
+	p.reply = rawREPL(`['lib/', 'main.py', "it's.py"]`)
+	r := &Repl{Port: p}
+	names, err := r.ListDir(`/a "quoted" dir`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "lib/,main.py,it's.py" {
+		t.Fatalf("got %q", names)
+	}
+	w := p.written.String()
+	if !strings.Contains(w, "import os as uos") || !strings.Contains(w, `ilistdir("/a \"quoted\" dir")`) {
+		t.Fatalf("sent %q", w)
+	}
+}
+
+func TestInterruptWithNoInterrupt(t *testing.T) {
+	// NoInterrupt only keeps Connect and EnterRawMode from sending ctrl-C
+	p := newFakePort()
+	p.reply = chattyDevice("temperature 21.5\r\n", true)
+	r := &Repl{Port: p, NoInterrupt: true}
+	err := r.Interrupt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(p.written.Bytes(), []byte{0x03}) {
+		t.Fatalf("wrote %q", p.written.Bytes())
+	}
+}
+
+func TestReadOutputPending(t *testing.T) {
+	// output read past the end of a response comes before the port's
+	p := newFakePort("", ">>> ")
+	r := &Repl{Port: p}
+	r.unread([]byte("\r\n"))
+	var got []byte
+	b := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		n, err := r.ReadOutput(b)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "\r\n>>> " {
+		t.Fatalf("got %q", got)
+	}
+}
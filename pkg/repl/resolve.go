@@ -0,0 +1,92 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// Devices can be given by USB identity instead of port name, so they're
+// found again when the port names shuffle after a reboot.
+const (
+	// usbScheme selects the port of a USB device, as usb:VID:PID in hex
+	usbScheme = "usb:"
+	// serialScheme selects the port of a USB device by its serial number
+	serialScheme = "serial:"
+)
+
+// PortInfo describes a serial port found by ListPortDetails.
+type PortInfo struct {
+	// Name is the port name like /dev/ttyUSB0 or COM3.
+	Name string
+	// VID and PID are the USB vendor and product IDs in lowercase hex,
+	// empty when the port isn't USB.
+	VID string
+	PID string
+	// SerialNumber is the USB serial number when the device has one.
+	SerialNumber string
+}
+
+// ListPortDetails returns the serial ports of this machine along with the
+// USB identity of those that have one.
+func ListPortDetails() ([]PortInfo, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]PortInfo, len(ports))
+	for i, p := range ports {
+		infos[i] = PortInfo{Name: p.Name}
+		if p.IsUSB {
+			infos[i].VID = strings.ToLower(p.VID)
+			infos[i].PID = strings.ToLower(p.PID)
+			infos[i].SerialNumber = p.SerialNumber
+		}
+	}
+	return infos, nil
+}
+
+// ResolveDevice returns the name of the port matching a usb:VID:PID or
+// serial:NUMBER device. Other devices are returned unchanged. It fails when
+// no port or more than one port matches.
+func ResolveDevice(device string) (string, error) {
+	var match func(p PortInfo) bool
+	switch {
+	case strings.HasPrefix(device, usbScheme):
+		ids := strings.Split(strings.ToLower(device[len(usbScheme):]), ":")
+		if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+			return "", fmt.Errorf("invalid device %s, want usb:VID:PID like usb:10c4:ea60", device)
+		}
+		match = func(p PortInfo) bool {
+			return p.VID == ids[0] && p.PID == ids[1]
+		}
+	case strings.HasPrefix(device, serialScheme):
+		sn := device[len(serialScheme):]
+		if sn == "" {
+			return "", fmt.Errorf("invalid device %s, want serial:NUMBER", device)
+		}
+		match = func(p PortInfo) bool {
+			return p.SerialNumber != "" && p.SerialNumber == sn
+		}
+	default:
+		return device, nil
+	}
+	ports, err := ListPortDetails()
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, p := range ports {
+		if match(p) {
+			names = append(names, p.Name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("no serial port matches %s, run zap ports to list them", device)
+	case 1:
+		return names[0], nil
+	}
+	return "", fmt.Errorf("%s matches several ports (%s), use serial:NUMBER or a port name instead", device, strings.Join(names, ", "))
+}
@@ -0,0 +1,183 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// followBoth reads the output and error sections of the response and the
+// prompt after them. Each section is either passed to its writer or
+// accumulated when the writer is nil, and an empty one is returned as nil.
+//
+// The device ends each section with \x04 and then prints the prompt, but the
+// output of a script may contain \x04 too. The response is framed by count
+// rather than by waiting: it takes two \x04, the second followed by the
+// prompt, to end it, and any \x04 before those two is output. The error
+// section is held back until then. Nothing depends on timing, so a script
+// may pause anywhere, right after printing \x04 too.
+func (r *Repl) followBoth(stdout, stderr io.Writer) ([]byte, []byte, error) {
+	var out bytes.Buffer
+	outw := io.Writer(&out)
+	if stdout != nil {
+		outw = stdout
+		if !r.RawOutput {
+			cw := &crlfWriter{w: stdout}
+			defer cw.Flush()
+			outw = cw
+		}
+	}
+	// output is written in blocks, flushed whenever the device pauses
+	bw := bufio.NewWriterSize(outw, outputBufSize)
+	defer bw.Flush()
+	outw = bw
+	rr := &responseReader{r: r, flush: bw.Flush, deadline: r.responseDeadline(time.Time{})}
+	prompt := r.prompt()
+	// held is what came after the last \x04, the error section if the
+	// prompt follows the next one
+	var held []byte
+	holding := false
+	for {
+		c, err := rr.next(time.Time{})
+		if err != nil {
+			return nil, nil, err
+		}
+		if c != 0x04 {
+			if holding {
+				held = append(held, c)
+				continue
+			}
+			_, err = outw.Write([]byte{c})
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		ahead, err := rr.peek(len(prompt), time.Time{})
+		if err != nil {
+			return nil, nil, err
+		}
+		if holding && bytes.Equal(ahead, prompt) {
+			rr.ahead = rr.ahead[len(ahead):]
+			rr.unread()
+			break
+		}
+		if holding {
+			// the \x04 held back was output after all
+			_, err = outw.Write(append([]byte{0x04}, held...))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		holding = true
+		held = nil
+	}
+	err := bw.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+	var data []byte
+	if stdout == nil && out.Len() > 0 {
+		data = out.Bytes()
+		if !r.RawOutput {
+			data = normalizeNewlines(data)
+		}
+	}
+	if len(held) == 0 {
+		return data, nil, nil
+	}
+	if !r.RawOutput {
+		held = normalizeNewlines(held)
+	}
+	if stderr != nil {
+		_, err := stderr.Write(held)
+		return data, nil, err
+	}
+	return data, held, nil
+}
+
+// outputBufSize is how much output followBoth collects before writing it.
+const outputBufSize = 4096
+
+// responseReader reads a response byte by byte from the port of r, with
+// room to look ahead.
+type responseReader struct {
+	r     *Repl
+	ahead []byte
+	// buf holds what was read from the port but not returned yet
+	buf []byte
+	// flush is called before waiting on the port when set
+	flush func() error
+	// deadline ends the whole response when it's not zero, like
+	// ResponseTimeout does in ReadUntil
+	deadline time.Time
+}
+
+// next returns the next byte, waiting until deadline unless it's zero.
+// Consecutive empty reads count against MaxIdleReads like in ReadUntil.
+func (rr *responseReader) next(deadline time.Time) (byte, error) {
+	if len(rr.ahead) > 0 {
+		c := rr.ahead[0]
+		rr.ahead = rr.ahead[1:]
+		return c, nil
+	}
+	return rr.read(deadline)
+}
+
+// peek returns up to n upcoming bytes without consuming them. It returns
+// fewer along with ErrTimeout when deadline passes first.
+func (rr *responseReader) peek(n int, deadline time.Time) ([]byte, error) {
+	for len(rr.ahead) < n {
+		c, err := rr.read(deadline)
+		if err != nil {
+			return rr.ahead, err
+		}
+		rr.ahead = append(rr.ahead, c)
+	}
+	return rr.ahead[:n], nil
+}
+
+func (rr *responseReader) read(deadline time.Time) (byte, error) {
+	if !rr.deadline.IsZero() && (deadline.IsZero() || rr.deadline.Before(deadline)) {
+		deadline = rr.deadline
+	}
+	if len(rr.buf) > 0 {
+		c := rr.buf[0]
+		rr.buf = rr.buf[1:]
+		return c, nil
+	}
+	if rr.flush != nil {
+		err := rr.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	b := make([]byte, readBlockSize)
+	idle := 0
+	for {
+		n, err := rr.r.readPort(b)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			rr.buf = b[1:n]
+			return b[0], nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, ErrTimeout
+		}
+		idle++
+		if rr.r.MaxIdleReads > 0 && idle >= rr.r.MaxIdleReads {
+			return 0, fmt.Errorf("%w: nothing received in %d reads", ErrTimeout, idle)
+		}
+	}
+}
+
+// unread hands what was read past the response back to the Repl.
+func (rr *responseReader) unread() {
+	rr.r.unread(append(append([]byte{}, rr.ahead...), rr.buf...))
+	rr.ahead = nil
+	rr.buf = nil
+}
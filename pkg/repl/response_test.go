@@ -0,0 +1,182 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFollowZeroLengthReads(t *testing.T) {
+	p := newFakePort("", "", "hel", "", "lo\r\n", "", "\x04", "", "\x04>")
+	p.chunk = 2
+	r := &Repl{Port: p}
+	out, errOut, err := r.Follow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello\n" || errOut != nil {
+		t.Fatalf("got %q, %q", out, errOut)
+	}
+}
+
+func TestFollowResponseTimeout(t *testing.T) {
+	// the device stops answering halfway and reads keep returning nothing
+	p := newFakePort("partial output")
+	r := &Repl{Port: p, ResponseTimeout: time.Millisecond * 50}
+	start := time.Now()
+	_, _, err := r.Follow(nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("gave up after %v", d)
+	}
+}
+
+func TestFollowMaxIdleReads(t *testing.T) {
+	p := newFakePort("partial output")
+	r := &Repl{Port: p, MaxIdleReads: 5}
+	_, _, err := r.Follow(nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if p.reads > 10 {
+		t.Fatalf("gave up after %d reads", p.reads)
+	}
+}
+
+func TestFollowEOF(t *testing.T) {
+	// the port is gone, reads fail right away
+	p := newFakePort("partial output")
+	p.err = io.EOF
+	r := &Repl{Port: p}
+	_, _, err := r.Follow(nil)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestFollowTimedOutEOF(t *testing.T) {
+	// drivers that report a read that timed out as io.EOF, after waiting
+	// most of the read timeout
+	p := newFakePort("hel", "", "lo\r\n", "", "", "\x04\x04>")
+	p.pause = time.Millisecond * 60
+	p.eofOnTimeout = true
+	r := &Repl{Port: p, readTimeout: time.Millisecond * 100}
+	out, errOut, err := r.Follow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello\n" || errOut != nil {
+		t.Fatalf("got %q, %q", out, errOut)
+	}
+}
+
+func TestFollowFraming(t *testing.T) {
+	tests := []struct {
+		response string
+		out      string
+		errOut   string
+	}{
+		{"\x04\x04>", "", ""},
+		{"hello\r\n\x04\x04>", "hello\n", ""},
+		{"\x00abc\x04\x04>", "\x00abc", ""},
+		{"a\x04b\x04\x04>", "a\x04b", ""},
+		{"a\x04\x04\x04>", "a\x04", ""},
+		{"\x04>\x04\x04>", "\x04>", ""},
+		{"a\x04>b\x04\x04>", "a\x04>b", ""},
+		{"out\x04Traceback\r\nValueError: x\r\n\x04>", "out", "Traceback\nValueError: x\n"},
+		{"a\x04b\x04Traceback\x04>", "a\x04b", "Traceback"},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int{0, 1, 3} {
+			p := newFakePort(tt.response)
+			p.chunk = chunk
+			r := &Repl{Port: p}
+			out, errOut, err := r.Follow(nil)
+			if err != nil {
+				t.Fatalf("%q: %v", tt.response, err)
+			}
+			if string(out) != tt.out || string(errOut) != tt.errOut {
+				t.Errorf("%q in chunks of %d: got %q, %q, want %q, %q", tt.response, chunk, out, errOut, tt.out, tt.errOut)
+			}
+			if tt.out == "" && out != nil {
+				t.Errorf("%q: empty output isn't nil", tt.response)
+			}
+			if len(p.rest()) > 0 || len(r.pending) > 0 {
+				t.Errorf("%q: read past the prompt", tt.response)
+			}
+		}
+	}
+}
+
+func TestFollowPauseAfterEOT(t *testing.T) {
+	// print('a\x04\x04', end=''); time.sleep(1.5); print('b', end='')
+	p := newFakePort("a\x04\x04")
+	for i := 0; i < 15; i++ {
+		p.queue("")
+	}
+	p.queue("b\x04\x04>", "after")
+	p.pause = time.Millisecond * 100
+	r := &Repl{Port: p}
+	out, _, err := r.Follow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a\x04\x04b" {
+		t.Fatalf("got %q", out)
+	}
+	if rest := append(r.pending, p.rest()...); string(rest) != "after" {
+		t.Fatalf("left %q", rest)
+	}
+}
+
+func TestExecCannedResponses(t *testing.T) {
+	tests := []struct {
+		response string
+		raw      bool
+		out      string
+	}{
+		{"OK/flash\x04\x04>", false, "/flash"},
+		{"OKboot.py\r\nmain.py\r\n\x04\x04>", false, "boot.py\nmain.py\n"},
+		{"OKboot.py\r\nmain.py\r\n\x04\x04>", true, "boot.py\r\nmain.py\r\n"},
+		{"OK\x04\x04>", false, ""},
+		{"OK\x00\x01\r\n\x04\x04>", true, "\x00\x01\r\n"},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int{0, 1, 2} {
+			for _, writer := range []bool{false, true} {
+				p := newFakePort()
+				p.chunk = chunk
+				response := tt.response
+				p.reply = func(b []byte) []byte {
+					if bytes.HasSuffix(b, []byte{0x04}) {
+						return []byte(response)
+					}
+					return nil
+				}
+				r := &Repl{Port: p, RawOutput: tt.raw}
+				var got []byte
+				var err error
+				if writer {
+					var buf bytes.Buffer
+					_, err = r.Exec([]byte("x"), &buf)
+					got = buf.Bytes()
+				} else {
+					got, err = r.Exec([]byte("x"), nil)
+				}
+				if err != nil {
+					t.Fatalf("%q: %v", tt.response, err)
+				}
+				if string(got) != tt.out {
+					t.Errorf("%q in chunks of %d, writer %v: got %q, want %q", tt.response, chunk, writer, got, tt.out)
+				}
+				if len(p.rest()) > 0 || len(r.pending) > 0 {
+					t.Errorf("%q: the prompt was left behind", tt.response)
+				}
+			}
+		}
+	}
+}
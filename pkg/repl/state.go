@@ -0,0 +1,150 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// ReplState is what the REPL of the device is waiting for, as far as
+// DetectReplState can tell from its prompt.
+type ReplState int
+
+const (
+	// StateUnknown is a device that answered with something unrecognised.
+	StateUnknown ReplState = iota
+	// StateSilent is a device that sent nothing at all.
+	StateSilent
+	// StateFriendly is the normal REPL at its >>> prompt.
+	StateFriendly
+	// StateContinuation is the normal REPL waiting for the rest of a
+	// statement at its ... prompt.
+	StateContinuation
+	// StatePaste is the paste mode entered with ctrl-E.
+	StatePaste
+	// StateRaw is the raw REPL entered with ctrl-A.
+	StateRaw
+)
+
+func (s ReplState) String() string {
+	switch s {
+	case StateSilent:
+		return "silent"
+	case StateFriendly:
+		return "friendly REPL"
+	case StateContinuation:
+		return "continuation prompt"
+	case StatePaste:
+		return "paste mode"
+	case StateRaw:
+		return "raw REPL"
+	}
+	return "unknown"
+}
+
+// hint explains a device found in state s after it didn't enter raw mode.
+func (s ReplState) hint() string {
+	switch s {
+	case StateSilent:
+		return "nothing was received, check the port and baudrate or reset the board"
+	case StateFriendly:
+		return "the device is at the >>> prompt but didn't answer ctrl-A"
+	case StateContinuation:
+		return "the REPL is waiting for the rest of a statement at the ... prompt"
+	case StatePaste:
+		return "the device is in paste mode, which ctrl-C should have cancelled"
+	case StateRaw:
+		return "the device is in the raw REPL but didn't answer ctrl-A"
+	}
+	return "the device answered with something unrecognised"
+}
+
+var (
+	// pasteBanner is printed when paste mode is entered and pastePrompt
+	// for each line in it.
+	pasteBanner = []byte("paste mode; Ctrl-C to cancel, Ctrl-D to finish")
+	pastePrompt = []byte("=== ")
+	// continuationPrompt is printed by the friendly REPL for the rest of
+	// a statement.
+	continuationPrompt = []byte("... ")
+)
+
+// stateTimeout is how long DetectReplState reads for.
+const stateTimeout = time.Millisecond * 500
+
+// DetectReplState sends a carriage return and tells from what comes back
+// in the next moment which mode the REPL is in. The friendly REPL and paste
+// mode answer with a prompt, the raw REPL buffers the line quietly, so a
+// raw REPL is only recognised by a banner or > prompt it printed before.
+func (r *Repl) DetectReplState() (ReplState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.detectReplState()
+}
+
+func (r *Repl) detectReplState() (ReplState, error) {
+	_, err := r.Port.Write([]byte("\r"))
+	if err != nil {
+		return StateUnknown, err
+	}
+	var received []byte
+	b := make([]byte, readBlockSize)
+	deadline := time.Now().Add(stateTimeout)
+	for time.Now().Before(deadline) && len(received) < maxReceived {
+		n, err := r.readPort(b)
+		if err != nil {
+			return StateUnknown, err
+		}
+		received = appendReceived(received, b[:n])
+	}
+	return replStateOf(received, r.rawBanner()), nil
+}
+
+// replStateOf recognises the state of the REPL from the last prompt or
+// banner in received, since the REPL may have left the mode of an earlier
+// one, like paste mode cancelled back to the >>> prompt.
+func replStateOf(received, banner []byte) ReplState {
+	b := bytes.TrimRight(received, "\r\n")
+	if len(b) == 0 {
+		return StateSilent
+	}
+	if bytes.HasSuffix(b, []byte(">")) {
+		// the raw REPL prompt, the others end in a space
+		return StateRaw
+	}
+	markers := []struct {
+		state ReplState
+		b     []byte
+	}{
+		{StatePaste, pasteBanner},
+		{StatePaste, pastePrompt},
+		{StateContinuation, continuationPrompt},
+		{StateFriendly, friendlyPrompt},
+		{StateRaw, bytes.TrimRight(banner, "\r\n")},
+	}
+	state, end := StateUnknown, -1
+	for _, m := range markers {
+		i := bytes.LastIndex(b, m.b)
+		if i >= 0 && i+len(m.b) > end {
+			state, end = m.state, i+len(m.b)
+		}
+	}
+	return state
+}
+
+// stateError adds what DetectReplState finds to err from EnterRawMode,
+// leaving err as it is when detecting fails. When the device doesn't answer
+// the carriage return, the state is told from received, what the device sent
+// during EnterRawMode.
+func (r *Repl) stateError(err error, received []byte) error {
+	s, derr := r.detectReplState()
+	if derr != nil {
+		return err
+	}
+	if s == StateSilent || s == StateUnknown {
+		if rs := replStateOf(received, r.rawBanner()); rs != StateSilent && rs != StateUnknown {
+			s = rs
+		}
+	}
+	return fmt.Errorf("%w: %s", err, s.hint())
+}
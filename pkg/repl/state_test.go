@@ -0,0 +1,30 @@
+package repl
+
+import "testing"
+
+func TestReplStateOf(t *testing.T) {
+	tests := []struct {
+		received string
+		want     ReplState
+	}{
+		{"", StateSilent},
+		{"\r\n", StateSilent},
+		{"\r\n>>> ", StateFriendly},
+		{"\r\n... ", StateContinuation},
+		{"\r\npaste mode; Ctrl-C to cancel, Ctrl-D to finish\r\n=== ", StatePaste},
+		{"=== \r\n=== ", StatePaste},
+		// cancelled back to the friendly REPL since the banner
+		{"paste mode; Ctrl-C to cancel, Ctrl-D to finish\r\n=== \r\n>>> ", StateFriendly},
+		{"paste mode; Ctrl-C to cancel, Ctrl-D to finish\r\n=== \r\n>>> \r\n... ", StateContinuation},
+		{"raw REPL; CTRL-B to exit\r\n>", StateRaw},
+		{"raw REPL; CTRL-B to exit\r\n", StateRaw},
+		{">>> \r\nraw REPL; CTRL-B to exit\r\n", StateRaw},
+		{"$GPGGA,123519,4807.038,N\r\n", StateUnknown},
+	}
+	for _, tt := range tests {
+		got := replStateOf([]byte(tt.received), DefaultRawBanner)
+		if got != tt.want {
+			t.Errorf("replStateOf(%q) = %v, want %v", tt.received, got, tt.want)
+		}
+	}
+}
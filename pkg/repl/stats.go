@@ -0,0 +1,75 @@
+package repl
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransferStats describes the data moved by a file transfer. Elapsed only
+// covers the chunk loop, not opening or closing the file on the device.
+type TransferStats struct {
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// KBps returns the throughput of the transfer in KB/s.
+func (s TransferStats) KBps() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / 1024 / s.Elapsed.Seconds()
+}
+
+// Add returns the combined stats of s and o.
+func (s TransferStats) Add(o TransferStats) TransferStats {
+	return TransferStats{
+		Bytes:   s.Bytes + o.Bytes,
+		Elapsed: s.Elapsed + o.Elapsed,
+	}
+}
+
+// String formats the stats for display.
+func (s TransferStats) String() string {
+	return fmt.Sprintf(
+		"%d bytes in %.2fs (%.2f KB/s)",
+		s.Bytes,
+		s.Elapsed.Seconds(),
+		s.KBps(),
+	)
+}
+
+// UploadSummary describes the outcome of an Upload.
+type UploadSummary struct {
+	FilesUploaded int
+	// FilesSkipped counts files left out by the exclude patterns or because
+	// they already exist with UploadOptions.SkipExisting.
+	FilesSkipped int
+	// FilesUnchanged counts files left out by UploadOptions.SkipUnchanged.
+	FilesUnchanged   int
+	BytesTransferred int64
+	Duration         time.Duration
+	// Errors holds an error for each file that couldn't be uploaded.
+	Errors []error
+}
+
+// String formats the summary for display.
+func (s UploadSummary) String() string {
+	files := "files"
+	if s.FilesUploaded == 1 {
+		files = "file"
+	}
+	msg := fmt.Sprintf(
+		"Uploaded %d %s (%.1f KB) in %.1fs",
+		s.FilesUploaded,
+		files,
+		float64(s.BytesTransferred)/1024,
+		s.Duration.Seconds(),
+	)
+	if s.FilesUnchanged > 0 {
+		msg += fmt.Sprintf(", %d unchanged", s.FilesUnchanged)
+	}
+	if s.FilesSkipped > 0 {
+		msg += fmt.Sprintf(", skipped %d", s.FilesSkipped)
+	}
+	return msg
+}
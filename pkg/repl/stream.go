@@ -0,0 +1,82 @@
+package repl
+
+import (
+	"bytes"
+	"io"
+)
+
+// Stream executes code and writes its output to w a line at a time, calling
+// stop with each line, without its line ending, as it arrives. Once stop
+// returns true the code is interrupted with ctrl-C. The rest of the output is
+// still written to w but stop isn't called again, and the KeyboardInterrupt
+// that follows isn't returned as an error. Other exceptions are returned as
+// Exec returns them.
+func (r *Repl) Stream(code []byte, w io.Writer, stop func(line []byte) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lw := &lineWriter{w: w}
+	stopped := false
+	lw.fn = func(line []byte) error {
+		if stopped || stop == nil || !stop(bytes.TrimSuffix(line, []byte("\r"))) {
+			return nil
+		}
+		stopped = true
+		// ctrl-C: interrupt running code
+		_, err := r.Port.Write([]byte("\x03"))
+		return err
+	}
+	res, err := r.execResult(code, lw, nil)
+	if err != nil {
+		return err
+	}
+	err = lw.Flush()
+	if err != nil {
+		return err
+	}
+	e := res.Exception
+	if e == nil || stopped && e.Type == "KeyboardInterrupt" {
+		return nil
+	}
+	return exceptionError(e)
+}
+
+// lineWriter passes whole lines on to w and fn, holding back the end of a
+// write until its line is complete.
+type lineWriter struct {
+	w   io.Writer
+	fn  func(line []byte) error
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		err := l.line(l.buf[:i+1])
+		l.buf = l.buf[i+1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush passes on a last line that doesn't end with a newline.
+func (l *lineWriter) Flush() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.line(l.buf)
+	l.buf = nil
+	return err
+}
+
+func (l *lineWriter) line(b []byte) error {
+	_, err := l.w.Write(b)
+	if err != nil {
+		return err
+	}
+	return l.fn(bytes.TrimSuffix(b, []byte("\n")))
+}
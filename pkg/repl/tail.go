@@ -0,0 +1,136 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// copyRangeCode writes n bytes of the open file f from its current position
+// to stdout, or everything up to the end when n is negative. Bytes are written
+// as they are so multi-byte characters split across chunks survive.
+const copyRangeCode = `import sys
+while n != 0:
+	b = f.read(256 if n < 0 else min(256, n))
+	if not b:
+		break
+	sys.stdout.write(b)
+	if n > 0:
+		n -= len(b)
+f.close()
+`
+
+// tailStartCode sets s to the offset of the last n lines of the open file f,
+// scanning backwards from the end in chunks so only those lines are sent.
+const tailStartCode = osImport + `def _tail(f, size, n):
+	pos = size
+	count = 0
+	while pos > 0:
+		c = min(256, pos)
+		pos -= c
+		f.seek(pos)
+		b = f.read(c)
+		i = len(b)
+		while i > 0:
+			i -= 1
+			if b[i] == 10 and pos + i != size - 1:
+				count += 1
+				if count == n:
+					return pos + i + 1
+	return 0
+s = _tail(f, uos.stat(p)[6], l)
+del _tail
+`
+
+// Head writes the first n lines of the remote file f to w.
+func (r *Repl) Head(w io.Writer, f string, n int) error {
+	code := "import sys\nf = open(" + pyString(f) + ", 'rb')\n" +
+		"for i in range(" + strconv.Itoa(n) + "):\n" +
+		"\tb = f.readline()\n\tif not b:\n\t\tbreak\n\tsys.stdout.write(b)\n" +
+		"f.close()\n"
+	_, err := r.Exec([]byte(code), w)
+	return err
+}
+
+// HeadBytes writes the first n bytes of the remote file f to w.
+func (r *Repl) HeadBytes(w io.Writer, f string, n int64) error {
+	return r.CatRange(w, f, 0, n)
+}
+
+// Tail writes the last n lines of the remote file f to w.
+func (r *Repl) Tail(w io.Writer, f string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	code := "p = " + pyString(f) + "\nl = " + strconv.Itoa(n) + "\n" +
+		"f = open(p, 'rb')\n" + tailStartCode +
+		"f.seek(s)\nn = -1\n" + copyRangeCode
+	_, err := r.Exec([]byte(code), w)
+	return err
+}
+
+// TailBytes writes the last n bytes of the remote file f to w.
+func (r *Repl) TailBytes(w io.Writer, f string, n int64) error {
+	code := osImport + "p = " + pyString(f) + "\n" +
+		"f = open(p, 'rb')\n" +
+		"f.seek(max(0, uos.stat(p)[6] - " + strconv.FormatInt(n, 10) + "))\n" +
+		"n = -1\n" + copyRangeCode
+	_, err := r.Exec([]byte(code), w)
+	return err
+}
+
+// CatRange writes n bytes of the remote file f starting at offset to w, or
+// everything from offset on when n is negative.
+func (r *Repl) CatRange(w io.Writer, f string, offset, n int64) error {
+	code := "f = open(" + pyString(f) + ", 'rb')\n" +
+		"f.seek(" + strconv.FormatInt(offset, 10) + ")\n" +
+		"n = " + strconv.FormatInt(n, 10) + "\n" + copyRangeCode
+	_, err := r.Exec([]byte(code), w)
+	return err
+}
+
+// Size returns the size of the remote file f in bytes.
+func (r *Repl) Size(f string) (int64, error) {
+	code := []byte(osImport + "print(uos.stat(" + pyString(f) + ")[6],end='')")
+	if r.useHelper() {
+		code = []byte("_zap.stat(" + pyString(f) + ",6)")
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(b.String(), 10, 64)
+}
+
+// Sizes returns the sizes of the remote files in paths in a single exchange.
+func (r *Repl) Sizes(paths []string) ([]int64, error) {
+	var list strings.Builder
+	list.WriteString("[")
+	for _, p := range paths {
+		list.WriteString(pyString(p) + ",")
+	}
+	list.WriteString("]")
+	code := osImport + "for p in " + list.String() + ":\n\tprint(uos.stat(p)[6])\n"
+	if r.useHelper() {
+		code = "_zap.sizes(" + list.String() + ")"
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(b.String())
+	if len(fields) != len(paths) {
+		return nil, fmt.Errorf("got %d sizes for %d files", len(fields), len(paths))
+	}
+	sizes := make([]int64, len(fields))
+	for i, f := range fields {
+		sizes[i], err = strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
@@ -0,0 +1,89 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// tcpScheme prefixes devices reached through a serial bridge such as
+// zap serve.
+const tcpScheme = "tcp://"
+
+// isTCP reports whether device names a TCP bridge instead of a serial port.
+func isTCP(device string) bool {
+	return strings.HasPrefix(device, tcpScheme)
+}
+
+// busyWait is how long openTCP waits for a busy rejection from the bridge.
+const busyWait = time.Millisecond * 200
+
+// tcpPort is a Port talking to a raw TCP serial bridge. The serial settings
+// are up to the bridge, so the control line methods return ErrUnsupported.
+type tcpPort struct {
+	conn        net.Conn
+	readTimeout time.Duration
+	// pending holds what arrived while checking whether the bridge is busy.
+	pending []byte
+}
+
+// openTCP connects to the bridge at device, a tcp://host:port address.
+func openTCP(device string, readTimeout time.Duration) (Port, error) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(device, tcpScheme))
+	if err != nil {
+		return nil, err
+	}
+	// a bridge serving someone else says so and hangs up right away
+	conn.SetReadDeadline(time.Now().Add(busyWait))
+	b := make([]byte, 64)
+	n, _ := conn.Read(b)
+	if bytes.HasPrefix(b[:n], []byte("busy")) {
+		conn.Close()
+		return nil, fmt.Errorf("%s is %s", device, strings.TrimSpace(string(b[:n])))
+	}
+	// anything else is device output, like a prompt, and is read first
+	return &tcpPort{conn: conn, readTimeout: readTimeout, pending: b[:n]}, nil
+}
+
+// Read returns zero bytes without an error when nothing arrives within the
+// read timeout, like a serial port.
+func (p *tcpPort) Read(b []byte) (int, error) {
+	if len(p.pending) > 0 {
+		n := copy(b, p.pending)
+		p.pending = p.pending[n:]
+		return n, nil
+	}
+	p.conn.SetReadDeadline(time.Now().Add(p.readTimeout))
+	n, err := p.conn.Read(b)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return n, nil
+	}
+	return n, err
+}
+
+func (p *tcpPort) Write(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *tcpPort) Close() error {
+	return p.conn.Close()
+}
+
+func (p *tcpPort) SetReadTimeout(t time.Duration) error {
+	p.readTimeout = t
+	return nil
+}
+
+func (p *tcpPort) SetDTR(dtr bool) error {
+	return ErrUnsupported
+}
+
+func (p *tcpPort) SetRTS(rts bool) error {
+	return ErrUnsupported
+}
+
+func (p *tcpPort) Break(d time.Duration) error {
+	return ErrUnsupported
+}
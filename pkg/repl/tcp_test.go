@@ -0,0 +1,51 @@
+package repl
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bridge listens on localhost and sends greeting to the first client.
+func bridge(t *testing.T, greeting string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(greeting))
+		time.Sleep(time.Second)
+		conn.Close()
+	}()
+	return tcpScheme + l.Addr().String()
+}
+
+func TestOpenTCPKeepsGreeting(t *testing.T) {
+	// the bridge passes on a prompt the device printed right away
+	p, err := openTCP(bridge(t, ">>> "), time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	b := make([]byte, 64)
+	n, err := p.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != ">>> " {
+		t.Fatalf("got %q", b[:n])
+	}
+}
+
+func TestOpenTCPBusy(t *testing.T) {
+	_, err := openTCP(bridge(t, "busy: another client is connected\r\n"), time.Millisecond*100)
+	if err == nil || !strings.Contains(err.Error(), "busy: another client is connected") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WalkFunc is called by Walk for each file and directory. Size is zero for
+// directories.
+type WalkFunc func(path string, isDir bool, size int64) error
+
+// walkCode prints a tab separated line for everything under root: d for a
+// directory or f and the size for a file, followed by the path.
+const walkCode = osImport + `def _walk(d):
+	for e in uos.ilistdir(d):
+		p = (d if d.endswith('/') else d + '/') + e[0]
+		if e[1] & 0x4000:
+			print('d\t0\t' + p)
+			_walk(p)
+		else:
+			print('f\t%d\t%s' % (uos.stat(p)[6], p))
+_walk(root)
+del _walk
+`
+
+// Walk calls fn for every file and directory under root on the device,
+// directories before their contents. The tree is listed in one exchange
+// before fn is first called, so fn is free to use the Repl.
+func (r *Repl) Walk(root string, fn WalkFunc) error {
+	code := []byte("root = " + pyString(root) + "\n" + walkCode)
+	if r.useHelper() {
+		code = []byte("_zap.walk(" + pyString(root) + ")")
+	}
+	b := &strings.Builder{}
+	_, err := r.Exec(code, b)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("unexpected walk output %q", line)
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected walk output %q", line)
+		}
+		err = fn(parts[2], parts[0] == "d", size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// wipeRootsCode prints a tab separated line for each entry in the root
+// directory: f for a file, d for a directory, m for another writable mount
+// and r for a read-only or virtual mount (one that reports no blocks, sets
+// ST_RDONLY or has no statvfs at all), followed by the path.
+const wipeRootsCode = osImport + `_r = uos.statvfs('/')
+for _e in uos.ilistdir('/'):
+	_p = '/' + _e[0]
+	_k = 'd' if _e[1] & 0x4000 else 'f'
+	if _k == 'd':
+		try:
+			_s = uos.statvfs(_p)
+			if _s != _r:
+				_k = 'r' if _s[2] == 0 or _s[8] & 1 else 'm'
+		except Exception:
+			_k = 'r'
+	print(_k + '\t' + _p)
+del _r
+`
+
+// rmTreeCode defines _rmtree, which removes p and everything under it and
+// returns the number of files removed. keep leaves the directory p itself in
+// place.
+const rmTreeCode = osImport + `def _rm(p):
+	n = 0
+	for e in list(uos.ilistdir(p)):
+		f = (p if p.endswith('/') else p + '/') + e[0]
+		if e[1] & 0x4000:
+			n += _rm(f)
+			uos.rmdir(f)
+		else:
+			uos.remove(f)
+			n += 1
+	return n
+def _rmtree(p, keep):
+	if uos.stat(p)[0] & 0x4000:
+		n = _rm(p)
+		if not keep:
+			uos.rmdir(p)
+		return n
+	uos.remove(p)
+	return 1
+`
+
+// RmTree removes the file or directory p and everything in it and returns the
+// number of files removed.
+func (r *Repl) RmTree(p string) (int, error) {
+	return r.rmTree(p, false)
+}
+
+// rmTree is RmTree, leaving the directory p itself in place when keep is set.
+func (r *Repl) rmTree(p string, keep bool) (int, error) {
+	// the arguments are passed rather than put in place in the code, a path
+	// can contain anything
+	code := rmTreeCode + "print(_rmtree(" + pyString(p) + ", " + pyBool(keep) + "))\ndel _rm, _rmtree\n"
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(code), b)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(b.String()))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected rmtree output %q", b.String())
+	}
+	return n, nil
+}
+
+// WipeOptions configures WipeWithOptions.
+type WipeOptions struct {
+	// DryRun removes nothing, OnRemove is still called for everything that
+	// would be removed.
+	DryRun bool
+	// OnRemove is called for each file and directory removed when set. With
+	// DryRun it's called for every path, otherwise only for the top level
+	// ones as their contents are removed on the device in one go.
+	OnRemove func(path string, isDir bool)
+	// OnSkip is called with each read-only or virtual mount left alone when
+	// set.
+	OnSkip func(path string)
+}
+
+// Wipe deletes every file and directory on the device, leaving the
+// filesystem as if it had just been formatted. Read-only and virtual mounts
+// are left alone and other mount points are emptied rather than removed. It
+// returns the number of files removed.
+func (r *Repl) Wipe() (int, error) {
+	return r.WipeWithOptions(WipeOptions{})
+}
+
+// WipeWithOptions is Wipe configured by opts. With DryRun the returned count
+// is the number of files that would be removed.
+func (r *Repl) WipeWithOptions(opts WipeOptions) (int, error) {
+	b := &strings.Builder{}
+	_, err := r.Exec([]byte(wipeRootsCode), b)
+	if err != nil {
+		return 0, err
+	}
+	if !opts.DryRun {
+		// the working directory may be about to go away
+		_, err = r.Exec([]byte(osImport+"uos.chdir('/')"), nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	total := 0
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return total, fmt.Errorf("unexpected wipe output %q", line)
+		}
+		kind, p := parts[0], parts[1]
+		if kind == "r" {
+			if opts.OnSkip != nil {
+				opts.OnSkip(p)
+			}
+			continue
+		}
+		if opts.DryRun {
+			n, err := r.planWipe(p, kind, opts.OnRemove)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+		n, err := r.rmTree(p, kind == "m")
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if opts.OnRemove != nil && kind != "m" {
+			opts.OnRemove(p, kind == "d")
+		}
+	}
+	return total, nil
+}
+
+// planWipe calls fn for everything under the top level entry p that
+// WipeWithOptions would remove and returns the number of files.
+func (r *Repl) planWipe(p, kind string, fn func(string, bool)) (int, error) {
+	if fn == nil {
+		fn = func(string, bool) {}
+	}
+	if kind == "f" {
+		fn(p, false)
+		return 1, nil
+	}
+	if kind == "d" {
+		fn(p, true)
+	}
+	n := 0
+	err := r.Walk(p, func(name string, isDir bool, size int64) error {
+		if !isDir {
+			n++
+		}
+		fn(name, isDir)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,34 @@
+package repl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRmTreeCode(t *testing.T) {
+	for _, p := range []string{"/lib", "/KEEPSAKE", "/ROOT/KEEP", `/it's "quoted"`} {
+		for _, keep := range []bool{false, true} {
+			dev := newFakePort()
+			dev.reply = rawREPL("3\r\n")
+			r := &Repl{Port: dev}
+			n, err := r.rmTree(p, keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 3 {
+				t.Fatalf("got %d files", n)
+			}
+			code := dev.written.String()
+			if !strings.Contains(code, rmTreeCode) {
+				t.Fatalf("%s: the code was changed:\n%s", p, code)
+			}
+			call := "print(_rmtree(" + pyString(p) + ", " + pyBool(keep) + "))"
+			if !strings.Contains(code, call) {
+				t.Errorf("%s: no %s in:\n%s", p, call, code)
+			}
+			if strings.Count(code, pyString(p)) != 1 {
+				t.Errorf("%s: path used more than once", p)
+			}
+		}
+	}
+}
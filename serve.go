@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// busyMessage is sent to clients that connect while another one is served.
+const busyMessage = "busy: another client is connected\r\n"
+
+func cmdServe(ctx *cli.Context) error {
+	devices, err := deviceNames(ctx)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ln, err := net.Listen("tcp", ctx.String("listen"))
+	if err != nil {
+		return err
+	}
+	c, cancel := interruptContext()
+	defer cancel()
+	go func() {
+		<-c.Done()
+		ln.Close()
+	}()
+	info.Printf("Serving %s on tcp://%s\n", devices[0], ln.Addr())
+	var busy int32
+	portErr := make(chan error, 1)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case err := <-portErr:
+				return err
+			default:
+			}
+			if c.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !atomic.CompareAndSwapInt32(&busy, 0, 1) {
+			conn.Write([]byte(busyMessage))
+			conn.Close()
+			continue
+		}
+		info.Println("Client connected from", conn.RemoteAddr())
+		go func() {
+			defer atomic.StoreInt32(&busy, 0)
+			err := bridge(r, conn)
+			info.Println("Client disconnected from", conn.RemoteAddr())
+			if err != nil {
+				// the serial port is gone, stop serving
+				portErr <- err
+				ln.Close()
+			}
+		}()
+	}
+}
+
+// bridge copies data between the serial port and conn until either side
+// disconnects. It only returns an error when the serial port failed.
+func bridge(r *repl.Repl, conn net.Conn) error {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(r.Port, conn)
+		close(done)
+	}()
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	b := make([]byte, 1024)
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		// returns empty after the read timeout so done is checked
+		n, err := r.ReadOutput(b)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			_, err = conn.Write(b[:n])
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/console"
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+	"golang.org/x/term"
+)
+
+const shellHelp = `Commands:
+   cat file              Print a file
+   cd dir                Change directory
+   connect device [baud] Switch to another device
+   get [local] remote    Copy a file from the device
+   ls                    List files
+   mkdir dir             Make directory
+   put remote [local]    Copy a file to the device
+   pwd                   Print working directory
+   reboot                Perform a soft reboot
+   repl                  Open the REPL, ctrl-] comes back here
+   rm file               Delete file
+   rmdir dir             Remove directory
+   run file              Execute a local Python file without copying it
+   exit                  Leave the shell`
+
+// shellCommands are the names completed at the start of a line.
+var shellCommands = []string{
+	"cat", "cd", "connect", "exit", "get", "help", "ls", "mkdir", "put",
+	"pwd", "reboot", "repl", "rm", "rmdir", "run",
+}
+
+// shellExitKey is ctrl-], which leaves the REPL opened from the shell.
+const shellExitKey = 0x1d
+
+// shell reads commands at a prompt and runs them over one connection. The
+// device stays in raw mode between commands, so its working directory and
+// globals carry over from one to the next.
+type shell struct {
+	r       *repl.Repl
+	console console.Console
+	term    *term.Terminal
+	// baud is used by connect when no rate is given
+	baud int
+	// names caches remote directory listings for completion until the next
+	// command runs
+	names map[string][]string
+}
+
+func cmdShell(ctx *cli.Context) error {
+	if !isTerminal(os.Stdin) {
+		return usagef("shell needs a terminal")
+	}
+	opts, err := connectOptions(ctx)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	current := console.Current()
+	defer current.Reset()
+	s := &shell{
+		r:       r,
+		console: current,
+		baud:    opts.Baud,
+		term: term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "zap> "),
+	}
+	s.term.AutoCompleteCallback = s.complete
+	return s.run()
+}
+
+// run reads and runs commands until exit or ctrl-D. Errors are printed and
+// the shell carries on.
+func (s *shell) run() error {
+	for {
+		line, err := s.readLine()
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		err = s.exec(args)
+		s.names = nil
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+		}
+	}
+}
+
+// readLine puts the terminal in raw mode for line editing while the prompt
+// is up and back for the command.
+func (s *shell) readLine() (string, error) {
+	err := s.console.SetRaw()
+	if err != nil {
+		return "", err
+	}
+	defer s.console.Reset()
+	if size, err := s.console.Size(); err == nil {
+		s.term.SetSize(int(size.Width), int(size.Height))
+	}
+	return s.term.ReadLine()
+}
+
+// exec runs a single command.
+func (s *shell) exec(args []string) error {
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch args[0] {
+	case "cat", "get", "mkdir", "rm", "rmdir":
+		if len(args) < 2 {
+			return fmt.Errorf("%s needs a remote path", args[0])
+		}
+		// like the get command, the remote path of get comes last
+		err := checkRemotePaths(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+	case "put", "run":
+		if len(args) < 2 {
+			return fmt.Errorf("%s needs a local file", args[0])
+		}
+	}
+	switch args[0] {
+	case "cat":
+		return catFile(s.r, os.Stdout, args[1], false, false, repl.CatOptions{})
+	case "cd":
+		d := arg(1)
+		if d == "" {
+			d = "/"
+		}
+		return s.r.Cd(d)
+	case "connect":
+		return s.connect(args[1:])
+	case "get":
+		local, remote := getArgs(args[1:])
+		if len(args) > 2 {
+			l, err := localTarget(local, path.Base(remote))
+			if err != nil {
+				return err
+			}
+			local = l
+		}
+		return getFile(s.r, local, remote, transferOpts{preserveTimes: true})
+	case "help":
+		fmt.Println(shellHelp)
+	case "ls":
+		fs, err := s.r.Ls()
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			fmt.Println(f)
+		}
+	case "mkdir":
+		return s.r.Mkdir(args[1])
+	case "put":
+		remote, local := putArgs(args[1:])
+		err := checkRemotePaths(remote)
+		if err != nil {
+			return err
+		}
+		remote, err = s.r.TargetPath(remote, filepath.Base(local))
+		if err != nil {
+			return err
+		}
+		return putFile(s.r, remote, local, transferOpts{preserveTimes: true})
+	case "pwd":
+		cwd, err := s.r.Cwd()
+		if err != nil {
+			return err
+		}
+		fmt.Println(cwd)
+	case "reboot":
+		return s.r.SoftReboot()
+	case "repl":
+		return s.repl()
+	case "rm":
+		return s.r.Rm(args[1])
+	case "rmdir":
+		return s.r.Rmdir(args[1])
+	case "run":
+		c, cancel := interruptContext()
+		defer cancel()
+		err := s.r.ExecFile(c, args[1], os.Stdout)
+		var e *repl.MicroPythonError
+		if errors.As(err, &e) {
+			fmt.Fprint(os.Stderr, e.Traceback)
+			return nil
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return nil
+}
+
+// connect switches the shell to another device, see Repl.Reconnect.
+func (s *shell) connect(args []string) error {
+	if len(args) == 0 {
+		return errors.New("connect needs a device")
+	}
+	baud := s.baud
+	if len(args) > 1 {
+		b, err := strconv.Atoi(args[1])
+		if err != nil || b <= 0 {
+			return fmt.Errorf("invalid baud rate %q", args[1])
+		}
+		baud = b
+	}
+	err := s.r.Reconnect(args[0], baud)
+	// on failure the old device was reopened, at the normal REPL too
+	rerr := s.r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	if rerr != nil {
+		return rerr
+	}
+	s.baud = baud
+	info.Println("Connected to", args[0])
+	return nil
+}
+
+// repl passes the terminal through to the friendly REPL until ctrl-] and
+// then goes back to raw mode for the next command.
+func (s *shell) repl() (err error) {
+	err = s.r.ExitRawMode()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// ctrl-C: raw mode can only be entered from an idle prompt
+		_, werr := s.r.Write([]byte("\x03"))
+		if werr == nil {
+			werr = s.r.EnterRawMode()
+		}
+		if err == nil {
+			err = werr
+		}
+	}()
+	// leaving raw mode consumed the prompt, ask for a fresh one
+	_, err = s.r.Write([]byte("\r"))
+	if err != nil {
+		return err
+	}
+	err = s.console.SetRaw()
+	if err != nil {
+		return err
+	}
+	defer s.console.Reset()
+	rs := &replSession{
+		r:       s.r,
+		console: s.console,
+		// the exit key comes first, so the menu never opens
+		menuKey: shellExitKey,
+		exitKey: shellExitKey,
+	}
+	err = rs.run()
+	fmt.Print("\r\n")
+	return err
+}
+
+// complete is the AutoCompleteCallback of the terminal. Tab completes the
+// word before the cursor as a command name, a local file for the arguments
+// of put and run, or a remote path.
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	start := strings.LastIndex(head, " ") + 1
+	cur := head[start:]
+	words := strings.Fields(head[:start])
+	var names []string
+	switch {
+	case len(words) == 0:
+		names = shellCommands
+	case words[0] == "run" || words[0] == "put" && len(words) >= 2:
+		names = localNames(cur)
+	default:
+		names = s.remoteNames(cur)
+	}
+	var matches []string
+	for _, n := range names {
+		if strings.HasPrefix(n, cur) {
+			matches = append(matches, n)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	word := commonPrefix(matches)
+	if len(matches) == 1 && !strings.HasSuffix(word, "/") {
+		word += " "
+	}
+	return head[:start] + word + line[pos:], start + len(word), true
+}
+
+// remoteNames completes cur with the remote directory it's in. The listing
+// of each directory is kept in s.names so pressing tab again doesn't ask the
+// device, and is dropped after every command since it may change files.
+func (s *shell) remoteNames(cur string) []string {
+	dir := cur[:strings.LastIndex(cur, "/")+1]
+	if names, ok := s.names[dir]; ok {
+		return names
+	}
+	names, err := remoteNames(s.r, cur)
+	if err != nil {
+		return nil
+	}
+	if s.names == nil {
+		s.names = make(map[string][]string)
+	}
+	s.names[dir] = names
+	return names
+}
+
+// localNames lists the local directory cur is in like remoteNames.
+func localNames(cur string) []string {
+	names, _ := filepath.Glob(cur + "*")
+	for i, n := range names {
+		if fi, err := os.Stat(n); err == nil && fi.IsDir() {
+			names[i] = n + "/"
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commonPrefix returns the longest prefix shared by all of names.
+func commonPrefix(names []string) string {
+	p := names[0]
+	for _, n := range names[1:] {
+		for !strings.HasPrefix(n, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli"
+	"github.com/wybiral/zap/pkg/repl"
+)
+
+// watchDebounce is how long watch waits for more changes before uploading.
+const watchDebounce = time.Millisecond * 300
+
+func cmdWatch(ctx *cli.Context) error {
+	dir := ctx.Args().Get(0)
+	if dir == "" {
+		dir = "."
+	}
+	ignore, err := readIgnoreFile(dir)
+	if err != nil {
+		return err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	err = w.Add(dir)
+	if err != nil {
+		return err
+	}
+	r, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.EnterRawMode()
+	if err != nil {
+		return err
+	}
+	defer r.ExitRawMode()
+	c, cancel := interruptContext()
+	defer cancel()
+	stop := follow(c, r)
+	changed := map[string]bool{}
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-c.Done():
+			stop()
+			return nil
+		case err := <-w.Errors:
+			fmt.Fprintln(os.Stderr, "watch error:", err)
+		case ev := <-w.Events:
+			name := filepath.Base(ev.Name)
+			if name == ignoreFile || name == repl.ManifestFile || repl.MatchesIgnore(ignore, name) {
+				continue
+			}
+			changed[name] = true
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			stop()
+			syncChanges(r, dir, changed, ctx.Bool("delete"))
+			changed = map[string]bool{}
+			stop = follow(c, r)
+		}
+	}
+}
+
+// follow soft reboots the board and streams the output of main.py until the
+// returned stop function is called.
+func follow(ctx context.Context, r *repl.Repl) func() {
+	c, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		info.Println("--- soft reboot ---")
+		err := r.SoftRebootAndFollow(c, os.Stdout)
+		if err != nil && c.Err() == nil {
+			fmt.Fprintln(os.Stderr, "\nERROR:", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// syncChanges uploads changed files that still exist and deletes the others
+// from the device when del is set. Errors are printed, not returned, so
+// watching carries on.
+func syncChanges(r *repl.Repl, dir string, changed map[string]bool, del bool) {
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			if del {
+				info.Println("Deleting", name, "...")
+				err = r.Rm(name)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR:", err)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		info.Println("Uploading", name, "...")
+		err = putFile(r, name, filepath.Join(dir, name), transferOpts{atomic: repl.CriticalFile(name)})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+		}
+	}
+}
+
+// ignoreFile lists file name patterns that shouldn't be copied to the device.
+const ignoreFile = ".zapignore"
+
+// readIgnoreFile returns the patterns from the .zapignore file in dir, if any.
+// Blank lines and lines starting with # are skipped.
+func readIgnoreFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, ignoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, s.Err()
+}